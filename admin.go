@@ -0,0 +1,223 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module that serves the version of the plugin at
+// /conneg/version, the list, the warnings and the health of all provisioned
+// conneg matchers at the /conneg/matchers, /conneg/warnings and
+// /conneg/health endpoints of the admin API, the aliases and offers of matchers with
+// ExposeAdmin at /conneg/<registry key>/aliases and /conneg/<registry key>/offers,
+// and the recent negotiations of matchers with a HistorySize at
+// /conneg/<registry key>/history.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.conneg",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the routes for the admin endpoint.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/conneg/version",
+			Handler: caddy.AdminHandlerFunc(a.handleVersion),
+		},
+		{
+			Pattern: "/conneg/matchers",
+			Handler: caddy.AdminHandlerFunc(a.handleMatchers),
+		},
+		{
+			Pattern: "/conneg/warnings",
+			Handler: caddy.AdminHandlerFunc(a.handleWarnings),
+		},
+		{
+			Pattern: "/conneg/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/conneg/",
+			Handler: caddy.AdminHandlerFunc(a.handleInstance),
+		},
+	}
+}
+
+// handleVersion writes the Version of the plugin.
+func (adminAPI) handleVersion(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"version": Version})
+}
+
+// matcherInfo describes a matcher in the list of /conneg/matchers.
+type matcherInfo struct {
+	Example   string `json:"example,omitempty"`
+	SourceTag string `json:"source_tag,omitempty"`
+}
+
+// handleMatchers writes the matchers in the Registry, by registry key, along
+// with their ExampleComment and SourceTag.
+func (adminAPI) handleMatchers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	matchers := make(map[string]matcherInfo)
+	Registry.Range(func(key, value interface{}) bool {
+		if m, ok := value.(*MatchConneg); ok {
+			matchers[key.(string)] = matcherInfo{Example: m.ExampleComment, SourceTag: m.SourceTag}
+		}
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(matchers)
+}
+
+// handleWarnings writes the warnings of the matchers in the Registry, by
+// registry key.
+func (adminAPI) handleWarnings(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	warnings := make(map[string][]Warning)
+	Registry.Range(func(key, value interface{}) bool {
+		if m, ok := value.(*MatchConneg); ok && len(m.warnings) > 0 {
+			warnings[key.(string)] = m.warnings
+		}
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(warnings)
+}
+
+// handleHealth writes the result of HealthCheck for the matchers in the
+// Registry, by registry key: `ok` or the error. The status is 503 Service
+// Unavailable if any of the matchers is unhealthy.
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	health, status := make(map[string]string), http.StatusOK
+	Registry.Range(func(key, value interface{}) bool {
+		if m, ok := value.(*MatchConneg); ok {
+			health[key.(string)] = "ok"
+			if err := m.HealthCheck(); err != nil {
+				health[key.(string)], status = err.Error(), http.StatusServiceUnavailable
+			}
+		}
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(health)
+}
+
+// handleInstance writes the aliases or the offers of a single matcher, which
+// has to have ExposeAdmin set, or its history, which has to be enabled with
+// HistorySize.
+func (adminAPI) handleInstance(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/conneg/")
+	slash := strings.LastIndex(path, "/")
+	if slash < 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown endpoint: %s", r.URL.Path),
+		}
+	}
+	key, resource := path[:slash], path[slash+1:]
+	value, ok := Registry.Load(key)
+	m, isMatcher := value.(*MatchConneg)
+	if ok && isMatcher && resource == "history" && m.history != nil {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(m.history.entries())
+	}
+	if !ok || !isMatcher || !m.ExposeAdmin {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no conneg matcher exposed as '%s'", key),
+		}
+	}
+
+	var result interface{}
+	switch resource {
+	case "aliases":
+		if m.DisableBuiltinAliases {
+			result = map[string][]string{}
+		} else {
+			result = aliasMap()
+		}
+	case "offers":
+		offers := make(map[string][]string)
+		for name, list := range map[string][]string{
+			"match_types":         m.MatchTypes,
+			"match_languages":     m.MatchLanguages,
+			"match_charsets":      m.MatchCharsets,
+			"match_encodings":     m.MatchEncodings,
+			"match_content_types": m.MatchContentTypes,
+		} {
+			if len(list) > 0 {
+				offers[name] = list
+			}
+		}
+		result = offers
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown endpoint: %s", r.URL.Path),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,96 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elnormous/contenttype"
+)
+
+// clientHintHeaders are the client hints that UseClientHints asks browsers
+// for in the Accept-CH response header.
+var clientHintHeaders = []string{"Sec-CH-UA-Full-Version-List"}
+
+// clientHintFormats lists the types browsers support from a major version
+// on, by the brand they give in the Sec-CH-UA headers. (Only browsers based
+// on Chromium send these headers so far.)
+var clientHintFormats = []struct {
+	brand     string
+	version   int
+	mediaType string
+}{
+	{"Chromium", 85, "image/avif"},
+	{"Chromium", 32, "image/webp"},
+}
+
+// clientHintBrands returns the major version of each brand the client gives
+// in its Sec-CH-UA-Full-Version-List header, or in its Sec-CH-UA header if
+// there is no full version list, as in `"Chromium";v="119.0.6045.105"`.
+func clientHintBrands(r *http.Request) map[string]int {
+	header := strings.Join(r.Header.Values("Sec-CH-UA-Full-Version-List"), ", ")
+	if len(header) == 0 {
+		header = strings.Join(r.Header.Values("Sec-CH-UA"), ", ")
+	}
+	brands := make(map[string]int)
+	for _, entry := range strings.Split(header, ",") {
+		parts := strings.Split(entry, ";")
+		brand := strings.Trim(strings.TrimSpace(parts[0]), `"`)
+		for _, param := range parts[1:] {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || key != "v" {
+				continue
+			}
+			major, _, _ := strings.Cut(strings.Trim(value, `"`), ".")
+			if version, err := strconv.Atoi(major); err == nil && len(brand) > 0 {
+				brands[brand] = version
+			}
+		}
+	}
+	return brands
+}
+
+// clientHintTypes returns the offered types that the client's browser
+// supports according to its client hints, to be preferred over others. Only
+// types the Accept header accepts anyway (e.g. through `*/*` or `image/*`)
+// are returned, so that the hints do not override what the client asked for.
+func clientHintTypes(r *http.Request, header string, offerTypes []contenttype.MediaType) []string {
+	brands := clientHintBrands(r)
+	if len(brands) == 0 {
+		return nil
+	}
+	ranges, ok := parseMediaRanges(header)
+	if !ok {
+		return nil
+	}
+	var types []string
+	for _, format := range clientHintFormats {
+		if version, ok := brands[format.brand]; !ok || version < format.version {
+			continue
+		}
+		for _, offer := range offerTypes {
+			if !strings.EqualFold(offer.MIME(), format.mediaType) {
+				continue
+			}
+			if rng := bestMediaRange(ranges, offer); rng != nil && rng.weight > 0 {
+				types = append(types, format.mediaType)
+				break
+			}
+		}
+	}
+	return types
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build schema
+
+// Command connegschema prints a JSON Schema of the JSON config of the conneg
+// matcher, for editors that offer completion and validation based on JSON
+// Schema. Caddy has no way for modules to provide a schema, so it is derived
+// from the source of the package: properties from the JSON struct tags,
+// descriptions and defaults from the doc comments.
+//
+// Run it from the root of the repository:
+//
+//	go run -tags schema ./cmd/connegschema > conneg.schema.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "directory of the conneg package")
+	flag.Parse()
+	schema, err := buildSchema(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
+
+// the trailing `Default: X` of field comments
+var defaultPattern = regexp.MustCompile(`\s*Default: (.*)$`)
+
+// example values given in field comments, as in "e.g. `text/html`" (except
+// for variable names, whose comments give examples of the variables' values)
+var examplePattern = regexp.MustCompile("e\\.g\\. `([^`]+)`")
+
+// buildSchema reads the package in dir and returns the schema of MatchConneg.
+func buildSchema(dir string) (map[string]interface{}, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := pkgs["connegmatcher"]
+	if !ok {
+		return nil, fmt.Errorf("No conneg package found in %s.", dir)
+	}
+	types := make(map[string]*ast.StructType)
+	var description string
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				if st, ok := typeSpec.Type.(*ast.StructType); ok {
+					types[typeSpec.Name.Name] = st
+					if typeSpec.Name.Name == "MatchConneg" {
+						description = doc.Synopsis(gen.Doc.Text())
+					}
+				}
+			}
+		}
+	}
+	matcher, ok := types["MatchConneg"]
+	if !ok {
+		return nil, fmt.Errorf("No MatchConneg type found in %s.", dir)
+	}
+	schema := structSchema(matcher, types)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "http.matchers.conneg"
+	schema["description"] = description
+	return schema, nil
+}
+
+// structSchema returns the schema of an object with the JSON fields of a struct.
+func structSchema(st *ast.StructType, types map[string]*ast.StructType) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for _, field := range st.Fields.List {
+		if field.Tag == nil || len(field.Names) == 0 || !field.Names[0].IsExported() {
+			continue
+		}
+		tag, _ := strconv.Unquote(field.Tag.Value)
+		name := strings.Split(reflect.StructTag(tag).Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		property := typeSchema(field.Type, types)
+		comment := strings.Join(strings.Fields(field.Doc.Text()), " ")
+		if match := defaultPattern.FindStringSubmatch(comment); match != nil {
+			comment = strings.TrimSpace(comment[:len(comment)-len(match[0])])
+			if value, ok := defaultValue(match[1], property["type"]); ok {
+				property["default"] = value
+			}
+		}
+		if len(comment) > 0 {
+			property["description"] = comment
+		}
+		if property["type"] == "string" && !strings.HasPrefix(comment, "Variable name") {
+			var examples []string
+			for _, match := range examplePattern.FindAllStringSubmatch(comment, -1) {
+				examples = append(examples, match[1])
+			}
+			if len(examples) > 0 {
+				property["examples"] = examples
+			}
+		}
+		properties[name] = property
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// typeSchema returns the schema of a Go type.
+func typeSchema(expr ast.Expr, types map[string]*ast.StructType) map[string]interface{} {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return typeSchema(t.X, types)
+	case *ast.ArrayType:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elt, types)}
+	case *ast.MapType:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Value, types)}
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return map[string]interface{}{"type": "string"}
+		case "bool":
+			return map[string]interface{}{"type": "boolean"}
+		case "int", "int64":
+			return map[string]interface{}{"type": "integer"}
+		case "float64":
+			return map[string]interface{}{"type": "number"}
+		}
+		if st, ok := types[t.Name]; ok {
+			return structSchema(st, types)
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// defaultValue converts the default given in a comment to a value of the
+// property's type. Defaults that are descriptions, like "Empty list", have
+// no value.
+func defaultValue(s string, kind interface{}) (interface{}, bool) {
+	switch kind {
+	case "string":
+		if value, err := strconv.Unquote(s); err == nil {
+			return value, true
+		}
+	case "boolean":
+		if value, err := strconv.ParseBool(s); err == nil {
+			return value, true
+		}
+	case "integer":
+		if value, err := strconv.Atoi(s); err == nil {
+			return value, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build schema
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildSchema(t *testing.T) {
+	schema, err := buildSchema("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	for name, want := range map[string]map[string]interface{}{
+		"match_types":             {"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"var_type":                {"type": "string", "default": ""},
+		"multipart_fallback":      {"type": "boolean", "default": false},
+		"implicit_utf8":           {"type": "boolean", "default": true},
+		"remember_max_age":        {"type": "integer", "default": 3600},
+		"upstream_map":            {"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+		"var_type_base":           {"type": "string", "default": "", "examples": nil},
+		"auth_context_key":        {"type": "string", "default": "", "examples": []string{"http.auth.user.plan"}},
+		"language_display_format": {"type": "string", "default": "bcp47"},
+	} {
+		property, ok := properties[name].(map[string]interface{})
+		if !ok {
+			t.Errorf("Missing property %s", name)
+			continue
+		}
+		if property["description"] == nil {
+			t.Errorf("Property %s should have a description", name)
+		}
+		for key, value := range want {
+			if !reflect.DeepEqual(property[key], value) {
+				t.Errorf("Property %s: expected %s %#v, got %#v", name, key, value, property[key])
+			}
+		}
+	}
+	priority := properties["force_priority"].(map[string]interface{})["items"].(map[string]interface{})
+	if _, ok := priority["properties"].(map[string]interface{})["source"]; !ok {
+		t.Errorf("Items of force_priority should have a source property, got %v", priority)
+	}
+	for _, computed := range []string{"MatchTTypes", "LanguageMatcher", "-", "omitempty"} {
+		if _, ok := properties[computed]; ok {
+			t.Errorf("Computed field %s should not be in the schema", computed)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package connegmatcher
+
+import (
+	"testing"
+)
+
+func TestCompareCharsetOrEncodings(t *testing.T) {
+	tests := []struct {
+		name   string
+		check  CharsetOrEncoding
+		other  CharsetOrEncoding
+		result bool
+	}{
+		{"exact match", CharsetOrEncoding{Value: "utf-8"}, CharsetOrEncoding{Value: "utf-8"}, true},
+		{"case-insensitive match", CharsetOrEncoding{Value: "utf-8"}, CharsetOrEncoding{Value: "UTF-8"}, true},
+		{"client wildcard match", CharsetOrEncoding{Value: "*"}, CharsetOrEncoding{Value: "utf-8"}, true},
+		{"offer wildcard match", CharsetOrEncoding{Value: "utf-8"}, CharsetOrEncoding{Value: "*"}, true},
+		{"wildcard with parameter missing from offer", CharsetOrEncoding{Value: "*", Parameters: Parameters{"level": "1"}}, CharsetOrEncoding{Value: "gzip"}, false},
+		{"wildcard with parameter present in offer", CharsetOrEncoding{Value: "*", Parameters: Parameters{"level": "1"}}, CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1"}}, true},
+		{"different value", CharsetOrEncoding{Value: "gzip"}, CharsetOrEncoding{Value: "br"}, false},
+		{"parameters must all be present", CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1", "window": "15"}}, CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1"}}, false},
+		{"parameter values must be equal", CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "2"}}, CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1"}}, false},
+		{"extra offer parameters are fine", CharsetOrEncoding{Value: "gzip"}, CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1"}}, true},
+	}
+	for _, test := range tests {
+		if got := compareCharsetOrEncodings(test.check, test.other); got != test.result {
+			t.Errorf("%s: expected %v, got %v", test.name, test.result, got)
+		}
+	}
+}
+
+// The quality values example from RFC 7231, 5.3.2, with encodings instead of
+// media types: "*;q=0.5, gzip;q=0.7, gzip;level=1, gzip;level=2;q=0.4"
+// gives gzip;level=1 1.0, gzip 0.7, gzip;level=3 0.7, gzip;level=2 0.4,
+// and any other encoding 0.5.
+func TestRFC7231QualityExample(t *testing.T) {
+	header := "*;q=0.5, gzip;q=0.7, gzip;level=1, gzip;level=2;q=0.4"
+	tests := []struct {
+		offers   []CharsetOrEncoding
+		expected CharsetOrEncoding
+	}{
+		{[]CharsetOrEncoding{{Value: "gzip"}, {Value: "gzip", Parameters: Parameters{"level": "1"}}}, CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1"}}},
+		{[]CharsetOrEncoding{{Value: "br"}, {Value: "gzip"}}, CharsetOrEncoding{Value: "gzip"}},
+		{[]CharsetOrEncoding{{Value: "br"}, {Value: "gzip", Parameters: Parameters{"level": "3"}}}, CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "3"}}},
+		{[]CharsetOrEncoding{{Value: "gzip", Parameters: Parameters{"level": "2"}}, {Value: "br"}}, CharsetOrEncoding{Value: "br"}},
+	}
+	for _, test := range tests {
+		result, _, err := getAcceptableCharsetOrEncodingFromHeader(header, test.offers)
+		if err != nil {
+			t.Fatalf("Offers %v: %v", test.offers, err)
+		}
+		if result.Value != test.expected.Value || len(result.Parameters) != len(test.expected.Parameters) || result.Parameters["level"] != test.expected.Parameters["level"] {
+			t.Errorf("Offers %v: expected %v, got %v", test.offers, test.expected, result)
+		}
+	}
+}
+
+func TestParseMediaRangesQuotedComma(t *testing.T) {
+	ranges, ok := parseMediaRanges(`application/ld+json;profile="a,b", text/html;q=0.1`)
+	if !ok || len(ranges) != 2 {
+		t.Fatalf("Expected 2 media ranges, got %v (%v)", ranges, ok)
+	}
+	if profile := ranges[0].mediaType.Parameters["profile"]; profile != "a,b" {
+		t.Errorf("Expected profile \"a,b\", got %q", profile)
+	}
+	if ranges[1].mediaType.MIME() != "text/html" || ranges[1].weight != 100 {
+		t.Errorf("Expected text/html with quality 0.1, got %v", ranges[1])
+	}
+}
+
+func TestAcceptExtensionParametersIgnored(t *testing.T) {
+	// parameters after the weight are accept-ext parameters, which do not restrict the range
+	result, extensions, err := getAcceptableCharsetOrEncodingFromHeader("gzip;q=0.5;foo=bar", []CharsetOrEncoding{{Value: "gzip"}})
+	if err != nil || result.Value != "gzip" {
+		t.Fatalf("Expected gzip to match, got %v (%v)", result, err)
+	}
+	if extensions["foo"] != "bar" {
+		t.Fatalf("Expected extension parameter foo=bar, got %v", extensions)
+	}
+}
+
+func TestGetPrecedence(t *testing.T) {
+	unset := CharsetOrEncoding{}
+	wildcard := CharsetOrEncoding{Value: "*", Parameters: Parameters{}}
+	wildcardParam := CharsetOrEncoding{Value: "*", Parameters: Parameters{"level": "1"}}
+	plain := CharsetOrEncoding{Value: "gzip", Parameters: Parameters{}}
+	param := CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "1"}}
+	otherParam := CharsetOrEncoding{Value: "gzip", Parameters: Parameters{"level": "2"}}
+	tests := []struct {
+		name        string
+		check       CharsetOrEncoding
+		other       CharsetOrEncoding
+		replacement bool
+	}{
+		{"anything beats unset", wildcard, unset, true},
+		{"more params wins", param, plain, true},
+		{"fewer params loses", plain, param, false},
+		{"equal params same values is stable", param, param, false},
+		{"equal params different values is stable", otherParam, param, false},
+		{"concrete beats wildcard", plain, wildcard, true},
+		{"wildcard loses to concrete", wildcard, plain, false},
+		{"wildcard with params loses to concrete", wildcardParam, plain, false},
+		{"wildcard with params beats wildcard", wildcardParam, wildcard, true},
+		{"wildcard does not override wildcard", wildcard, wildcard, false},
+		{"wildcard loses to wildcard with params", wildcard, wildcardParam, false},
+	}
+	for _, test := range tests {
+		if got := getPrecedence(test.check, test.other); got != test.replacement {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.replacement, got)
+		}
+	}
+
+	// the weight of the most specific entry applies, whatever its position
+	for header, weight := range map[string]int{
+		"*, utf-8":           1000,
+		"*, utf-8;q=0.5":     500,
+		"utf-8;q=0.3, *":     300,
+		"*;q=0.5, *":         500,
+		"*;q=0.5, *;q=0.8":   500,
+		"*;q=0.2, UTF-8;q=1": 1000,
+	} {
+		result, _, got, err := negotiateCharsetOrEncoding(header, []CharsetOrEncoding{{Value: "utf-8"}}, false)
+		if err != nil || result.Value != "utf-8" {
+			t.Fatalf("%s: expected utf-8, got %q (%v)", header, result.Value, err)
+		}
+		if got != weight {
+			t.Errorf("%s: expected weight %d, got %d", header, weight, got)
+		}
+	}
+}
+
+func TestObsoleteLineFolding(t *testing.T) {
+	offers := []CharsetOrEncoding{{Value: "iso-8859-1"}, {Value: "utf-8"}}
+	for _, header := range []string{
+		"iso-8859-1;q=0.5,\r\n utf-8",
+		"iso-8859-1;q=0.5,\r\n\tutf-8",
+		"iso-8859-1;q=0.5, utf-8\r\n ;q=1.0",
+		"iso-8859-1\r\n ;\r\n q=0.5, utf-8",
+	} {
+		result, _, err := getAcceptableCharsetOrEncodingFromHeader(header, offers)
+		if err != nil || result.Value != "utf-8" {
+			t.Errorf("%q: expected utf-8, got %q (%v)", header, result.Value, err)
+		}
+	}
+	if _, _, err := getAcceptableCharsetOrEncodingFromHeader("iso-8859-1,\r\nutf-8", offers); err == nil {
+		t.Error("CRLF without following whitespace is no folding and should fail")
+	}
+}
+
+func FuzzGetAcceptableCharsetOrEncodingFromHeader(f *testing.F) {
+	for _, seed := range []string{
+		"utf-8",
+		"*;q=0.5, gzip;q=0.7, gzip;level=1, gzip;level=2;q=0.4",
+		"iso-8859-1;q=0.5,\r\n utf-8",
+		"iso-8859-1\r\n ;\r\n\tq=0.5, utf-8",
+		"gzip,\r\n",
+		"br;q=1.0;ext=\"quoted\"",
+	} {
+		f.Add(seed)
+	}
+	offers := []CharsetOrEncoding{{Value: "utf-8"}, {Value: "gzip", Parameters: Parameters{"level": "1"}}, {Value: "*"}}
+	f.Fuzz(func(t *testing.T, header string) {
+		result, _, err := getAcceptableCharsetOrEncodingFromHeader(header, offers)
+		if err == nil && result.Value == "" {
+			t.Errorf("%q: no error, but no result either", header)
+		}
+	})
+}
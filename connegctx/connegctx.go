@@ -0,0 +1,60 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package connegctx lets other Caddy modules pick up the results of the
+// conneg matcher. Matchers cannot replace the context of the request they
+// inspect, so the values are kept in the request's variables, which live in
+// the context and are shared by all modules handling the request.
+package connegctx
+
+import (
+	"context"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// EncodingVar is the name of the variable holding the negotiated encoding.
+// It does not start with `conneg_`, so that it cannot collide with the
+// variables configured in a matcher.
+const EncodingVar = "conneg.encoding"
+
+// EncodingSelector is implemented by handlers that compress responses (like
+// Caddy's `encode` handler) and can apply the negotiated encoding instead of
+// making their own choice.
+type EncodingSelector interface {
+	// SupportsEncoding reports whether the handler can apply the encoding
+	// with the given name, e.g. `gzip`, `zstd` or `br`.
+	SupportsEncoding(name string) bool
+}
+
+// SetEncoding stores the negotiated encoding in ctx.
+func SetEncoding(ctx context.Context, encoding string) {
+	caddyhttp.SetVar(ctx, EncodingVar, encoding)
+}
+
+// Encoding returns the negotiated encoding stored in ctx, if any.
+func Encoding(ctx context.Context) (string, bool) {
+	encoding, ok := caddyhttp.GetVar(ctx, EncodingVar).(string)
+	return encoding, ok && len(encoding) > 0
+}
+
+// SelectEncoding returns the negotiated encoding stored in ctx if the
+// selector supports it. Otherwise, the selector is free to choose.
+func SelectEncoding(ctx context.Context, selector EncodingSelector) (string, bool) {
+	encoding, ok := Encoding(ctx)
+	if !ok || !selector.SupportsEncoding(encoding) {
+		return "", false
+	}
+	return encoding, true
+}
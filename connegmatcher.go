@@ -15,20 +15,40 @@
 package connegmatcher
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/elnormous/contenttype"
+	"github.com/mpilhlt/caddy-conneg/connegctx"
+	"github.com/oschwald/maxminddb-golang"
 	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 	"golang.org/x/text/language"
 	"golang.org/x/text/language/display"
 )
 
+// Version is the version of the plugin, as reported at `GET /conneg/version`
+// of the admin API. It is bumped at release.
+const Version = "0.1.0"
+
 // Parameters is a map to represent charset or encoding parameters.
 type Parameters = map[string]string
 
@@ -55,7 +75,8 @@ type CharsetOrEncoding struct {
 // variable called `aliases`: They presently cover `htm` and `html` for
 // `text/html`, `text` or `txt` for `text/plain`, `rdf` for
 // `application/rdf+xml`, `tei` and `xml` for `application/tei+xml`,
-// and `pdf` for `application/pdf`. For instance, if
+// `pdf` for `application/pdf`, and the SPARQL 1.1 result formats
+// (`srj`, `srx`, `csv`, `tsv`). For instance, if
 // `force_type_query_string` is set to `format`, a request uri ending
 // in `foo.com?format=tei` will result in content type
 // `application/tei+xml` and then succeed or not, based on whether that
@@ -64,262 +85,3375 @@ type CharsetOrEncoding struct {
 // COMPATIBILITY NOTE: This module is still experimental and is not
 // subject to Caddy's compatibility guarantee.
 type MatchConneg struct {
+	// Registry key of a matcher provisioned before this one (e.g. in an earlier route), whose offer lists are taken over, followed by those of this matcher. Default: ""
+	Inherit                  string   `json:"inherit,omitempty"`
+	// Name of a Caddy app implementing ConnegOffersProvider, whose offer lists are taken over at provisioning, followed by those of this matcher. Default: ""
+	OffersFrom               string   `json:"offers_from,omitempty"`
 	// List of content/mime types to match against ([IETF RFC 7231, section 5.3.2](https://datatracker.ietf.org/doc/html/rfc7231#section-5.3.2)). Default: Empty list
 	MatchTypes               []string `json:"match_types,omitempty"`
+	// Server-side quality of offered types, multiplied with the quality the client gives them, as set with `match_types text/html;q=1.0 application/json;q=0.8` in the Caddyfile. Default: 1.0 for each type
+	TypeQualities            map[string]float64 `json:"type_qualities,omitempty"`
 	// List of language codes to match against ([IETF RFC 7231, section 5.3.5](https://datatracker.ietf.org/doc/html/rfc7231#section-5.3.5)). Default: Empty list
 	MatchLanguages           []string `json:"match_languages,omitempty"`
 	// List of character sets to match against ([IETF RFC 7231, section 5.3.3](https://datatracker.ietf.org/doc/html/rfc7231#section-5.3.3)). Default: Empty list
 	MatchCharsets            []string `json:"match_charsets,omitempty"`
 	// List of encodings to match against ([IETF RFC 7231, section 5.3.4](https://datatracker.ietf.org/doc/html/rfc7231#section-5.3.4)). Default: Empty list
 	MatchEncodings           []string `json:"match_encodings,omitempty"`
+	// List of content/mime types of request bodies to match against the Content-Type request header ([IETF RFC 7231, section 3.1.1.5](https://datatracker.ietf.org/doc/html/rfc7231#section-3.1.1.5)). Default: Empty list
+	MatchContentTypes        []string `json:"match_content_types,omitempty"`
+	// HTTP methods of the requests to negotiate, requests with other methods match without negotiation. Default: Empty list, meaning all methods
+	AllowedMethods           []string `json:"allowed_methods,omitempty"`
+	// HTTP methods of the requests that match without negotiation, the inverse of `allowed_methods`. Default: Empty list
+	DisallowedMethods        []string `json:"disallowed_methods,omitempty"`
+	// The only HTTP method of the requests to negotiate, like `allowed_methods` with a single method. Default: ""
+	AssertMethod             string   `json:"assert_method,omitempty"`
+	// Reject requests without any of the `Accept`, `Accept-Language`, `Accept-Charset` and `Accept-Encoding` headers, unless the client forces a value, setting the variable `conneg_no_headers` to `1`. Default: false
+	RequireAtLeastOneHeader  bool     `json:"require_at_least_one_header,omitempty"`
+	// Other request matchers that all have to match as well, each an object with the configuration of a matcher by its module name (as in `{"path": ["/api/*"]}`). Default: Empty list
+	ChainedMatcher           []json.RawMessage `json:"chained_matcher,omitempty"`
+	// Check the chained matchers before the negotiation, which is skipped for requests they reject, instead of after a successful negotiation. Default: false
+	ChainBefore              bool     `json:"chain_before,omitempty"`
+	// Match exactly the requests that would not match otherwise, e.g. to route everything but JSON elsewhere. The variables are set as without it. Default: false
+	InvertMatch              bool     `json:"invert_match,omitempty"`
 	// Query string parameter key to override content negotiation. Default: ""
 	ForceTypeQueryString     string   `json:"force_type_query_string,omitempty"`
+	// Cookie name to override content negotiation, tried after `force_type_query_string`. Default: ""
+	ForceCookieType          string   `json:"force_cookie_type,omitempty"`
+	// Have the `conneg` handler set the cookie in `force_cookie_type` to the type negotiated from the Accept header, so that later requests get the same type. Default: false
+	RememberNegotiationCookie bool    `json:"remember_negotiation_cookie,omitempty"`
+	// Max-Age of the cookie set with `remember_negotiation_cookie`, in seconds. Default: 3600
+	RememberMaxAge           int      `json:"remember_max_age,omitempty"`
+	// Ordered list of mechanisms to override content negotiation, the first one resolving to an offered type wins. `force_type_query_string` is tried after them. Default: Empty list
+	ForcePriority            []ForceMechanism `json:"force_priority,omitempty"`
 	// Query string parameter key to override language negotiation. Default: ""
 	ForceLanguageQueryString string   `json:"force_language_query_string,omitempty"`
+	// BCP 47 language tags for other locale identifiers clients may force with `force_language_query_string`, like `en_US` or `english`, in addition to the ISO 639-2 codes of major languages (like `eng`). Default: Empty map
+	LocaleAlias              map[string]string `json:"locale_alias,omitempty"`
+	// Replace the Accept header of the request with the type forced by the client, so that later handlers and upstreams see it. Default: false
+	ForceTypeAcceptReplace   bool     `json:"force_type_accept_replace,omitempty"`
+	// Replace the Accept-Language header of the request with the language forced by the client. Default: false
+	ForceLanguageAcceptReplace bool   `json:"force_language_accept_replace,omitempty"`
+	// Remove the query parameter a client used to force a value from the request URL, so that later handlers and upstreams don't see it. Default: false
+	RemoveForceParam         bool     `json:"remove_force_param,omitempty"`
+	// Compare the values of query parameters forcing a value with the offers and their aliases case-insensitively, so that e.g. `?format=HTML` works like `?format=html`. Default: false
+	NormalizeQueryParam      bool     `json:"normalize_query_param,omitempty"`
+	// Don't accept the built-in aliases (and those added by plugins) in place of the offers they stand for, e.g. if `?format=xml` should not mean `application/tei+xml`. Default: false
+	DisableBuiltinAliases    bool     `json:"disable_builtin_aliases,omitempty"`
+	// Which value of a query parameter forcing a value is used if it is given more than once, as in `?format=json&format=rdf`: `first`, `last`, or `highest_quality` to try them in turn, as a list of preferences. Default: "first"
+	ForceQueryParamMultiValue string  `json:"force_query_param_multi_value,omitempty"`
 	// Query string parameter key to override charset negotiation. Default: ""
 	ForceCharsetQueryString  string   `json:"force_charset_query_string,omitempty"`
 	// Query string parameter key to override encoding negotiation. Default: ""
 	ForceEncodingQueryString string   `json:"force_encoding_query_string,omitempty"`
 	// Variable name (will be prefixed with `conneg_`) to hold result of content negotiation. Default: ""
 	VarType                  string   `json:"var_type,omitempty"`
+	// Value to store in `var_type` if no types are offered, without negotiating them. Default: ""
+	DefaultTypeOnEmpty       string   `json:"default_type_on_empty,omitempty"`
+	// Parameters of the negotiated content type to keep in `var_type`, e.g. `charset`, dropping all others. Default: Empty list, keeping all parameters
+	MIMEParamWhitelist       []string `json:"mime_param_whitelist,omitempty"`
+	// Also store each offered type the client accepts in a variable of its own, by descending quality, e.g. `conneg_type_0` and `conneg_type_1` for `var_type type`, along with their number in `conneg_type_count`. Default: false
+	MultipleTypeVars         bool     `json:"multiple_type_vars,omitempty"`
+	// Maximum number of types stored with `multiple_type_vars`, 0 meaning the default. Default: 10
+	MaxTypeVars              int      `json:"max_type_vars,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the negotiated content type without parameters, e.g. `text/html`. Default: ""
+	VarTypeBase              string   `json:"var_type_base,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the top-level type of the negotiated content type, e.g. `text`. Default: ""
+	VarTypeType              string   `json:"var_type_type,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the subtype of the negotiated content type, e.g. `html`. Default: ""
+	VarTypeSubtype           string   `json:"var_type_subtype,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the canonical file extension of the negotiated content type, e.g. `.html`. Default: ""
+	VarExtension             string   `json:"var_extension,omitempty"`
+	// Guess the language of clients without an Accept-Language header from the country their IP address is located in, using `geo_database`. Default: false
+	GeoLanguage              bool     `json:"geo_language,omitempty"`
+	// Path of a MaxMind GeoIP2/GeoLite2 country or city database in MMDB format, for `geo_language`. Default: ""
+	GeoDatabase              string   `json:"geo_database,omitempty"`
+	// Networks (in CIDR notation) of proxies whose X-Forwarded-For header is trusted to give the client IP address for `geo_language`. Default: Empty list
+	GeoTrustedProxies        []string `json:"geo_trusted_proxies,omitempty"`
+	// Take the language of clients without an Accept-Language header from the first label of the host in their Origin header, e.g. `fr` for `https://fr.example.com`, if it is an offered language or alias. Default: false
+	SameOriginLanguage       bool     `json:"same_origin_language,omitempty"`
+	// Domains whose subdomains are trusted to give the language for `same_origin_language`, e.g. `example.com`. Default: Empty list
+	AllowedOriginDomains     []string `json:"allowed_origin_domains,omitempty"`
 	// Variable name (will be prefixed with `conneg_`) to hold result of language negotiation. Default: ""
 	VarLanguage              string   `json:"var_language,omitempty"`
+	// Value to store in `var_language` if no languages are offered, without negotiating them. Default: ""
+	DefaultLanguageOnEmpty   string   `json:"default_language_on_empty,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the confidence of the language match: `Exact`, `High` or `Low`. Default: ""
+	VarLanguageConfidence    string   `json:"var_language_confidence,omitempty"`
 	// Variable name (will be prefixed with `conneg_`) to hold result of charset negotiation. Default: ""
 	VarCharset               string   `json:"var_charset,omitempty"`
+	// Value to store in `var_charset` if no charsets are offered, without negotiating them. Default: ""
+	DefaultCharsetOnEmpty    string   `json:"default_charset_on_empty,omitempty"`
+	// Store the `charset` parameter of the negotiated content type in the charset variable, even without `match_charsets`. Default: false
+	ExtractCharsetFromType   bool     `json:"extract_charset_from_type,omitempty"`
 	// Variable name (will be prefixed with `conneg_`) to hold result of encoding negotiation. Default: ""
 	VarEncoding              string   `json:"var_encoding,omitempty"`
+	// Value to store in `var_encoding` if no encodings are offered, without negotiating them. Default: ""
+	DefaultEncodingOnEmpty   string   `json:"default_encoding_on_empty,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the number of negotiated dimensions (type, language, charset, encoding) that matched, e.g. `2`. Default: ""
+	VarMatchCount            string   `json:"var_match_count,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the negotiated type, language, charset and encoding in one value, `*` standing for dimensions that were not negotiated, e.g. `application/json:en:*:gzip`. Default: ""
+	VarNegotiatedAll         string   `json:"var_negotiated_all,omitempty"`
+	// Separator of the values in `var_negotiated_all`. Default: ":"
+	VarNegotiatedAllDelimiter string  `json:"var_negotiated_all_delimiter,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold `1` if the client forced any of the negotiated values (e.g. with `force_type_query_string`), `0` otherwise. Default: ""
+	VarForceUsed             string   `json:"var_force_used,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold a score of how well the request matched, aggregated from the qualities the client gave the negotiated values, e.g. `0.500`. Default: ""
+	ScoreVar                 string   `json:"score_var,omitempty"`
+	// How `score_var` aggregates the qualities of the dimensions: `product`, `minimum` or `average`. Default: "product"
+	ScoreAggregation         string   `json:"score_aggregation,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold a suggested cache lifetime in seconds, `base_ttl` times the average quality the client gave the negotiated values, e.g. `1800`. Default: ""
+	TTLVar                   string   `json:"ttl_var,omitempty"`
+	// Cache lifetime in seconds suggested in `ttl_var` for exact matches, 0 meaning the default. Default: 3600
+	BaseTTL                  int      `json:"base_ttl,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the matched request body type. Default: ""
+	VarContentType           string   `json:"var_content_type,omitempty"`
+	// Check the Content-Type of requests with a body against the offered types, as if they were listed in `match_content_types`. Default: false
+	MatchInboundContentType  bool     `json:"match_inbound_content_type,omitempty"`
+	// Accept the offered types as request body types and vice versa, for protocols using the same type in both directions. Default: false
+	Reflect                  bool     `json:"reflect,omitempty"`
+	// Upstream addresses by offered content type, for use with `dynamic_upstream_var`. Default: Empty map
+	UpstreamMap              map[string]string `json:"upstream_map,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the upstream address from `upstream_map` for the negotiated content type. Default: ""
+	DynamicUpstreamVar       string   `json:"dynamic_upstream_var,omitempty"`
+	// Negotiate types against the offers extended for the authenticated user's claim, see `auth_extended_offers`. Default: false
+	PostAuthMode             bool     `json:"post_auth_mode,omitempty"`
+	// Placeholder holding the claim of the authenticated user, e.g. `http.auth.user.plan`. Default: ""
+	AuthContextKey           string   `json:"auth_context_key,omitempty"`
+	// Content types offered in addition to `match_types`, by the value of the claim in `auth_context_key`. Default: Empty map
+	AuthExtendedOffers       map[string][]string `json:"auth_extended_offers,omitempty"`
+	// Profile URIs acceptable in the `profile` parameter of a requested type, by offered content type, e.g. for JSON-LD frames. Default: Empty map
+	MatchProfiles            map[string][]string `json:"match_profiles,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the profile requested with the negotiated content type. Default: ""
+	VarProfile               string   `json:"var_profile,omitempty"`
+	// API versions acceptable in the `version` parameter of the negotiated type, as in `Accept: application/vnd.myapi+json;version=2` for an offered `application/vnd.myapi+json;version=2`. Default: Empty list, meaning any version
+	MatchAPIVersions         []string `json:"match_api_versions,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the `version` parameter of the negotiated type. Default: ""
+	VarAPIVersion            string   `json:"var_api_version,omitempty"`
+	// Request header holding a date that selects the version of the content, like `X-API-Version-Date: 2024-01-01`. Requests without it are not checked. Default: ""
+	TemporalHeaderName       string   `json:"temporal_header_name,omitempty"`
+	// Go time layout of the dates in `temporal_header_name`, `before_date` and `after_date`. Default: "2006-01-02"
+	TemporalFormat           string   `json:"temporal_format,omitempty"`
+	// Only match requests whose date in `temporal_header_name` is earlier than this one. Default: ""
+	BeforeDate               string   `json:"before_date,omitempty"`
+	// Only match requests whose date in `temporal_header_name` is later than this one. Default: ""
+	AfterDate                string   `json:"after_date,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold the date given in `temporal_header_name`, in the `temporal_format` layout. Default: ""
+	VarTemporalDate          string   `json:"var_temporal_date,omitempty"`
+	// Have the `conneg` handler advertise `match_types` in an `Accept-Patch` response header ([IETF RFC 5789, section 3.1](https://datatracker.ietf.org/doc/html/rfc5789#section-3.1)). Default: false
+	AdvertiseAcceptPatch     bool     `json:"advertise_accept_patch,omitempty"`
+	// Have the `conneg` handler answer OPTIONS requests with only the Accept-Patch, Allow and Vary headers. Default: false
+	RespondToOptions         bool     `json:"respond_to_options,omitempty"`
+	// Store the negotiated encoding for compressing handlers, see package `connegctx`. Default: false
+	CoordinateWithEncode     bool     `json:"coordinate_with_encode,omitempty"`
+	// Skip encoding negotiation for negotiated types that are compressed already (see `already_compressed_types`), and store `identity` as their encoding. Default: false
+	CompressionAware         bool     `json:"compression_aware,omitempty"`
+	// Types that `compression_aware` considers compressed already. Default: JPEG, PNG, GIF, WebP, AVIF, ZIP, gzip and other common formats
+	AlreadyCompressedTypes   []string `json:"already_compressed_types,omitempty"`
+	// Store `identity` as the encoding when none of the offered encodings is acceptable, and treat the encoding as matched, instead of not matching the request. Default: false
+	EncodingFallbackToIdentity bool   `json:"encoding_fallback_to_identity,omitempty"`
+	// Dimensions (`type`, `language`, `charset`, `encoding`) to skip, as if they had matched, when the client's header for them is malformed, instead of not matching the request. Default: Empty list
+	GracefulDegradation      []string `json:"graceful_degradation,omitempty"`
+	// Report requests whose Accept-* headers give all offered values a quality of 0 (like `*/*;q=0`) in the variable `conneg_source` as `explicit_rejection`, and don't fall back to `multipart/mixed` for them. Default: false
+	ZeroQRejectsAll          bool     `json:"zero_q_rejects_all,omitempty"`
+	// Log the results of each negotiation as structured fields like `conneg_type`, along with the request they belong to. Default: false
+	LogFields                bool     `json:"log_fields,omitempty"`
+	// Path of a file that a JSON record of each negotiation is appended to. Default: ""
+	ContentNegotiationLog    string   `json:"content_negotiation_log,omitempty"`
+	// Size in MiB beyond which `content_negotiation_log` is moved to `<path>.1` and started anew, 0 meaning the default. Default: 100
+	ContentNegotiationLogMaxMB int    `json:"content_negotiation_log_max_mb,omitempty"`
+	// Context key (of type `caddy.CtxKey`) under which a tracing span is stored, to be tagged with the negotiation results if it implements TelemetrySpan. Default: ""
+	TelemetryKey             string   `json:"telemetry_key,omitempty"`
+	// Modules of the `conneg.hook` namespace (like `{"hook": "log"}`) that are notified of the outcome of each negotiation, see Hook. Default: Empty list
+	Hooks                    []json.RawMessage `json:"hooks,omitempty" caddy:"namespace=conneg.hook inline_key=hook"`
+	// Have the `conneg` handler explain the negotiation in an `X-Content-Negotiation` response header, for debugging. Default: false
+	NoteHeader               bool     `json:"note_header,omitempty"`
+	// Prefer offered types that the client's browser supports according to its Sec-CH-UA-Full-Version-List client hint, like `image/avif`, and have the `conneg` handler ask for the hint in an Accept-CH response header. Default: false
+	UseClientHints           bool     `json:"use_client_hints,omitempty"`
+	// Choose the first type in `match_types` that the client accepts at all, instead of the one the client gives the highest quality. Default: false
+	PrioritizeOffer          bool     `json:"prioritize_offer,omitempty"`
+	// Offered type to negotiate for clients whose Accept header matches only with `*/*`, e.g. browsers asking an API. Default: ""
+	WildcardDefault          string   `json:"wildcard_default,omitempty"`
+	// Use `multipart/mixed` (if it is listed in `match_types`) as a fallback when no other offered type matches. Default: false
+	MultipartFallback        bool     `json:"multipart_fallback,omitempty"`
+	// Free-form description of the requests the matcher is meant for, e.g. `application/json request`, for documentation only. Default: ""
+	ExampleComment           string   `json:"example,omitempty"`
+	// Label of the route or server block the matcher belongs to, e.g. `main-api-v2`, added to its log entries, its results and the negotiation log. Default: ""
+	SourceTag                string   `json:"source_tag,omitempty"`
+	// Key under which this matcher is listed in the package-level `Registry`. Default: derived from the instance
+	RegistryKey              string   `json:"registry_key,omitempty"`
+	// Serve the aliases and offers of this matcher at `/conneg/<registry key>/aliases` and `/conneg/<registry key>/offers` of the admin API. Default: false
+	ExposeAdmin              bool     `json:"expose_admin,omitempty"`
+	// Number of recent negotiations to keep and serve at `/conneg/<registry key>/history` of the admin API, 0 meaning none. Default: 0
+	HistorySize              int      `json:"history_size,omitempty"`
+	// Maximum number of entries in each of the offer lists, 0 meaning unlimited. Default: 0
+	MaxOfferListSize         int      `json:"max_offer_list_size,omitempty"`
+	// Format of the language result stored in the language variable: `bcp47` (or its synonym `ietf`), `display_en`, `display_native` or `iso639_1`. Default: "bcp47"
+	LanguageDisplayFormat    string   `json:"language_display_format,omitempty"`
+	// Variable name (will be prefixed with `conneg_`) to hold a hash of all negotiation results, to be used in ETags of the representation. Default: ""
+	ETagVar                  string   `json:"etag_var,omitempty"`
+	// Secret mixed into the hash stored in `etag_var`. Default: ""
+	ETagSalt                 string   `json:"etag_salt,omitempty"`
+	// Version of the offer lists, e.g. `v2`, stored in each ConnegResult and mixed into the hash of `etag_var`, so that results and ETags from before a change of the offers can be told apart. Default: ""
+	OfferListVersion         string   `json:"offer_list_version,omitempty"`
+	// Treat a missing Accept-Charset header as `Accept-Charset: utf-8` if `utf-8` is offered ([IETF RFC 7231, section 5.3.3](https://datatracker.ietf.org/doc/html/rfc7231#section-5.3.3)). Default: true
+	ImplicitUTF8             *bool    `json:"implicit_utf8,omitempty"`
+	// Deprecated: restore the behavior of earlier versions for configurations relying on it, i.e. only match charsets offered in lower case (as header values are lowercased) and let requests without an Accept-Charset header miss unless `implicit_utf8` is set explicitly. Default: false
+	BackwardsCompatibilityMode bool   `json:"backwards_compatibility_mode,omitempty"`
+
+	// the following fields are populated internally/computationally
+	MatchTTypes     []contenttype.MediaType	`json:"-"`
+	MatchTLanguages []language.Tag		`json:"-"`
+	MatchTCharsets  []CharsetOrEncoding	`json:"-"`
+	MatchTEncodings []CharsetOrEncoding	`json:"-"`
+	LanguageMatcher language.Matcher	`json:"-"`
+	matchTContentTypes []contenttype.MediaType
+	// offered types (public and extended) for each claim in post-auth mode
+	authOffers      map[string][]string
+	authTTypes      map[string][]contenttype.MediaType
+	logger          *zap.Logger
+	// offered types without their inline qualities, followed by those added
+	// by Reflect; MatchTTypes holds them parsed
+	matchTypes      []string
+	// server-side quality of offered types, given inline as in `text/html;q=0.9`
+	// or in TypeQualities
+	serverQualities map[string]float64
+	// whether any of the server-side qualities is not 1.0
+	weightedTypes   bool
+	// key this instance has been registered under
+	registryKey     string
+	// variants of the offered types with the profiles in MatchProfiles
+	profileTTypes   []contenttype.MediaType
+	// ForcePriority, followed by ForceTypeQueryString and ForceCookieType
+	forceTypes      []ForceMechanism
+	// matchers loaded from ChainedMatcher
+	chainedMatchers []caddyhttp.RequestMatcher
+	// modules loaded from Hooks
+	hooks           []Hook
+	// database opened from GeoDatabase
+	geoDB           *maxminddb.Reader
+	// networks parsed from GeoTrustedProxies
+	geoProxies      []*net.IPNet
+	// log opened from ContentNegotiationLog
+	negotiationLog  *negotiationLog
+	// recent negotiations, see HistorySize
+	history         *negotiationHistory
+	// non-fatal configuration issues found by VerifyConfig
+	warnings        []Warning
+	// set by Cleanup, after which the matcher must not be used
+	cleanedUp       bool
+}
+
+// ErrExplicitRejection is returned when a client gives all offered values a
+// quality of 0, as opposed to not mentioning them at all.
+var ErrExplicitRejection = errors.New("Client explicitly refuses all offered values.")
+
+// acceptSyntaxError is returned for malformed Accept-Charset and
+// Accept-Encoding headers.
+type acceptSyntaxError string
+
+func (e acceptSyntaxError) Error() string {
+	return string(e)
+}
+
+// Variable that tells why a request did not match, see ZeroQRejectsAll, or
+// that it matched despite malformed headers, see GracefulDegradation.
+const sourceVar = "conneg_source"
+
+// Variable that tells that a request did not match because it had no Accept*
+// headers, see RequireAtLeastOneHeader.
+const noHeadersVar = "conneg_no_headers"
+
+// ForceMechanism is a way for clients to override content negotiation for
+// types, see ForcePriority.
+type ForceMechanism struct {
+	// One of `query`, `header`, `cookie`, `form`, `extension`, `path_segment` and `subdomain`
+	Source string `json:"source"`
+	// Name of the query parameter, header, cookie or form field. For `path_segment` and `subdomain`, the index of the segment or label, negative ones counting from the end. Default for `path_segment`: -1, for `subdomain`: 0
+	Key    string `json:"key,omitempty"`
+}
+
+// Matcher is implemented by MatchConneg. Other modules can type-assert
+// request matchers to it (or mock it in tests) to get at the negotiation
+// results without depending on the concrete type.
+type Matcher interface {
+	Match(r *http.Request) bool
+	MatchWithResult(r *http.Request) ConnegResult
+}
+
+// TelemetrySpan is implemented by the spans of tracing libraries that can be
+// tagged with the negotiation results, see TelemetryKey.
+type TelemetrySpan interface {
+	SetTag(key, value string)
+}
+
+// ConnegOffers are offer lists that a Caddy app can provide to matchers, see
+// OffersFrom. Types may carry a server quality, as in `text/html;q=0.8`.
+type ConnegOffers struct {
+	Types     []string
+	Languages []string
+	Charsets  []string
+	Encodings []string
+}
+
+// ConnegOffersProvider is implemented by Caddy apps that provide offer lists
+// to matchers, e.g. apps that know which variants of resources are available.
+type ConnegOffersProvider interface {
+	GetOffers() ConnegOffers
+}
+
+// total number of offers beyond which Provision warns about performance
+const largeOfferCount = 100
+
+// Registry lists all provisioned MatchConneg instances, mapping their
+// registry key (string) to the instance (*MatchConneg). Instances add
+// themselves during Provision and remove themselves during Cleanup.
+var Registry sync.Map
+
+// If a type/language/etc is forced via parameter, these are values that the parameter can take
+var aliases = map[string]interface{}{
+	"text/html":           []string{"html", "htm"},
+	"application/rdf+xml": []string{"rdf"},
+	"application/tei+xml": []string{"tei", "xml"},
+	"application/pdf":     []string{"pdf"},
+	"text/plain":	       []string{"txt", "text"},
+	// SPARQL 1.1 Query Results formats
+	"application/sparql-results+json": []string{"srj", "sparql-json"},
+	"application/sparql-results+xml":  []string{"srx", "sparql-xml"},
+	"text/tab-separated-values":       []string{"tsv"},
+	// JSON Schema and JSON patch formats
+	"application/schema+json":         []string{"schema", "json-schema"},
+	"application/json-patch+json":     []string{"json-patch"},
+	"application/merge-patch+json":    []string{"merge-patch"},
+}
+
+// iso639_2Tags maps the ISO 639-2 codes of major languages, including the
+// bibliographic variants (like `ger` besides `deu`), to BCP 47 tags, see
+// LocaleAlias.
+var iso639_2Tags = map[string]string{
+	"ara": "ar",
+	"chi": "zh",
+	"zho": "zh",
+	"ces": "cs",
+	"cze": "cs",
+	"dan": "da",
+	"deu": "de",
+	"ger": "de",
+	"ell": "el",
+	"gre": "el",
+	"eng": "en",
+	"fin": "fi",
+	"fra": "fr",
+	"fre": "fr",
+	"heb": "he",
+	"hin": "hi",
+	"hun": "hu",
+	"ita": "it",
+	"jpn": "ja",
+	"kor": "ko",
+	"lat": "la",
+	"dut": "nl",
+	"nld": "nl",
+	"nor": "no",
+	"pol": "pl",
+	"por": "pt",
+	"rus": "ru",
+	"spa": "es",
+	"swe": "sv",
+	"tur": "tr",
+	"ukr": "uk",
+}
+
+// aliasesMu guards aliases, which plugins may extend from their init functions
+// while matchers are in use
+var aliasesMu sync.RWMutex
+
+// aliasesOf returns the aliases of a type or language.
+func aliasesOf(t string) []string {
+	aliasesMu.RLock()
+	defer aliasesMu.RUnlock()
+	values, _ := aliases[t].([]string)
+	return values
+}
+
+// offerAliases returns the aliases of an offered type or language, unless
+// DisableBuiltinAliases is set.
+func (m MatchConneg) offerAliases(t string) []string {
+	if m.DisableBuiltinAliases {
+		return nil
+	}
+	return aliasesOf(t)
+}
+
+// aliasMap returns a copy of all aliases.
+func aliasMap() map[string][]string {
+	aliasesMu.RLock()
+	defer aliasesMu.RUnlock()
+	result := make(map[string][]string, len(aliases))
+	for t, values := range aliases {
+		result[t] = append([]string(nil), values.([]string)...)
+	}
+	return result
+}
+
+// aliasCount returns the number of types and languages with aliases.
+func aliasCount() int {
+	aliasesMu.RLock()
+	defer aliasesMu.RUnlock()
+	return len(aliases)
+}
+
+// SetDefaultAliases merges the given aliases into the package-level ones,
+// replacing the aliases of types (or languages) that already have some. This
+// lets plugins extending conneg register their types, and is safe to call
+// from init functions. Nothing is changed if any of the entries is invalid.
+func SetDefaultAliases(m map[string][]string) error {
+	for t, values := range m {
+		if err := checkAliases(t, values...); err != nil {
+			return err
+		}
+	}
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	for t, values := range m {
+		aliases[t] = append([]string(nil), values...)
+	}
+	return nil
+}
+
+// AddDefaultAlias adds a single alias for a type (or language) to the
+// package-level aliases, see SetDefaultAliases.
+func AddDefaultAlias(mimeType, alias string) error {
+	if err := checkAliases(mimeType, alias); err != nil {
+		return err
+	}
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	values, _ := aliases[mimeType].([]string)
+	if !slices.Contains(values, alias) {
+		// copy, so that slices handed out by aliasesOf stay unchanged
+		aliases[mimeType] = append(values[:len(values):len(values)], alias)
+	}
+	return nil
+}
+
+// checkAliases rejects aliases that could never be given in a query string.
+func checkAliases(t string, values ...string) error {
+	if len(strings.TrimSpace(t)) == 0 {
+		return errors.New("Aliases need a type or language to stand for.")
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("No aliases given for '%s'.", t)
+	}
+	for _, alias := range values {
+		if len(strings.TrimSpace(alias)) == 0 {
+			return fmt.Errorf("Empty alias given for '%s'.", t)
+		}
+	}
+	return nil
+}
+
+// mimeToExtension holds the canonical file extension of common types, taking
+// precedence over the (system dependent) answers of mime.ExtensionsByType
+var mimeToExtension = map[string]string{
+	"text/html":                       ".html",
+	"text/plain":                      ".txt",
+	"text/csv":                        ".csv",
+	"text/tab-separated-values":       ".tsv",
+	"text/turtle":                     ".ttl",
+	"text/css":                        ".css",
+	"text/markdown":                   ".md",
+	"application/json":                ".json",
+	"application/ld+json":             ".jsonld",
+	"application/xml":                 ".xml",
+	"application/rdf+xml":             ".rdf",
+	"application/n-triples":           ".nt",
+	"application/n-quads":             ".nq",
+	"application/trig":                ".trig",
+	"application/tei+xml":             ".xml",
+	"application/pdf":                 ".pdf",
+	"application/sparql-results+json": ".srj",
+	"application/sparql-results+xml":  ".srx",
+}
+
+// presets are named lists of types that can be offered at once with the `preset` directive
+var presets = map[string][]string{
+	// result formats of the SPARQL 1.1 Protocol, <https://www.w3.org/TR/sparql11-protocol/>
+	"sparql": {"application/sparql-results+json", "application/sparql-results+xml", "text/csv", "text/tab-separated-values"},
+}
+
+// defaultCompressedTypes are the types that CompressionAware considers
+// compressed already if AlreadyCompressedTypes is not set
+var defaultCompressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+	"audio/mpeg", "audio/ogg", "video/mp4", "video/webm",
+	"application/zip", "application/gzip", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/zstd", "font/woff", "font/woff2",
+}
+
+func init() {
+	caddy.RegisterModule(MatchConneg{})
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchConneg) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.conneg",
+		New: func() caddy.Module { return new(MatchConneg) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (m *MatchConneg) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		// skip the name of a named matcher, as written by MarshalCaddyfile
+		if strings.HasPrefix(d.Val(), "@") {
+			for d.Val() != "conneg" && d.NextArg() {
+			}
+		}
+		if err := m.unmarshalInline(d); err != nil {
+			return err
+		}
+		if err := m.unmarshalBlock(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalInline parses the arguments of the matcher on its own line, as in
+// `conneg text/html application/json with var_type type`: types to offer,
+// optionally followed by `with` and pairs of subdirective and value, each of
+// them read as if it had been given on a line of its own in the block.
+func (m *MatchConneg) unmarshalInline(d *caddyfile.Dispenser) error {
+	for d.NextArg() {
+		if d.Val() != "with" {
+			m.MatchTypes = append(m.MatchTypes, d.Val())
+			continue
+		}
+		begin := d.Token()
+		begin.Text = "{"
+		tokens := []caddyfile.Token{d.Token(), begin}
+		for d.NextArg() {
+			token := d.Token()
+			token.Line = begin.Line + 1 + (len(tokens)-2)/2
+			tokens = append(tokens, token)
+		}
+		if len(tokens) == 2 || len(tokens)%2 != 0 {
+			return d.ArgErr()
+		}
+		end := begin
+		end.Text, end.Line = "}", tokens[len(tokens)-1].Line+1
+		inline := caddyfile.NewDispenser(append(tokens, end))
+		inline.Next()
+		return m.unmarshalBlock(inline)
+	}
+	return nil
+}
+
+// unmarshalBlock parses the subdirectives in the block following the
+// current token of d.
+func (m *MatchConneg) unmarshalBlock(d *caddyfile.Dispenser) error {
+	profile := ""
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "profile":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			profile = d.Val()
+		case "inherit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Inherit = d.Val()
+		case "offers_from":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OffersFrom = d.Val()
+		case "match_types":
+			for _, arg := range offerArgs(d) {
+				offer, quality, err := splitOfferQuality(arg)
+				if err != nil {
+					return d.Errf("invalid quality value: %s", arg)
+				}
+				if offer != arg {
+					if m.TypeQualities == nil {
+						m.TypeQualities = make(map[string]float64)
+					}
+					m.TypeQualities[offer] = quality
+				}
+				m.MatchTypes = append(m.MatchTypes, offer)
+			}
+		case "preset":
+			for _, name := range d.RemainingArgs() {
+				types, ok := presets[name]
+				if !ok {
+					return d.Errf("unknown preset: %s", name)
+				}
+				m.MatchTypes = append(m.MatchTypes, types...)
+			}
+		case "match_languages":
+			m.MatchLanguages = append(m.MatchLanguages, offerArgs(d)...)
+		case "geo_language":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.GeoLanguage = true
+			m.GeoDatabase = d.Val()
+		case "geo_trusted_proxies":
+			m.GeoTrustedProxies = append(m.GeoTrustedProxies, d.RemainingArgs()...)
+		case "same_origin_language":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.SameOriginLanguage = val
+		case "allowed_origin_domains":
+			m.AllowedOriginDomains = append(m.AllowedOriginDomains, d.RemainingArgs()...)
+		case "match_charsets":
+			m.MatchCharsets = append(m.MatchCharsets, offerArgs(d)...)
+		case "match_encodings":
+			m.MatchEncodings = append(m.MatchEncodings, offerArgs(d)...)
+		case "match_content_types":
+			m.MatchContentTypes = append(m.MatchContentTypes, offerArgs(d)...)
+		case "allowed_methods":
+			for _, method := range d.RemainingArgs() {
+				m.AllowedMethods = append(m.AllowedMethods, strings.ToUpper(method))
+			}
+		case "disallowed_methods":
+			for _, method := range d.RemainingArgs() {
+				m.DisallowedMethods = append(m.DisallowedMethods, strings.ToUpper(method))
+			}
+		case "assert_method":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.AssertMethod = strings.ToUpper(d.Val())
+		case "require_at_least_one_header":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.RequireAtLeastOneHeader = val
+		case "chained_matcher":
+			chained, err := parseChainedMatcher(d, m.ChainedMatcher)
+			if err != nil {
+				return err
+			}
+			m.ChainedMatcher = chained
+		case "chain_before":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ChainBefore = val
+		case "invert_match":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.InvertMatch = val
+		case "force_type_query_string":
+			d.Next()
+			m.ForceTypeQueryString = d.Val()
+		case "force_cookie_type":
+			d.Next()
+			m.ForceCookieType = d.Val()
+		case "remember_negotiation_cookie":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.RememberNegotiationCookie = val
+		case "remember_max_age":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid remember_max_age: %v", err)
+			}
+			m.RememberMaxAge = val
+		case "force_type_accept_replace":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ForceTypeAcceptReplace = val
+		case "force_language_accept_replace":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ForceLanguageAcceptReplace = val
+		case "remove_force_param":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.RemoveForceParam = val
+		case "normalize_query_param":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.NormalizeQueryParam = val
+		case "disable_builtin_aliases":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.DisableBuiltinAliases = val
+		case "force_query_param_multi_value":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ForceQueryParamMultiValue = d.Val()
+		case "force_type":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			mechanism := ForceMechanism{Source: args[0]}
+			if len(args) > 1 {
+				mechanism.Key = args[1]
+			}
+			m.ForcePriority = append(m.ForcePriority, mechanism)
+		case "force_language_query_string":
+			d.Next()
+			m.ForceLanguageQueryString = d.Val()
+		case "locale_alias":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if m.LocaleAlias == nil {
+				m.LocaleAlias = make(map[string]string)
+			}
+			m.LocaleAlias[args[0]] = args[1]
+		case "force_charset_query_string":
+			d.Next()
+			m.ForceCharsetQueryString = d.Val()
+		case "force_encoding_query_string":
+			d.Next()
+			m.ForceEncodingQueryString = d.Val()
+		case "var_type":
+			d.Next()
+			m.VarType = d.Val()
+		case "default_type_on_empty":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DefaultTypeOnEmpty = d.Val()
+		case "mime_param_whitelist":
+			m.MIMEParamWhitelist = append(m.MIMEParamWhitelist, d.RemainingArgs()...)
+		case "multiple_type_vars":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.MultipleTypeVars = val
+		case "max_type_vars":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_type_vars: %s", d.Val())
+			}
+			m.MaxTypeVars = val
+		case "var_type_base":
+			d.Next()
+			m.VarTypeBase = d.Val()
+		case "var_type_type":
+			d.Next()
+			m.VarTypeType = d.Val()
+		case "var_type_subtype":
+			d.Next()
+			m.VarTypeSubtype = d.Val()
+		case "var_extension":
+			d.Next()
+			m.VarExtension = d.Val()
+		case "var_language":
+			d.Next()
+			m.VarLanguage = d.Val()
+		case "default_language_on_empty":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DefaultLanguageOnEmpty = d.Val()
+		case "var_language_confidence":
+			d.Next()
+			m.VarLanguageConfidence = d.Val()
+		case "var_charset":
+			d.Next()
+			m.VarCharset = d.Val()
+		case "default_charset_on_empty":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DefaultCharsetOnEmpty = d.Val()
+		case "extract_charset_from_type":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ExtractCharsetFromType = val
+		case "var_encoding":
+			d.Next()
+			m.VarEncoding = d.Val()
+		case "default_encoding_on_empty":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.DefaultEncodingOnEmpty = d.Val()
+		case "match_profile":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if m.MatchProfiles == nil {
+				m.MatchProfiles = make(map[string][]string)
+			}
+			m.MatchProfiles[args[0]] = append(m.MatchProfiles[args[0]], args[1:]...)
+		case "var_profile":
+			d.Next()
+			m.VarProfile = d.Val()
+		case "match_api_versions":
+			m.MatchAPIVersions = append(m.MatchAPIVersions, d.RemainingArgs()...)
+		case "var_api_version":
+			d.Next()
+			m.VarAPIVersion = d.Val()
+		case "temporal_header_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.TemporalHeaderName = d.Val()
+		case "temporal_format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.TemporalFormat = d.Val()
+		case "before_date":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.BeforeDate = d.Val()
+		case "after_date":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.AfterDate = d.Val()
+		case "var_temporal_date":
+			d.Next()
+			m.VarTemporalDate = d.Val()
+		case "var_match_count":
+			d.Next()
+			m.VarMatchCount = d.Val()
+		case "var_negotiated_all":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.VarNegotiatedAll = d.Val()
+		case "var_negotiated_all_delimiter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.VarNegotiatedAllDelimiter = d.Val()
+		case "var_force_used":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.VarForceUsed = d.Val()
+		case "score_var":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ScoreVar = d.Val()
+		case "score_aggregation":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ScoreAggregation = d.Val()
+		case "ttl_var":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.TTLVar = d.Val()
+		case "base_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid base_ttl: %v", err)
+			}
+			m.BaseTTL = val
+		case "var_content_type":
+			d.Next()
+			m.VarContentType = d.Val()
+		case "match_inbound_content_type":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.MatchInboundContentType = val
+		case "reflect":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.Reflect = val
+		case "upstream":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if m.UpstreamMap == nil {
+				m.UpstreamMap = make(map[string]string)
+			}
+			m.UpstreamMap[args[0]] = args[1]
+		case "dynamic_upstream_var":
+			d.Next()
+			m.DynamicUpstreamVar = d.Val()
+		case "post_auth_mode":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.PostAuthMode = val
+		case "auth_context_key":
+			d.Next()
+			m.AuthContextKey = d.Val()
+		case "auth_extended_offers":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if m.AuthExtendedOffers == nil {
+				m.AuthExtendedOffers = make(map[string][]string)
+			}
+			m.AuthExtendedOffers[args[0]] = append(m.AuthExtendedOffers[args[0]], args[1:]...)
+		case "advertise_accept_patch":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.AdvertiseAcceptPatch = val
+		case "respond_to_options":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.RespondToOptions = val
+		case "coordinate_with_encode":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.CoordinateWithEncode = val
+		case "compression_aware":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.CompressionAware = val
+		case "already_compressed_types":
+			m.AlreadyCompressedTypes = append(m.AlreadyCompressedTypes, d.RemainingArgs()...)
+		case "encoding_fallback_to_identity":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.EncodingFallbackToIdentity = val
+		case "graceful_degradation":
+			m.GracefulDegradation = append(m.GracefulDegradation, d.RemainingArgs()...)
+		case "zero_q_rejects_all":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ZeroQRejectsAll = val
+		case "log_fields":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.LogFields = val
+		case "content_negotiation_log":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ContentNegotiationLog = d.Val()
+		case "content_negotiation_log_max_mb":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid content_negotiation_log_max_mb: %v", err)
+			}
+			m.ContentNegotiationLogMaxMB = val
+		case "telemetry_key":
+			d.Next()
+			m.TelemetryKey = d.Val()
+		case "hook":
+			raw, err := parseHook(d)
+			if err != nil {
+				return err
+			}
+			m.Hooks = append(m.Hooks, raw)
+		case "note_header":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.NoteHeader = val
+		case "wildcard_default":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.WildcardDefault = d.Val()
+		case "prioritize_offer":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.PrioritizeOffer = val
+		case "use_client_hints":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.UseClientHints = val
+		case "multipart_fallback":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.MultipartFallback = val
+		case "example":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ExampleComment = d.Val()
+		case "source_tag":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.SourceTag = d.Val()
+		case "registry_key":
+			d.Next()
+			m.RegistryKey = d.Val()
+		case "expose_admin":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ExposeAdmin = val
+		case "history_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid history_size: %v", err)
+			}
+			m.HistorySize = val
+		case "max_offer_list_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_offer_list_size: %s", d.Val())
+			}
+			m.MaxOfferListSize = size
+		case "language_display_format":
+			d.Next()
+			m.LanguageDisplayFormat = d.Val()
+		case "etag_var":
+			d.Next()
+			m.ETagVar = d.Val()
+		case "etag_salt":
+			d.Next()
+			m.ETagSalt = d.Val()
+		case "offer_list_version":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.OfferListVersion = d.Val()
+		case "implicit_utf8":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.ImplicitUTF8 = &val
+		case "backwards_compatibility_mode":
+			val, err := parseCaddyfileBool(d)
+			if err != nil {
+				return err
+			}
+			m.BackwardsCompatibilityMode = val
+		}
+	}
+	if len(profile) > 0 {
+		ok, err := m.applyProfile(profile)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.Errf("unknown conneg profile: %s", profile)
+		}
+	}
+	return nil
+}
+
+// MarshalCaddyfile returns a named matcher block in Caddyfile syntax that,
+// when parsed with UnmarshalCaddyfile, results in an equivalent matcher.
+// The matcher is named after the registry key, or `conneg` if there is none.
+func (m MatchConneg) MarshalCaddyfile() (string, error) {
+	var sb strings.Builder
+	var err error
+	writeArgs := func(directive string, args ...string) {
+		if len(args) == 0 || err != nil {
+			return
+		}
+		sb.WriteString("\t")
+		sb.WriteString(directive)
+		for _, arg := range args {
+			if strings.ContainsAny(arg, "\r\n") {
+				err = fmt.Errorf("Value '%s' of %s cannot be expressed in a Caddyfile.", arg, directive)
+				return
+			}
+			sb.WriteByte(' ')
+			sb.WriteString(quoteCaddyfileArg(arg))
+		}
+		sb.WriteByte('\n')
+	}
+	writeString := func(directive, value string) {
+		if value != "" {
+			writeArgs(directive, value)
+		}
+	}
+
+	name := m.RegistryKey
+	if name == "" {
+		name = "conneg"
+	}
+	sb.WriteString("@" + quoteCaddyfileArg(name) + " conneg {\n")
+	writeString("inherit", m.Inherit)
+	writeString("offers_from", m.OffersFrom)
+	types := make([]string, len(m.MatchTypes))
+	for i, t := range m.MatchTypes {
+		types[i] = t
+		if q, ok := m.TypeQualities[t]; ok {
+			types[i] += ";q=" + strconv.FormatFloat(q, 'f', -1, 64)
+		}
+	}
+	writeArgs("match_types", types...)
+	writeArgs("match_languages", m.MatchLanguages...)
+	if m.GeoLanguage {
+		writeArgs("geo_language", m.GeoDatabase)
+	}
+	writeArgs("geo_trusted_proxies", m.GeoTrustedProxies...)
+	if m.SameOriginLanguage {
+		writeArgs("same_origin_language", "true")
+	}
+	writeArgs("allowed_origin_domains", m.AllowedOriginDomains...)
+	writeArgs("match_charsets", m.MatchCharsets...)
+	writeArgs("match_encodings", m.MatchEncodings...)
+	writeArgs("match_content_types", m.MatchContentTypes...)
+	writeArgs("allowed_methods", m.AllowedMethods...)
+	writeArgs("disallowed_methods", m.DisallowedMethods...)
+	writeString("assert_method", m.AssertMethod)
+	if m.RequireAtLeastOneHeader {
+		writeArgs("require_at_least_one_header", "true")
+	}
+	if len(m.ChainedMatcher) > 0 && err == nil {
+		err = errors.New("chained_matcher cannot be expressed in a Caddyfile.")
+	}
+	if m.ChainBefore {
+		writeArgs("chain_before", "true")
+	}
+	if m.InvertMatch {
+		writeArgs("invert_match", "true")
+	}
+	writeString("force_type_query_string", m.ForceTypeQueryString)
+	for _, mechanism := range m.ForcePriority {
+		if len(mechanism.Key) > 0 {
+			writeArgs("force_type", mechanism.Source, mechanism.Key)
+		} else {
+			writeArgs("force_type", mechanism.Source)
+		}
+	}
+	writeString("force_language_query_string", m.ForceLanguageQueryString)
+	localeAliases := make([]string, 0, len(m.LocaleAlias))
+	for alias := range m.LocaleAlias {
+		localeAliases = append(localeAliases, alias)
+	}
+	slices.Sort(localeAliases)
+	for _, alias := range localeAliases {
+		writeArgs("locale_alias", alias, m.LocaleAlias[alias])
+	}
+	writeString("force_cookie_type", m.ForceCookieType)
+	if m.RememberNegotiationCookie {
+		writeArgs("remember_negotiation_cookie", "true")
+	}
+	if m.RememberMaxAge != 0 {
+		writeArgs("remember_max_age", strconv.Itoa(m.RememberMaxAge))
+	}
+	if m.ForceTypeAcceptReplace {
+		writeArgs("force_type_accept_replace", "true")
+	}
+	if m.ForceLanguageAcceptReplace {
+		writeArgs("force_language_accept_replace", "true")
+	}
+	if m.RemoveForceParam {
+		writeArgs("remove_force_param", "true")
+	}
+	if m.NormalizeQueryParam {
+		writeArgs("normalize_query_param", "true")
+	}
+	if m.DisableBuiltinAliases {
+		writeArgs("disable_builtin_aliases", "true")
+	}
+	writeString("force_query_param_multi_value", m.ForceQueryParamMultiValue)
+	writeString("force_charset_query_string", m.ForceCharsetQueryString)
+	writeString("force_encoding_query_string", m.ForceEncodingQueryString)
+	writeString("var_type", m.VarType)
+	writeString("default_type_on_empty", m.DefaultTypeOnEmpty)
+	writeArgs("mime_param_whitelist", m.MIMEParamWhitelist...)
+	if m.MultipleTypeVars {
+		writeArgs("multiple_type_vars", "true")
+	}
+	if m.MaxTypeVars != 0 {
+		writeArgs("max_type_vars", strconv.Itoa(m.MaxTypeVars))
+	}
+	writeString("var_type_base", m.VarTypeBase)
+	writeString("var_type_type", m.VarTypeType)
+	writeString("var_type_subtype", m.VarTypeSubtype)
+	writeString("var_extension", m.VarExtension)
+	writeString("var_language", m.VarLanguage)
+	writeString("default_language_on_empty", m.DefaultLanguageOnEmpty)
+	writeString("var_language_confidence", m.VarLanguageConfidence)
+	writeString("var_charset", m.VarCharset)
+	writeString("default_charset_on_empty", m.DefaultCharsetOnEmpty)
+	if m.ExtractCharsetFromType {
+		writeArgs("extract_charset_from_type", "true")
+	}
+	writeString("var_encoding", m.VarEncoding)
+	writeString("default_encoding_on_empty", m.DefaultEncodingOnEmpty)
+	writeString("var_match_count", m.VarMatchCount)
+	writeString("var_negotiated_all", m.VarNegotiatedAll)
+	writeString("var_negotiated_all_delimiter", m.VarNegotiatedAllDelimiter)
+	writeString("var_force_used", m.VarForceUsed)
+	writeString("score_var", m.ScoreVar)
+	writeString("score_aggregation", m.ScoreAggregation)
+	writeString("ttl_var", m.TTLVar)
+	if m.BaseTTL != 0 {
+		writeArgs("base_ttl", strconv.Itoa(m.BaseTTL))
+	}
+	writeString("var_content_type", m.VarContentType)
+	profileTypes := make([]string, 0, len(m.MatchProfiles))
+	for t := range m.MatchProfiles {
+		profileTypes = append(profileTypes, t)
+	}
+	slices.Sort(profileTypes)
+	for _, t := range profileTypes {
+		writeArgs("match_profile", append([]string{t}, m.MatchProfiles[t]...)...)
+	}
+	writeString("var_profile", m.VarProfile)
+	writeArgs("match_api_versions", m.MatchAPIVersions...)
+	writeString("var_api_version", m.VarAPIVersion)
+	writeString("temporal_header_name", m.TemporalHeaderName)
+	writeString("temporal_format", m.TemporalFormat)
+	writeString("before_date", m.BeforeDate)
+	writeString("after_date", m.AfterDate)
+	writeString("var_temporal_date", m.VarTemporalDate)
+	if m.MatchInboundContentType {
+		writeArgs("match_inbound_content_type", "true")
+	}
+	if m.Reflect {
+		writeArgs("reflect", "true")
+	}
+	upstreamTypes := make([]string, 0, len(m.UpstreamMap))
+	for t := range m.UpstreamMap {
+		upstreamTypes = append(upstreamTypes, t)
+	}
+	slices.Sort(upstreamTypes)
+	for _, t := range upstreamTypes {
+		writeArgs("upstream", t, m.UpstreamMap[t])
+	}
+	writeString("dynamic_upstream_var", m.DynamicUpstreamVar)
+	if m.PostAuthMode {
+		writeArgs("post_auth_mode", "true")
+	}
+	if m.ZeroQRejectsAll {
+		writeArgs("zero_q_rejects_all", "true")
+	}
+	writeArgs("graceful_degradation", m.GracefulDegradation...)
+	if m.CoordinateWithEncode {
+		writeArgs("coordinate_with_encode", "true")
+	}
+	if m.CompressionAware {
+		writeArgs("compression_aware", "true")
+	}
+	writeArgs("already_compressed_types", m.AlreadyCompressedTypes...)
+	if m.EncodingFallbackToIdentity {
+		writeArgs("encoding_fallback_to_identity", "true")
+	}
+	if m.AdvertiseAcceptPatch {
+		writeArgs("advertise_accept_patch", "true")
+	}
+	if m.RespondToOptions {
+		writeArgs("respond_to_options", "true")
+	}
+	writeString("auth_context_key", m.AuthContextKey)
+	claims := make([]string, 0, len(m.AuthExtendedOffers))
+	for claim := range m.AuthExtendedOffers {
+		claims = append(claims, claim)
+	}
+	slices.Sort(claims)
+	for _, claim := range claims {
+		writeArgs("auth_extended_offers", append([]string{claim}, m.AuthExtendedOffers[claim]...)...)
+	}
+	if m.NoteHeader {
+		writeArgs("note_header", "true")
+	}
+	if m.PrioritizeOffer {
+		writeArgs("prioritize_offer", "true")
+	}
+	if m.UseClientHints {
+		writeArgs("use_client_hints", "true")
+	}
+	writeString("wildcard_default", m.WildcardDefault)
+	if m.MultipartFallback {
+		writeArgs("multipart_fallback", "true")
+	}
+	writeString("example", m.ExampleComment)
+	writeString("source_tag", m.SourceTag)
+	writeString("registry_key", m.RegistryKey)
+	if m.ExposeAdmin {
+		writeArgs("expose_admin", "true")
+	}
+	if m.HistorySize != 0 {
+		writeArgs("history_size", strconv.Itoa(m.HistorySize))
+	}
+	if m.LogFields {
+		writeArgs("log_fields", "true")
+	}
+	writeString("content_negotiation_log", m.ContentNegotiationLog)
+	if m.ContentNegotiationLogMaxMB != 0 {
+		writeArgs("content_negotiation_log_max_mb", strconv.Itoa(m.ContentNegotiationLogMaxMB))
+	}
+	writeString("telemetry_key", m.TelemetryKey)
+	for _, raw := range m.Hooks {
+		var hook map[string]json.RawMessage
+		var name string
+		if json.Unmarshal(raw, &hook) != nil || len(hook) != 1 || json.Unmarshal(hook["hook"], &name) != nil {
+			if err == nil {
+				err = errors.New("Hooks with a configuration cannot be expressed in a Caddyfile.")
+			}
+			continue
+		}
+		writeArgs("hook", name)
+	}
+	if m.MaxOfferListSize != 0 {
+		writeArgs("max_offer_list_size", strconv.Itoa(m.MaxOfferListSize))
+	}
+	writeString("language_display_format", m.LanguageDisplayFormat)
+	writeString("etag_var", m.ETagVar)
+	writeString("etag_salt", m.ETagSalt)
+	writeString("offer_list_version", m.OfferListVersion)
+	if m.ImplicitUTF8 != nil {
+		writeArgs("implicit_utf8", strconv.FormatBool(*m.ImplicitUTF8))
+	}
+	if m.BackwardsCompatibilityMode {
+		writeArgs("backwards_compatibility_mode", "true")
+	}
+	sb.WriteString("}\n")
+
+	if err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// quoteCaddyfileArg quotes a Caddyfile argument if it would not be read as a single token otherwise.
+func quoteCaddyfileArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\"{}#`") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
+
+// parseChainedMatcher reads the block of a chained_matcher directive, in
+// which each line configures another request matcher like in a named
+// matcher, as in `path /api/*`, and adds the matchers to those of earlier
+// blocks. As in a named matcher, the lines of the same matcher configure it
+// together, so that `path /api/*` and `path /v2/*` make one path matcher
+// for both.
+func parseChainedMatcher(d *caddyfile.Dispenser, chained []json.RawMessage) ([]json.RawMessage, error) {
+	var names []string
+	tokens := make(map[string][]caddyfile.Token)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if _, ok := tokens[name]; !ok {
+			for _, raw := range chained {
+				var set caddy.ModuleMap
+				if err := json.Unmarshal(raw, &set); err == nil && set[name] != nil {
+					return nil, d.Errf("matcher %s is chained already, configure it in a single chained_matcher block", name)
+				}
+			}
+			names = append(names, name)
+		}
+		tokens[name] = append(tokens[name], d.NextSegment()...)
+	}
+	if len(names) == 0 {
+		return nil, d.ArgErr()
+	}
+	for _, name := range names {
+		mod, err := caddy.GetModule("http.matchers." + name)
+		if err != nil {
+			return nil, d.Errf("unknown matcher: %s", name)
+		}
+		unmarshaler, ok := mod.New().(caddyfile.Unmarshaler)
+		if !ok {
+			return nil, d.Errf("matcher %s cannot be configured in a Caddyfile", name)
+		}
+		if err := unmarshaler.UnmarshalCaddyfile(caddyfile.NewDispenser(tokens[name])); err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(unmarshaler)
+		if err != nil {
+			return nil, d.Errf("encoding matcher %s: %v", name, err)
+		}
+		set, err := json.Marshal(caddy.ModuleMap{name: raw})
+		if err != nil {
+			return nil, d.Errf("encoding matcher %s: %v", name, err)
+		}
+		chained = append(chained, set)
+	}
+	return chained, nil
+}
+
+// offerArgs reads the offers of an offer list directive, including those on
+// the following lines that start with `+` to continue the list:
+//
+//	match_types text/html
+//	    + application/json application/ld+json
+//
+// (Ending a line with `\` continues it, too, as anywhere in a Caddyfile.)
+func offerArgs(d *caddyfile.Dispenser) []string {
+	args := d.RemainingArgs()
+	for d.Next() {
+		if !strings.HasPrefix(d.Val(), "+") {
+			// the next directive
+			d.Prev()
+			break
+		}
+		if offer := strings.TrimPrefix(d.Val(), "+"); len(offer) > 0 {
+			args = append(args, offer)
+		}
+		args = append(args, d.RemainingArgs()...)
+	}
+	return args
+}
+
+// parseCaddyfileBool reads an optional boolean argument of a flag directive.
+// A flag without an argument is true.
+func parseCaddyfileBool(d *caddyfile.Dispenser) (bool, error) {
+	if !d.NextArg() {
+		return true, nil
+	}
+	val, err := strconv.ParseBool(d.Val())
+	if err != nil {
+		return false, d.Errf("invalid boolean value: %s", d.Val())
+	}
+	return val, nil
+}
+
+// Equal reports whether two matchers have the same configuration. Offer
+// lists are compared in order, since order decides between offers of equal
+// quality; fields populated during Provision are not compared. The comparison
+// is based on the JSON representation of the configuration, in which map
+// keys are sorted, so maps compare independent of order.
+func (m *MatchConneg) Equal(other *MatchConneg) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	a, err := json.Marshal(m)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
+
+// SynthesizeAcceptHeader formats the offered types as the value of an Accept
+// header, with the server-side qualities of the offers, so that a request
+// forwarded to a backend under test asks for what this matcher offers.
+func (m MatchConneg) SynthesizeAcceptHeader() string {
+	values := make([]string, 0, len(m.MatchTypes))
+	for _, t := range m.MatchTypes {
+		offer, quality, err := splitOfferQuality(t)
+		if err != nil {
+			offer, quality = t, 1.0
+		}
+		if q, ok := m.TypeQualities[offer]; ok {
+			quality = q
+		}
+		if q, ok := m.serverQualities[offer]; ok {
+			quality = q
+		}
+		if quality < 1.0 {
+			offer += ";q=" + strconv.FormatFloat(quality, 'f', -1, 64)
+		}
+		values = append(values, offer)
+	}
+	return strings.Join(values, ", ")
+}
+
+// SynthesizeAcceptLanguage formats the offered languages as the value of an
+// Accept-Language header, see SynthesizeAcceptHeader.
+func (m MatchConneg) SynthesizeAcceptLanguage() string {
+	return strings.Join(m.MatchLanguages, ", ")
+}
+
+// Provision sets up the module.
+func (m *MatchConneg) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m) // m.logger is a *zap.Logger
+	// the config has been adapted, so profiles are of no further use
+	forgetProfiles()
+	if len(m.OffersFrom) > 0 {
+		app, err := ctx.App(m.OffersFrom)
+		if err != nil {
+			return fmt.Errorf("Cannot take offers from '%s': %v", m.OffersFrom, err)
+		}
+		if err := m.offersFrom(app); err != nil {
+			return err
+		}
+	}
+	if len(m.ChainedMatcher) > 0 {
+		m.chainedMatchers = nil
+		for _, raw := range m.ChainedMatcher {
+			var set caddy.ModuleMap
+			if err := json.Unmarshal(raw, &set); err != nil {
+				return fmt.Errorf("Invalid chained_matcher %s: %v", raw, err)
+			}
+			// in a fixed order, so that the same requests are short-circuited
+			names := make([]string, 0, len(set))
+			for name := range set {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				mod, err := ctx.LoadModuleByID("http.matchers."+name, set[name])
+				if err != nil {
+					return fmt.Errorf("Cannot load chained_matcher '%s': %v", name, err)
+				}
+				matcher, ok := mod.(caddyhttp.RequestMatcher)
+				if !ok {
+					return fmt.Errorf("Module '%s' of chained_matcher is not a request matcher.", name)
+				}
+				m.chainedMatchers = append(m.chainedMatchers, matcher)
+			}
+		}
+	}
+	if len(m.Hooks) > 0 {
+		mods, err := ctx.LoadModule(m, "Hooks")
+		if err != nil {
+			return fmt.Errorf("Cannot load hooks: %v", err)
+		}
+		hooks, _ := mods.([]interface{})
+		m.hooks = nil
+		for _, mod := range hooks {
+			hook, ok := mod.(Hook)
+			if !ok {
+				return fmt.Errorf("Module %T is not a conneg hook.", mod)
+			}
+			m.hooks = append(m.hooks, hook)
+		}
+	}
+	return m.provision()
+}
+
+// MustProvision is like Provision, but panics on errors. It is meant for
+// tests and never to be used in production code paths.
+func (m *MatchConneg) MustProvision(ctx caddy.Context) {
+	if err := m.Provision(ctx); err != nil {
+		panic(err)
+	}
+}
+
+// MustProvisionWithLogger sets up the module with the given logger instead of
+// one from a Caddy context, and panics on errors. Without a context, it cannot
+// load the modules of ChainedMatcher and Hooks or the app of OffersFrom, so
+// setting any of them is an error, too. It is meant for tests and never to be
+// used in production code paths.
+func (m *MatchConneg) MustProvisionWithLogger(l *zap.Logger) {
+	if len(m.ChainedMatcher) > 0 || len(m.Hooks) > 0 || len(m.OffersFrom) > 0 {
+		panic(errors.New("chained_matcher, hooks and offers_from need a Caddy context, use MustProvision."))
+	}
+	m.logger = l
+	if err := m.provision(); err != nil {
+		panic(err)
+	}
+}
+
+// provision does the actual setup once the logger is in place.
+func (m *MatchConneg) provision() error {
+	m.cleanedUp = false
+	// start over if the matcher is provisioned again
+	m.MatchTTypes, m.MatchTLanguages, m.MatchTCharsets, m.MatchTEncodings = nil, nil, nil, nil
+	m.matchTContentTypes, m.profileTTypes = nil, nil
+	if len(m.SourceTag) > 0 && m.logger != nil {
+		m.logger = m.logger.With(zap.String("source_tag", m.SourceTag))
+	}
+	if len(m.Inherit) > 0 {
+		if err := m.inherit(); err != nil {
+			return err
+		}
+	}
+	m.serverQualities = make(map[string]float64)
+	// MatchTypes is left as configured, with the qualities of its offers
+	m.matchTypes = make([]string, 0, len(m.MatchTypes))
+	for _, t := range m.MatchTypes {
+		offer, quality, err := splitOfferQuality(t)
+		if err != nil {
+			return err
+		}
+		m.matchTypes = append(m.matchTypes, offer)
+		m.serverQualities[offer] = quality
+		m.MatchTTypes = append(m.MatchTTypes, contenttype.NewMediaType(offer))
+	}
+	for offer, quality := range m.TypeQualities {
+		m.serverQualities[offer] = quality
+	}
+	m.weightedTypes = false
+	for _, quality := range m.serverQualities {
+		if quality != 1.0 {
+			m.weightedTypes = true
+		}
+	}
+
+	if m.Reflect {
+		types := append([]string(nil), m.matchTypes...)
+		for _, t := range m.MatchContentTypes {
+			if !slices.Contains(m.matchTypes, t) {
+				m.matchTypes = append(m.matchTypes, t)
+				m.serverQualities[t] = 1.0
+				m.MatchTTypes = append(m.MatchTTypes, contenttype.NewMediaType(t))
+			}
+		}
+		for _, t := range types {
+			if !slices.Contains(m.MatchContentTypes, t) {
+				m.MatchContentTypes = append(m.MatchContentTypes, t)
+			}
+		}
+	}
+
+	m.forceTypes = append([]ForceMechanism(nil), m.ForcePriority...)
+	if len(m.ForceTypeQueryString) > 0 {
+		m.forceTypes = append(m.forceTypes, ForceMechanism{Source: "query", Key: m.ForceTypeQueryString})
+	}
+	if len(m.ForceCookieType) > 0 {
+		m.forceTypes = append(m.forceTypes, ForceMechanism{Source: "cookie", Key: m.ForceCookieType})
+	}
+
+	for _, offer := range m.MatchTTypes {
+		for _, profile := range m.MatchProfiles[offer.MIME()] {
+			variant := contenttype.MediaType{Type: offer.Type, Subtype: offer.Subtype, Parameters: contenttype.Parameters{"profile": profile}}
+			for k, v := range offer.Parameters {
+				variant.Parameters[k] = v
+			}
+			m.profileTTypes = append(m.profileTTypes, variant)
+		}
+	}
+
+	if m.PostAuthMode {
+		m.authOffers = make(map[string][]string)
+		m.authTTypes = make(map[string][]contenttype.MediaType)
+		for claim, extended := range m.AuthExtendedOffers {
+			offers := append([]string(nil), m.matchTypes...)
+			typed := append([]contenttype.MediaType(nil), m.MatchTTypes...)
+			for _, t := range extended {
+				if !slices.Contains(offers, t) {
+					offers = append(offers, t)
+					typed = append(typed, contenttype.NewMediaType(t))
+				}
+			}
+			m.authOffers[claim], m.authTTypes[claim] = offers, typed
+		}
+	}
+
+	m.MatchTLanguages = append(m.MatchTLanguages, language.Make("und"))
+	for _, l := range m.MatchLanguages {
+		m.MatchTLanguages = append(m.MatchTLanguages, language.Make(l))
+	}
+	m.LanguageMatcher = language.NewMatcher(m.MatchTLanguages)
+	if m.GeoLanguage {
+		if err := m.provisionGeo(); err != nil {
+			return err
+		}
+	}
+	m.history = nil
+	if m.HistorySize > 0 {
+		m.history = newNegotiationHistory(m.HistorySize)
+	}
+	if len(m.ContentNegotiationLog) > 0 {
+		maxMB := m.ContentNegotiationLogMaxMB
+		if maxMB == 0 {
+			maxMB = 100
+		}
+		negotiationLog, err := openNegotiationLog(m.ContentNegotiationLog, maxMB)
+		if err != nil {
+			return err
+		}
+		m.negotiationLog = negotiationLog
+	}
+
+	for _, t := range m.MatchContentTypes {
+		m.matchTContentTypes = append(m.matchTContentTypes, contenttype.NewMediaType(t))
+	}
+	if m.MatchInboundContentType {
+		for i, t := range m.matchTypes {
+			if !slices.Contains(m.MatchContentTypes, t) {
+				m.matchTContentTypes = append(m.matchTContentTypes, m.MatchTTypes[i])
+			}
+		}
+	}
+
+	for _, c := range m.MatchCharsets {
+		m.MatchTCharsets = append(m.MatchTCharsets, CharsetOrEncoding{Value: c})
+	}
+
+	for _, e := range m.MatchEncodings {
+		m.MatchTEncodings = append(m.MatchTEncodings, CharsetOrEncoding{Value: e})
+	}
+
+	if offers := len(m.matchTypes) + len(m.MatchLanguages) + len(m.MatchCharsets) + len(m.MatchEncodings) + len(m.MatchContentTypes); offers > largeOfferCount {
+		m.logger.Warn("large number of offers may slow down negotiation", zap.Int("offers", offers))
+	}
+
+	m.warnings = m.VerifyConfig()
+	for _, w := range m.warnings {
+		m.logger.Warn(w.Message, zap.String("field", w.Field))
+	}
+
+	m.registryKey = m.RegistryKey
+	if m.registryKey == "" {
+		m.registryKey = fmt.Sprintf("%s@%p", m.CaddyModule().ID, m)
+	}
+	Registry.Store(m.registryKey, m)
+
+	m.logger.Info("conneg provisioned",
+		zap.Int("types", len(m.MatchTTypes)),
+		zap.Strings("first_types", firstOffers(m.matchTypes)),
+		zap.Int("languages", len(m.MatchLanguages)),
+		zap.Strings("first_languages", firstOffers(m.MatchLanguages)),
+		zap.Int("charsets", len(m.MatchTCharsets)),
+		zap.Strings("first_charsets", firstOffers(m.MatchCharsets)),
+		zap.Int("encodings", len(m.MatchTEncodings)),
+		zap.Strings("first_encodings", firstOffers(m.MatchEncodings)),
+		zap.Int("content_types", len(m.matchTContentTypes)),
+		zap.Strings("first_content_types", firstOffers(m.MatchContentTypes)),
+		zap.Int("aliases", aliasCount()),
+		zap.String("force_type_query_string", m.ForceTypeQueryString),
+		zap.String("force_language_query_string", m.ForceLanguageQueryString),
+		zap.String("force_charset_query_string", m.ForceCharsetQueryString),
+		zap.String("force_encoding_query_string", m.ForceEncodingQueryString),
+		zap.String("example", m.ExampleComment),
+	)
+	return nil
+}
+
+// inherit puts the offer lists of the matcher named in Inherit in front of
+// this matcher's own.
+func (m *MatchConneg) inherit() error {
+	value, ok := Registry.Load(m.Inherit)
+	parent, isMatcher := value.(*MatchConneg)
+	if !ok || !isMatcher || parent == m {
+		return fmt.Errorf("Cannot inherit from '%s': no such matcher has been provisioned before.", m.Inherit)
+	}
+	var types []string
+	for _, t := range parent.matchTypes {
+		// the matcher's own offers (and their qualities) take precedence
+		if slices.IndexFunc(m.MatchTypes, func(offer string) bool {
+			offer, _, err := splitOfferQuality(offer)
+			return err == nil && offer == t
+		}) >= 0 {
+			continue
+		}
+		if _, own := m.TypeQualities[t]; !own && parent.serverQualities[t] != 1.0 {
+			t += ";q=" + strconv.FormatFloat(parent.serverQualities[t], 'f', -1, 64)
+		}
+		types = append(types, t)
+	}
+	m.MatchTypes = append(types, m.MatchTypes...)
+	m.MatchLanguages = mergeOffers(parent.MatchLanguages, m.MatchLanguages)
+	m.MatchCharsets = mergeOffers(parent.MatchCharsets, m.MatchCharsets)
+	m.MatchEncodings = mergeOffers(parent.MatchEncodings, m.MatchEncodings)
+	m.MatchContentTypes = mergeOffers(parent.MatchContentTypes, m.MatchContentTypes)
+	return nil
+}
+
+// offersFrom puts the offer lists of the app named in OffersFrom in front of
+// this matcher's own.
+func (m *MatchConneg) offersFrom(app interface{}) error {
+	provider, ok := app.(ConnegOffersProvider)
+	if !ok {
+		return fmt.Errorf("Cannot take offers from '%s': the app does not provide conneg offers.", m.OffersFrom)
+	}
+	offers := provider.GetOffers()
+	// the matcher's own offers (and their qualities) take precedence
+	var types []string
+	for _, t := range offers.Types {
+		offer, _, err := splitOfferQuality(t)
+		if err != nil {
+			return fmt.Errorf("Invalid type '%s' from '%s': %v", t, m.OffersFrom, err)
+		}
+		if slices.IndexFunc(m.MatchTypes, func(own string) bool {
+			own, _, err := splitOfferQuality(own)
+			return err == nil && own == offer
+		}) < 0 {
+			types = append(types, t)
+		}
+	}
+	m.MatchTypes = append(types, m.MatchTypes...)
+	m.MatchLanguages = mergeOffers(offers.Languages, m.MatchLanguages)
+	m.MatchCharsets = mergeOffers(offers.Charsets, m.MatchCharsets)
+	m.MatchEncodings = mergeOffers(offers.Encodings, m.MatchEncodings)
+	return nil
+}
+
+// mergeOffers returns the offers taken over from elsewhere that are not
+// among a matcher's own, followed by its own.
+func mergeOffers(inherited, own []string) []string {
+	var merged []string
+	for _, offer := range inherited {
+		if !slices.Contains(own, offer) {
+			merged = append(merged, offer)
+		}
+	}
+	return append(merged, own...)
+}
+
+// firstOffers shortens an offer list for logging.
+func firstOffers(offers []string) []string {
+	if len(offers) > 5 {
+		return offers[:5]
+	}
+	return offers
+}
+
+// Cleanup removes the module from the registry and releases what Provision
+// has set up. Using the matcher afterwards panics, to catch that early.
+func (m *MatchConneg) Cleanup() error {
+	// during a config reload, a new instance may already have taken over the key
+	if v, ok := Registry.Load(m.registryKey); ok && v == m {
+		Registry.Delete(m.registryKey)
+	}
+	// let go of what has been set up in Provision
+	m.MatchTTypes, m.MatchTLanguages, m.MatchTCharsets, m.MatchTEncodings = nil, nil, nil, nil
+	m.matchTypes, m.matchTContentTypes, m.profileTTypes = nil, nil, nil
+	m.chainedMatchers, m.hooks = nil, nil
+	m.LanguageMatcher = nil
+	m.logger = nil
+	var err error
+	if m.geoDB != nil {
+		err = m.geoDB.Close()
+		m.geoDB = nil
+	}
+	if m.negotiationLog != nil {
+		if logErr := m.negotiationLog.close(); err == nil {
+			err = logErr
+		}
+		m.negotiationLog = nil
+	}
+	m.cleanedUp = true
+	return err
+}
+
+// HealthCheck verifies that the state set up by Provision is complete, i.e.
+// that every offer list has been parsed and that the language matcher and
+// the logger are in place. It catches provisioning failures that did not
+// surface as errors, and is served for all matchers in the Registry at the
+// /conneg/health endpoint of the admin API.
+func (m *MatchConneg) HealthCheck() error {
+	if m.cleanedUp {
+		return errors.New("Matcher has been cleaned up.")
+	}
+	if m.logger == nil {
+		return errors.New("Matcher has not been provisioned: no logger.")
+	}
+	if m.LanguageMatcher == nil {
+		return errors.New("Matcher has not been provisioned: no language matcher.")
+	}
+	for _, offers := range []struct {
+		name           string
+		given, offered int
+	}{
+		{"match_types", len(m.matchTypes), len(m.MatchTTypes)},
+		{"match_languages", len(m.MatchLanguages), len(m.MatchTLanguages) - 1},
+		{"match_charsets", len(m.MatchCharsets), len(m.MatchTCharsets)},
+		{"match_encodings", len(m.MatchEncodings), len(m.MatchTEncodings)},
+	} {
+		if offers.given != offers.offered {
+			return fmt.Errorf("%s has %d entries, but %d of them are offered.", offers.name, offers.given, offers.offered)
+		}
+	}
+	if m.GeoLanguage && m.geoDB == nil {
+		return errors.New("geo_database has not been opened.")
+	}
+	return nil
+}
+
+// Validate validates that the module has a usable config.
+func (m MatchConneg) Validate() error {
+	if len(m.MatchTypes)+len(m.MatchLanguages)+len(m.MatchCharsets)+len(m.MatchEncodings)+len(m.MatchContentTypes)+len(m.AuthExtendedOffers) == 0 && len(m.Inherit) == 0 && len(m.OffersFrom) == 0 {
+		return errors.New("One of match_types, match_languages, match_charsets, match_encodings, match_content_types MUST be set.")
+	}
+	if m.RemoveForceParam {
+		// form fields are not part of the URL
+		keys := m.forceQueryKeys()
+		delete(keys, "force_type form")
+		if len(keys) == 0 {
+			return errors.New("remove_force_param needs a query parameter to force values with, like force_type_query_string.")
+		}
+	}
+	switch m.ForceQueryParamMultiValue {
+	case "", "first", "last", "highest_quality":
+	default:
+		return fmt.Errorf("Unknown force_query_param_multi_value '%s', expected first, last or highest_quality.", m.ForceQueryParamMultiValue)
+	}
+	if len(m.ForceQueryParamMultiValue) > 0 && len(m.forceQueryKeys()) == 0 {
+		return errors.New("force_query_param_multi_value needs a query parameter to force values with, like force_type_query_string.")
+	}
+	if len(m.AllowedMethods) > 0 && len(m.DisallowedMethods) > 0 {
+		return errors.New("Only one of allowed_methods and disallowed_methods can be set.")
+	}
+	if len(m.AssertMethod) > 0 {
+		if len(m.AllowedMethods) > 0 || len(m.DisallowedMethods) > 0 {
+			return errors.New("assert_method cannot be combined with allowed_methods or disallowed_methods.")
+		}
+		// RFC 7231, 4.1: methods are tokens
+		if _, rest, ok := consumeToken(m.AssertMethod); !ok || len(rest) > 0 {
+			return fmt.Errorf("assert_method '%s' is not a valid HTTP method.", m.AssertMethod)
+		}
+	}
+	if m.HistorySize < 0 {
+		return errors.New("history_size must not be negative.")
+	}
+	if m.MaxOfferListSize < 0 {
+		return errors.New("max_offer_list_size must not be negative.")
+	}
+	if m.MaxTypeVars < 0 {
+		return errors.New("max_type_vars must not be negative.")
+	}
+	if m.MultipleTypeVars && len(m.VarType) == 0 {
+		return errors.New("multiple_type_vars needs var_type to name the variables.")
+	}
+	if m.MaxOfferListSize > 0 {
+		for name, offers := range map[string][]string{"match_types": m.MatchTypes, "match_languages": m.MatchLanguages, "match_charsets": m.MatchCharsets, "match_encodings": m.MatchEncodings, "match_content_types": m.MatchContentTypes} {
+			if len(offers) > m.MaxOfferListSize {
+				return fmt.Errorf("%s has %d entries, more than max_offer_list_size (%d) allows.", name, len(offers), m.MaxOfferListSize)
+			}
+		}
+	}
+	for t, quality := range m.TypeQualities {
+		if quality < 0 || quality > 1 {
+			return fmt.Errorf("Quality %v of type '%s' is not between 0 and 1.", quality, t)
+		}
+		if slices.IndexFunc(m.MatchTypes, func(offer string) bool {
+			offer, _, err := splitOfferQuality(offer)
+			return err == nil && offer == t
+		}) < 0 {
+			return fmt.Errorf("Type '%s' in type_qualities is not listed in match_types.", t)
+		}
+	}
+	for _, dimension := range m.GracefulDegradation {
+		switch dimension {
+		case "type", "language", "charset", "encoding":
+		default:
+			return fmt.Errorf("Unknown dimension '%s' in graceful_degradation, use one of type, language, charset, encoding.", dimension)
+		}
+	}
+	switch m.ScoreAggregation {
+	case "", "product", "minimum", "average":
+	default:
+		return fmt.Errorf("Unknown score_aggregation '%s', use one of product, minimum, average.", m.ScoreAggregation)
+	}
+	switch m.LanguageDisplayFormat {
+	case "", "bcp47", "ietf", "display_en", "display_native", "iso639_1":
+	default:
+		return fmt.Errorf("Unknown language_display_format '%s', use one of bcp47, ietf, display_en, display_native, iso639_1.", m.LanguageDisplayFormat)
+	}
+	if len(m.MatchTypes) == 0 && len(m.AuthExtendedOffers) == 0 && (len(m.VarTypeBase+m.VarTypeType+m.VarTypeSubtype+m.VarExtension) > 0 || len(m.VarType) > 0 && len(m.DefaultTypeOnEmpty) == 0) {
+		return errors.New("You cannot specify a variable to store content negotiation results (for content types) if you don't also specify what types are offered. (Use '*/*' to work around this constraint.)")
+	}
+	if len(m.MatchLanguages) == 0 && (len(m.VarLanguageConfidence) > 0 || len(m.VarLanguage) > 0 && len(m.DefaultLanguageOnEmpty) == 0) {
+		return errors.New("You cannot specify a variable to store content negotiation results (for languages) if you don't also specify what languages are offered. (Use '*' to work around this constraint.)")
+	}
+	if m.GeoLanguage && (len(m.MatchLanguages) == 0 || len(m.GeoDatabase) == 0) {
+		return errors.New("geo_language needs match_languages and geo_database to be set.")
+	}
+	if m.SameOriginLanguage && (len(m.MatchLanguages) == 0 || len(m.AllowedOriginDomains) == 0) {
+		return errors.New("same_origin_language needs match_languages and allowed_origin_domains to be set.")
+	}
+	if len(m.AllowedOriginDomains) > 0 && !m.SameOriginLanguage {
+		return errors.New("allowed_origin_domains has no effect without same_origin_language.")
+	}
+	if len(m.MatchCharsets) == 0 && len(m.VarCharset) > 0 && !m.ExtractCharsetFromType && len(m.DefaultCharsetOnEmpty) == 0 {
+		return errors.New("You cannot specify a variable to store content negotiation results (for charsets) if you don't also specify what charsets are offered. (Use '*' to work around this constraint.)")
+	}
+	if len(m.MatchEncodings) == 0 && len(m.VarEncoding) > 0 && len(m.DefaultEncodingOnEmpty) == 0 {
+		return errors.New("You cannot specify a variable to store content negotiation results (for encodings) if you don't also specify what encodings are offered. (Use '*' to work around this constraint.)")
+	}
+	for _, dimension := range []struct {
+		directive, value string
+		offered          bool
+	}{
+		{"default_type_on_empty", m.DefaultTypeOnEmpty, len(m.MatchTypes) > 0 || m.PostAuthMode},
+		{"default_language_on_empty", m.DefaultLanguageOnEmpty, len(m.MatchLanguages) > 0},
+		{"default_charset_on_empty", m.DefaultCharsetOnEmpty, len(m.MatchCharsets) > 0},
+		{"default_encoding_on_empty", m.DefaultEncodingOnEmpty, len(m.MatchEncodings) > 0},
+	} {
+		if len(dimension.value) > 0 && dimension.offered {
+			return fmt.Errorf("%s has no effect if there are offers to negotiate.", dimension.directive)
+		}
+	}
+	if len(m.DynamicUpstreamVar) > 0 && (len(m.MatchTypes) == 0 || len(m.UpstreamMap) == 0) {
+		return errors.New("You cannot specify a variable to store the upstream for the negotiated type if you don't also specify what types are offered and which upstreams serve them.")
+	}
+	if m.ExtractCharsetFromType && (len(m.MatchTypes) == 0 || len(m.VarCharset) == 0) {
+		return errors.New("extract_charset_from_type needs match_types and var_charset to be set.")
+	}
+	if m.CoordinateWithEncode && len(m.MatchEncodings) == 0 {
+		return errors.New("You cannot coordinate the negotiated encoding with compressing handlers if you don't also specify what encodings are offered.")
+	}
+	if m.UseClientHints && len(m.MatchTypes) == 0 {
+		return errors.New("use_client_hints needs match_types to be set.")
+	}
+	if m.CompressionAware && (len(m.MatchTypes) == 0 || len(m.MatchEncodings) == 0) {
+		return errors.New("compression_aware needs match_types and match_encodings to be set.")
+	}
+	if m.EncodingFallbackToIdentity && len(m.MatchEncodings) == 0 {
+		return errors.New("encoding_fallback_to_identity needs match_encodings to be set.")
+	}
+	if len(m.AlreadyCompressedTypes) > 0 && !m.CompressionAware {
+		return errors.New("already_compressed_types has no effect without compression_aware.")
+	}
+	for _, t := range m.AlreadyCompressedTypes {
+		if _, err := contenttype.ParseMediaType(t); err != nil {
+			return fmt.Errorf("Invalid type '%s' in already_compressed_types: %v", t, err)
+		}
+	}
+	if (m.AdvertiseAcceptPatch || m.RespondToOptions) && len(m.MatchTypes) == 0 {
+		return errors.New("You cannot advertise the types accepted for PATCH requests if you don't also specify what types are offered.")
+	}
+	if m.PostAuthMode && (len(m.AuthContextKey) == 0 || len(m.AuthExtendedOffers) == 0) {
+		return errors.New("post_auth_mode needs auth_context_key and auth_extended_offers to be set.")
+	}
+	for t := range m.MatchProfiles {
+		if slices.IndexFunc(m.MatchTypes, func(offer string) bool { return contenttype.NewMediaType(offer).MIME() == t }) < 0 {
+			return fmt.Errorf("You cannot accept profiles for type '%s' if you don't also offer the type in match_types.", t)
+		}
+	}
+	if len(m.MatchProfiles) == 0 && len(m.VarProfile) > 0 {
+		return errors.New("You cannot specify a variable to store the requested profile if you don't also specify what profiles are accepted.")
+	}
+	if (len(m.MatchAPIVersions) > 0 || len(m.VarAPIVersion) > 0) && len(m.MatchTypes) == 0 {
+		return errors.New("You cannot negotiate API versions if you don't also specify what types are offered.")
+	}
+	if len(m.TemporalHeaderName) == 0 && len(m.TemporalFormat+m.BeforeDate+m.AfterDate+m.VarTemporalDate) > 0 {
+		return errors.New("You cannot check dates if you don't also specify the header they are given in with temporal_header_name.")
+	}
+	for directive, date := range map[string]string{"before_date": m.BeforeDate, "after_date": m.AfterDate} {
+		if _, err := time.Parse(m.temporalFormat(), date); len(date) > 0 && err != nil {
+			return fmt.Errorf("%s '%s' does not match the temporal_format '%s'.", directive, date, m.temporalFormat())
+		}
+	}
+	if err := m.validateVarNames(); err != nil {
+		return err
+	}
+	for directive, key := range m.forceQueryKeys() {
+		if strings.HasPrefix(strings.ToLower(key), "caddy_") {
+			return fmt.Errorf("The query parameter '%s' of %s is reserved for Caddy.", key, directive)
+		}
+	}
+	if len(m.WildcardDefault) > 0 && slices.IndexFunc(m.MatchTypes, func(t string) bool {
+		offer, _, err := splitOfferQuality(t)
+		return err == nil && offer == m.WildcardDefault
+	}) < 0 {
+		return fmt.Errorf("wildcard_default '%s' must be one of the types in match_types.", m.WildcardDefault)
+	}
+	if m.RememberNegotiationCookie && len(m.ForceCookieType) == 0 {
+		return errors.New("remember_negotiation_cookie needs force_cookie_type to name the cookie.")
+	}
+	if m.RememberMaxAge < 0 {
+		return errors.New("remember_max_age must not be negative.")
+	}
+	if m.BaseTTL < 0 {
+		return errors.New("base_ttl must not be negative.")
+	}
+	if m.BaseTTL > 0 && len(m.TTLVar) == 0 {
+		return errors.New("base_ttl needs ttl_var to be set.")
+	}
+	if len(m.MIMEParamWhitelist) > 0 && len(m.VarType) == 0 {
+		return errors.New("mime_param_whitelist needs var_type to be set.")
+	}
+	if len(m.VarNegotiatedAllDelimiter) > 0 && len(m.VarNegotiatedAll) == 0 {
+		return errors.New("var_negotiated_all_delimiter needs var_negotiated_all to be set.")
+	}
+	if m.ContentNegotiationLogMaxMB < 0 {
+		return errors.New("content_negotiation_log_max_mb must not be negative.")
+	}
+	if m.ContentNegotiationLogMaxMB > 0 && len(m.ContentNegotiationLog) == 0 {
+		return errors.New("content_negotiation_log_max_mb needs content_negotiation_log to be set.")
+	}
+	for _, mechanism := range m.ForcePriority {
+		switch mechanism.Source {
+		case "query", "header", "cookie", "form":
+			if len(mechanism.Key) == 0 {
+				return fmt.Errorf("Forcing the type by %s needs a key.", mechanism.Source)
+			}
+		case "path_segment", "subdomain":
+			if _, err := strconv.Atoi(mechanism.Key); len(mechanism.Key) > 0 && err != nil {
+				return fmt.Errorf("Forcing the type by %s needs a number as key, not '%s'.", mechanism.Source, mechanism.Key)
+			}
+		case "extension":
+		default:
+			return fmt.Errorf("Unknown source '%s' for forcing the type, use one of query, header, cookie, form, extension, path_segment, subdomain.", mechanism.Source)
+		}
+	}
+	if m.MatchInboundContentType && len(m.MatchTypes) == 0 {
+		return errors.New("match_inbound_content_type needs match_types to check the Content-Type against.")
+	}
+	if len(m.MatchContentTypes) == 0 && !m.MatchInboundContentType && len(m.VarContentType) > 0 {
+		return errors.New("You cannot specify a variable to store the request body type if you don't also specify what body types are accepted. (Use '*/*' to work around this constraint.)")
+	}
+	return nil
+}
+
+// validVarName matches the variable names that can be used in placeholders
+// like `{vars.conneg_<name>}` without further escaping.
+var validVarName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// varNames returns the names of all variables the matcher has been
+// configured to set (without the `conneg_` prefix), by subdirective, i.e.
+// the values of all non-empty string fields named `Var*` or `*Var` (but not
+// `*Delimiter`), in the order of the fields.
+func (m MatchConneg) varNames() (directives []string, names []string) {
+	v := reflect.ValueOf(m)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() || field.Type.Kind() != reflect.String ||
+			!(strings.HasPrefix(field.Name, "Var") || strings.HasSuffix(field.Name, "Var")) ||
+			strings.HasSuffix(field.Name, "Delimiter") {
+			continue
+		}
+		if name := v.Field(i).String(); len(name) > 0 {
+			directives = append(directives, strings.Split(field.Tag.Get("json"), ",")[0])
+			names = append(names, name)
+		}
+	}
+	return directives, names
+}
+
+// validateVarNames checks the names of all variables the matcher sets.
+func (m MatchConneg) validateVarNames() error {
+	directives, names := m.varNames()
+	for i, name := range names {
+		if !validVarName.MatchString(name) {
+			return fmt.Errorf("The variable name '%s' of %s may only contain letters, digits, '_' and '-'.", name, directives[i])
+		}
+	}
+	return nil
+}
+
+// Provides returns the names of the variables the matcher may set, as they
+// are stored in the request context, e.g. `conneg_type`. This includes the
+// variables named with the `var_*` subdirectives (and the like, such as
+// `etag_var`), `conneg_source` if it is set, and the variable of package
+// connegctx if the encoding is coordinated with compressing handlers.
+// Provides only depends on the configuration, so it can be called before
+// Provision.
+func (m MatchConneg) Provides() []string {
+	var vars, provides []string
+	_, names := m.varNames()
+	for _, name := range names {
+		vars = append(vars, "conneg_"+name)
+	}
+	if m.ZeroQRejectsAll || len(m.GracefulDegradation) > 0 {
+		vars = append(vars, sourceVar)
+	}
+	if m.RequireAtLeastOneHeader {
+		vars = append(vars, noHeadersVar)
+	}
+	if m.MultipleTypeVars && len(m.VarType) > 0 {
+		for i := 0; i < m.maxTypeVars(); i++ {
+			vars = append(vars, "conneg_"+m.VarType+"_"+strconv.Itoa(i))
+		}
+		vars = append(vars, "conneg_"+m.VarType+"_count")
+	}
+	if m.CoordinateWithEncode {
+		vars = append(vars, connegctx.EncodingVar)
+	}
+	for _, v := range vars {
+		if !slices.Contains(provides, v) {
+			provides = append(provides, v)
+		}
+	}
+	return provides
+}
+
+// forceQueryKeys returns the query parameters used to override content
+// negotiation, by the subdirective configuring them.
+func (m MatchConneg) forceQueryKeys() map[string]string {
+	keys := make(map[string]string)
+	for directive, key := range map[string]string{
+		"force_type_query_string":     m.ForceTypeQueryString,
+		"force_language_query_string": m.ForceLanguageQueryString,
+		"force_charset_query_string":  m.ForceCharsetQueryString,
+		"force_encoding_query_string": m.ForceEncodingQueryString,
+	} {
+		if len(key) > 0 {
+			keys[directive] = key
+		}
+	}
+	for _, mechanism := range m.ForcePriority {
+		if mechanism.Source == "query" || mechanism.Source == "form" {
+			keys["force_type "+mechanism.Source] = mechanism.Key
+		}
+	}
+	return keys
+}
+
+// Match returns true if the request matches all requirements, or, with
+// InvertMatch, if it does not. (The results of MatchWithResult are never
+// inverted.)
+func (m MatchConneg) Match(r *http.Request) bool {
+	return m.MatchWithResult(r).Match != m.InvertMatch
+}
+
+// negotiatesMethod tells whether requests with the given method are subject
+// to negotiation, see AllowedMethods, DisallowedMethods and AssertMethod.
+func (m MatchConneg) negotiatesMethod(method string) bool {
+	if len(m.AssertMethod) > 0 {
+		return method == m.AssertMethod
+	}
+	if len(m.AllowedMethods) > 0 {
+		return slices.Contains(m.AllowedMethods, method)
+	}
+	return !slices.Contains(m.DisallowedMethods, method)
+}
+
+// chainMatches tells whether the request matches all chained matchers, see
+// ChainedMatcher.
+func (m MatchConneg) chainMatches(r *http.Request) bool {
+	for _, matcher := range m.chainedMatchers {
+		if !matcher.Match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchWithResult does the content negotiation for Match, setting the
+// configured variables along the way, and returns all of its results.
+func (m MatchConneg) MatchWithResult(r *http.Request) ConnegResult {
+	if m.cleanedUp {
+		panic(errors.New("Conneg matcher used after Cleanup."))
+	}
+	if m.ChainBefore && !m.chainMatches(r) {
+		m.notifyHooks(r, &ConnegResult{}, "chained_matcher")
+		return ConnegResult{}
+	}
+	if !m.negotiatesMethod(r.Method) {
+		// exempt requests match without negotiation, and hooks hear of them as such
+		result := ConnegResult{Match: m.ChainBefore || m.chainMatches(r)}
+		m.notifyHooks(r, &result, "chained_matcher")
+		return result
+	}
+	if m.RequireAtLeastOneHeader && !hasAcceptHeaders(r) && !m.forceGiven(r) {
+		caddyhttp.SetVar(r.Context(), noHeadersVar, "1")
+		m.notifyHooks(r, &ConnegResult{}, "headers")
+		return ConnegResult{}
+	}
+	typeMatch, _type, profile, typeSource := false, "", "", ""
+	if len(m.matchTypes) == 0 && !m.PostAuthMode {
+		typeMatch = true
+		if len(m.DefaultTypeOnEmpty) > 0 && len(m.VarType) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarType, m.DefaultTypeOnEmpty)
+		}
+	} else {
+		offers, offerTypes := m.typeOffers(r)
+		if len(m.profileTTypes) > 0 {
+			offerTypes = append(offerTypes[:len(offerTypes):len(offerTypes)], m.profileTTypes...)
+		}
+		start := time.Now()
+		typeMatch, _type, typeSource = m.matchType(r, offers, offerTypes, m.forceTypes, "Accept")
+		observeDuration("type", start, typeMatch)
+		if typeMatch && len(m.profileTTypes) > 0 {
+			if _type, profile = m.splitProfile(_type); len(profile) > 0 && len(m.VarProfile) > 0 {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarProfile, profile)
+			}
+		}
+		if typeMatch && (len(m.MatchAPIVersions) > 0 || len(m.VarAPIVersion) > 0) {
+			version := contenttype.NewMediaType(_type).Parameters["version"]
+			if len(m.MatchAPIVersions) > 0 && !slices.Contains(m.MatchAPIVersions, version) {
+				typeMatch, _type = false, ""
+			} else if len(version) > 0 && len(m.VarAPIVersion) > 0 {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarAPIVersion, version)
+			}
+		}
+		if typeMatch && len(m.VarType) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarType, m.whitelistedParams(_type))
+		}
+		if typeMatch && m.MultipleTypeVars {
+			types := []string{_type}
+			if typeSource == "header" {
+				if acceptable := m.acceptableTypes(strings.Join(r.Header.Values("Accept"), ", "), offers, offerTypes); len(acceptable) > 0 {
+					types = acceptable
+				}
+			}
+			m.setTypeVars(r, types)
+		}
+		if typeMatch && m.ExtractCharsetFromType {
+			if charset, ok := contenttype.NewMediaType(_type).Parameters["charset"]; ok {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarCharset, charset)
+			}
+		}
+		if typeMatch && len(m.VarTypeBase+m.VarTypeType+m.VarTypeSubtype) > 0 {
+			mediaType := contenttype.NewMediaType(_type)
+			if len(m.VarTypeBase) > 0 {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarTypeBase, mediaType.Type+"/"+mediaType.Subtype)
+			}
+			if len(m.VarTypeType) > 0 {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarTypeType, mediaType.Type)
+			}
+			if len(m.VarTypeSubtype) > 0 {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarTypeSubtype, mediaType.Subtype)
+			}
+		}
+		if typeMatch && len(m.VarExtension) > 0 {
+			if ext, ok := extensionFor(_type); ok {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.VarExtension, ext)
+			}
+		}
+		if typeMatch && len(m.DynamicUpstreamVar) > 0 {
+			if upstream, ok := m.upstreamFor(_type); ok {
+				caddyhttp.SetVar(r.Context(), "conneg_"+m.DynamicUpstreamVar, upstream)
+			}
+		}
+		if !typeMatch && m.degraded(r, "type", "Accept") {
+			typeMatch = true
+		}
+	}
+
+	languageMatch, language, confidence := false, "", ""
+	if len(m.MatchLanguages) == 0 {
+		languageMatch = true
+		if len(m.DefaultLanguageOnEmpty) > 0 && len(m.VarLanguage) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarLanguage, m.DefaultLanguageOnEmpty)
+		}
+	} else {
+		var languageConfidence fmt.Stringer
+		start := time.Now()
+		languageMatch, language, languageConfidence = m.matchLanguage(r, m.MatchLanguages, m.ForceLanguageQueryString, "Accept-Language")
+		observeDuration("language", start, languageMatch)
+		if languageMatch && len(m.VarLanguage) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarLanguage, language)
+		}
+		if languageMatch {
+			confidence = languageConfidence.String()
+		}
+		if languageMatch && len(m.VarLanguageConfidence) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarLanguageConfidence, confidence)
+		}
+		if !languageMatch && m.degraded(r, "language", "Accept-Language") {
+			languageMatch = true
+		}
+	}
+
+	charsetMatch, charset := false, ""
+	if len(m.MatchCharsets) == 0 {
+		charsetMatch = true
+		if len(m.DefaultCharsetOnEmpty) > 0 && len(m.VarCharset) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarCharset, m.DefaultCharsetOnEmpty)
+		}
+	} else {
+		start := time.Now()
+		charsetMatch, charset = m.matchCharsetOrEncoding(r, m.MatchCharsets, m.MatchTCharsets, m.ForceCharsetQueryString, "Accept-Charset")
+		observeDuration("charset", start, charsetMatch)
+		if charsetMatch && len(m.VarCharset) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarCharset, charset)
+		}
+		if !charsetMatch && m.degraded(r, "charset", "Accept-Charset") {
+			charsetMatch = true
+		}
+	}
+
+	encodingMatch, encoding := false, ""
+	if len(m.MatchEncodings) == 0 {
+		encodingMatch = true
+		if len(m.DefaultEncodingOnEmpty) > 0 && len(m.VarEncoding) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarEncoding, m.DefaultEncodingOnEmpty)
+		}
+	} else {
+		if m.CompressionAware && typeMatch && m.alreadyCompressed(_type) {
+			// compressing again would only cost time
+			encodingMatch, encoding = true, "identity"
+		} else {
+			start := time.Now()
+			encodingMatch, encoding = m.matchCharsetOrEncoding(r, m.MatchEncodings, m.MatchTEncodings, m.ForceEncodingQueryString, "Accept-Encoding")
+			observeDuration("encoding", start, encodingMatch)
+		}
+		if !encodingMatch && m.EncodingFallbackToIdentity {
+			// serving unencoded content is always possible
+			encodingMatch, encoding = true, "identity"
+		}
+		if encodingMatch && len(m.VarEncoding) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarEncoding, encoding)
+		}
+		if encodingMatch && m.CoordinateWithEncode {
+			connegctx.SetEncoding(r.Context(), encoding)
+		}
+		if !encodingMatch && m.degraded(r, "encoding", "Accept-Encoding") {
+			encodingMatch = true
+		}
+	}
+
+	contentTypeMatch, contentType := false, ""
+	if len(m.MatchContentTypes) == 0 && (!m.MatchInboundContentType || !hasBody(r)) {
+		contentTypeMatch = true
+	} else {
+		contentTypeMatch, contentType = m.matchContentType(r)
+		if contentTypeMatch && len(m.VarContentType) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarContentType, contentType)
+		}
+	}
+
+	if len(m.VarMatchCount) > 0 {
+		count := 0
+		for _, dimension := range []struct {
+			offered, matched bool
+		}{
+			{len(m.matchTypes) > 0 || m.PostAuthMode, typeMatch},
+			{len(m.MatchLanguages) > 0, languageMatch},
+			{len(m.MatchCharsets) > 0, charsetMatch},
+			{len(m.MatchEncodings) > 0, encodingMatch},
+		} {
+			if dimension.offered && dimension.matched {
+				count++
+			}
+		}
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.VarMatchCount, strconv.Itoa(count))
+	}
+	if len(m.VarNegotiatedAll) > 0 {
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.VarNegotiatedAll, m.negotiatedAll(
+			[]bool{typeMatch, languageMatch, charsetMatch, encodingMatch},
+			[]string{_type, language, charset, encoding}))
+	}
+	if len(m.VarForceUsed) > 0 {
+		forceUsed := "0"
+		if m.forceUsed(r, typeSource) {
+			forceUsed = "1"
+		}
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.VarForceUsed, forceUsed)
+	}
+	temporalMatch := true
+	if len(m.TemporalHeaderName) > 0 {
+		var date string
+		temporalMatch, date = m.matchTemporal(r)
+		if len(date) > 0 && len(m.VarTemporalDate) > 0 {
+			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarTemporalDate, date)
+		}
+	}
+
+	match := typeMatch && languageMatch && charsetMatch && encodingMatch && contentTypeMatch && temporalMatch &&
+		(m.ChainBefore || m.chainMatches(r))
+	if match && len(m.ScoreVar) > 0 {
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.ScoreVar, m.negotiationScore(r, _type, typeSource, language, charset, encoding))
+	}
+	if match && len(m.TTLVar) > 0 {
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.TTLVar, m.negotiationTTL(r, _type, typeSource, language, charset, encoding))
+	}
+	if match && len(m.ETagVar) > 0 {
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.ETagVar, m.etagComponent(_type, language, charset, encoding))
+	}
+	if len(m.TelemetryKey) > 0 {
+		if span, ok := r.Context().Value(caddy.CtxKey(m.TelemetryKey)).(TelemetrySpan); ok {
+			span.SetTag("conneg.match", strconv.FormatBool(match))
+			for _, tag := range []struct{ key, value string }{
+				{"conneg.type", _type},
+				{"conneg.language", language},
+				{"conneg.charset", charset},
+				{"conneg.encoding", encoding},
+				{"conneg.content_type", contentType},
+			} {
+				if len(tag.value) > 0 {
+					span.SetTag(tag.key, tag.value)
+				}
+			}
+		}
+	}
+	remember := m.RememberNegotiationCookie && typeMatch && typeSource == "header" && len(_type) > 0
+	if match && (m.AdvertiseAcceptPatch || m.RespondToOptions || remember || m.NoteHeader || m.UseClientHints) {
+		a := m.advertisement()
+		if remember {
+			a.cookie = m.rememberCookie(_type)
+		}
+		if m.NoteHeader {
+			a.note = m.negotiationNote(r, _type, typeSource, language, charset, encoding)
+		}
+		caddyhttp.SetVar(r.Context(), advertisementVar, a)
+	}
+	result := ConnegResult{
+		Match:              match,
+		Type:               _type,
+		Profile:            profile,
+		Language:           language,
+		LanguageConfidence: confidence,
+		Charset:            charset,
+		Encoding:           encoding,
+		ContentType:        contentType,
+		OfferListVersion:   m.OfferListVersion,
+		SourceTag:          m.SourceTag,
+	}
+	if m.LogFields && m.logger != nil {
+		m.logger.Info("conneg negotiated", m.logFields(r, result)...)
+	}
+	if m.negotiationLog != nil {
+		m.logNegotiation(r, result, typeSource)
+	}
+	if m.history != nil {
+		m.history.add(r.RequestURI, result)
+	}
+	if len(m.hooks) > 0 {
+		// if all dimensions matched, the chained matchers didn't
+		missed := "chained_matcher"
+		for _, dimension := range []struct {
+			name    string
+			matched bool
+		}{
+			{"type", typeMatch},
+			{"language", languageMatch},
+			{"charset", charsetMatch},
+			{"encoding", encodingMatch},
+			{"content_type", contentTypeMatch},
+			{"temporal", temporalMatch},
+		} {
+			if !dimension.matched {
+				missed = dimension.name
+				break
+			}
+		}
+		m.notifyHooks(r, &result, missed)
+	}
+	return result
+}
+
+// logFields returns the results of a negotiation as log fields, named like
+// the variables that would hold them by default, along with fields that
+// identify the request.
+func (m MatchConneg) logFields(r *http.Request, result ConnegResult) []zap.Field {
+	fields := []zap.Field{
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.Bool("match", result.Match),
+	}
+	for _, field := range []struct{ key, value string }{
+		{"conneg_type", result.Type},
+		{"conneg_profile", result.Profile},
+		{"conneg_language", result.Language},
+		{"conneg_charset", result.Charset},
+		{"conneg_encoding", result.Encoding},
+		{"conneg_content_type", result.ContentType},
+	} {
+		if len(field.value) > 0 {
+			fields = append(fields, zap.String(field.key, field.value))
+		}
+	}
+	return fields
+}
+
+// extensionFor returns the canonical file extension (with leading dot) of a
+// content type, ignoring its parameters.
+func extensionFor(t string) (string, bool) {
+	mediaType := contenttype.NewMediaType(t)
+	base := strings.ToLower(mediaType.Type + "/" + mediaType.Subtype)
+	if ext, ok := mimeToExtension[base]; ok {
+		return ext, true
+	}
+	if exts, err := mime.ExtensionsByType(base); err == nil && len(exts) > 0 {
+		return exts[0], true
+	}
+	return "", false
+}
+
+// rememberCookie returns the cookie for remembering a negotiated type, using
+// the shortest name that force_cookie_type understands.
+func (m MatchConneg) rememberCookie(t string) *http.Cookie {
+	value := t
+	if values := m.offerAliases(t); len(values) > 0 {
+		value = values[0]
+	}
+	maxAge := m.RememberMaxAge
+	if maxAge == 0 {
+		maxAge = 3600
+	}
+	return &http.Cookie{
+		Name:     m.ForceCookieType,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// advertisement returns the capabilities of the matcher to be advertised by
+// the `conneg` handler.
+func (m MatchConneg) advertisement() advertisement {
+	a := advertisement{respondToOptions: m.RespondToOptions}
+	if m.AdvertiseAcceptPatch {
+		a.acceptPatch = strings.Join(m.matchTypes, ", ")
+	}
+	for _, dim := range []struct {
+		offers []string
+		header string
+	}{
+		{m.matchTypes, "Accept"},
+		{m.MatchLanguages, "Accept-Language"},
+		{m.MatchCharsets, "Accept-Charset"},
+		{m.MatchEncodings, "Accept-Encoding"},
+	} {
+		if len(dim.offers) > 0 {
+			a.vary = append(a.vary, dim.header)
+		}
+	}
+	if m.UseClientHints {
+		a.acceptCH = clientHintHeaders
+		a.vary = append(a.vary, clientHintHeaders...)
+	}
+	return a
+}
+
+// splitProfile separates the profile from a negotiated type if it is one of
+// the profile variants of the offered types. (Profile URIs are no tokens, so
+// the type cannot simply be parsed again, and as the order of parameters in
+// MediaType.String() is random, the strings are compared part by part.)
+func (m MatchConneg) splitProfile(t string) (string, string) {
+	parts := strings.Split(t, ";")
+	slices.Sort(parts)
+	for _, variant := range m.profileTTypes {
+		variantParts := strings.Split(variant.String(), ";")
+		slices.Sort(variantParts)
+		if !slices.Equal(parts, variantParts) {
+			continue
+		}
+		offer := contenttype.MediaType{Type: variant.Type, Subtype: variant.Subtype, Parameters: contenttype.Parameters{}}
+		for k, v := range variant.Parameters {
+			if k != "profile" {
+				offer.Parameters[k] = v
+			}
+		}
+		return offer.String(), variant.Parameters["profile"]
+	}
+	return t, ""
+}
+
+// upstreamFor looks up the upstream for a negotiated type, with or without its parameters.
+func (m MatchConneg) upstreamFor(t string) (string, bool) {
+	if upstream, ok := m.UpstreamMap[t]; ok {
+		return upstream, true
+	}
+	upstream, ok := m.UpstreamMap[contenttype.NewMediaType(t).MIME()]
+	return upstream, ok
+}
+
+// alreadyCompressed tells whether the type t (ignoring its parameters) is
+// one of the types that CompressionAware leaves uncompressed.
+func (m MatchConneg) alreadyCompressed(t string) bool {
+	compressed := m.AlreadyCompressedTypes
+	if len(compressed) == 0 {
+		compressed = defaultCompressedTypes
+	}
+	base := strings.ToLower(contenttype.NewMediaType(t).MIME())
+	if len(base) == 0 {
+		return false
+	}
+	for _, c := range compressed {
+		if strings.ToLower(contenttype.NewMediaType(c).MIME()) == base {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAcceptHeaders tells whether the request has any of the headers for
+// content negotiation, see RequireAtLeastOneHeader.
+func hasAcceptHeaders(r *http.Request) bool {
+	for _, header := range []string{"Accept", "Accept-Language", "Accept-Charset", "Accept-Encoding"} {
+		if len(r.Header.Values(header)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forceGiven tells whether the client gave a value with any of the force
+// mechanisms, whether or not it names an offer.
+func (m MatchConneg) forceGiven(r *http.Request) bool {
+	mechanisms := m.forceTypes
+	for _, key := range []string{m.ForceLanguageQueryString, m.ForceCharsetQueryString, m.ForceEncodingQueryString} {
+		if len(key) > 0 {
+			mechanisms = append(mechanisms[:len(mechanisms):len(mechanisms)], ForceMechanism{Source: "query", Key: key})
+		}
+	}
+	for _, mechanism := range mechanisms {
+		if len(m.forcedValues(r, mechanism)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forceUsed tells whether the client forced any of the negotiated values.
+func (m MatchConneg) forceUsed(r *http.Request, typeSource string) bool {
+	switch typeSource {
+	case "", "default":
+	case "header":
+		// a forcing header that names no offer would not have matched
+		for _, mechanism := range m.forceTypes {
+			if mechanism.Source == "header" && len(r.Header.Get(mechanism.Key)) > 0 {
+				return true
+			}
+		}
+	default:
+		return true
+	}
+	for _, dimension := range []struct {
+		offers      []string
+		forceString string
+	}{
+		{m.MatchLanguages, m.ForceLanguageQueryString},
+		{m.MatchCharsets, m.ForceCharsetQueryString},
+		{m.MatchEncodings, m.ForceEncodingQueryString},
+	} {
+		if len(dimension.offers) > 0 && noteSource(r, dimension.forceString) == "query" {
+			return true
+		}
+	}
+	return false
+}
 
-	// the following fields are populated internally/computationally
-	MatchTTypes     []contenttype.MediaType	`json:"omitempty"`
-	MatchTLanguages []language.Tag		`json:"omitempty"`
-	MatchTCharsets  []CharsetOrEncoding	`json:"omitempty"`
-	MatchTEncodings []CharsetOrEncoding	`json:"omitempty"`
-	LanguageMatcher language.Matcher	`json:"omitempty"`
-	logger          *zap.Logger
+// negotiatedAll joins the negotiated values for var_negotiated_all, with `*`
+// for dimensions that did not match or were not negotiated.
+func (m MatchConneg) negotiatedAll(matched []bool, values []string) string {
+	delimiter := m.VarNegotiatedAllDelimiter
+	if len(delimiter) == 0 {
+		delimiter = ":"
+	}
+	parts := make([]string, len(values))
+	for i, value := range values {
+		if !matched[i] || len(value) == 0 {
+			value = "*"
+		}
+		parts[i] = value
+	}
+	return strings.Join(parts, delimiter)
 }
 
-// If a type/language/etc is forced via parameter, these are values that the parameter can take
-var aliases = map[string]interface{}{
-	"text/html":           []string{"html", "htm"},
-	"application/rdf+xml": []string{"rdf"},
-	"application/tei+xml": []string{"tei", "xml"},
-	"application/pdf":     []string{"pdf"},
-	"text/plain":	       []string{"txt", "text"},
+// etagComponent hashes the negotiated values, so that each representation
+// of a resource can get its own ETag.
+func (m MatchConneg) etagComponent(values ...string) string {
+	h := fnv.New32a()
+	h.Write([]byte(m.ETagSalt))
+	for _, v := range values {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+	if len(m.OfferListVersion) > 0 {
+		// ETags of matchers without a version stay as they are
+		h.Write([]byte{1})
+		h.Write([]byte(m.OfferListVersion))
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
 }
 
-func init() {
-	caddy.RegisterModule(MatchConneg{})
+// typeOffers returns the types offered to the request. In post-auth mode,
+// these are extended by the offers for the authenticated user's claim.
+func (m MatchConneg) typeOffers(r *http.Request) ([]string, []contenttype.MediaType) {
+	if m.PostAuthMode {
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			if claim, ok := repl.GetString(m.AuthContextKey); ok {
+				if offers, ok := m.authOffers[claim]; ok {
+					return offers, m.authTTypes[claim]
+				}
+			}
+		}
+	}
+	return m.matchTypes, m.MatchTTypes
 }
 
-// CaddyModule returns the Caddy module information.
-func (MatchConneg) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.matchers.conneg",
-		New: func() caddy.Module { return new(MatchConneg) },
+// matchContentType checks the type of the request body, as given in the
+// Content-Type header, against the accepted types. Wildcards like `*/*` or
+// `text/*` may be used in the accepted types, and parameters of accepted types
+// must be present in the header. The result is the request's type without
+// parameters.
+func (m MatchConneg) matchContentType(r *http.Request) (bool, string) {
+	mediatype, err := contenttype.GetMediaType(r)
+	if err != nil || mediatype.Type == "" {
+		return false, ""
+	}
+	for _, offer := range m.matchTContentTypes {
+		if (offer.Type == "*" || offer.Type == mediatype.Type) &&
+			(offer.Subtype == "*" || offer.Subtype == mediatype.Subtype) &&
+			containsParameters(mediatype.Parameters, offer.Parameters) {
+			return true, mediatype.MIME()
+		}
 	}
+	return false, ""
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
-func (m *MatchConneg) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
-		for nesting := d.Nesting(); d.NextBlock(nesting); {
-			switch d.Val() {
-			case "match_types":
-				m.MatchTypes = append(m.MatchTypes, d.RemainingArgs()...)
-			case "match_languages":
-				m.MatchLanguages = append(m.MatchLanguages, d.RemainingArgs()...)
-			case "match_charsets":
-				m.MatchCharsets = append(m.MatchCharsets, d.RemainingArgs()...)
-			case "match_encodings":
-				m.MatchEncodings = append(m.MatchEncodings, d.RemainingArgs()...)
-			case "force_type_query_string":
-				d.Next()
-				m.ForceTypeQueryString = d.Val()
-			case "force_language_query_string":
-				d.Next()
-				m.ForceLanguageQueryString = d.Val()
-			case "force_charset_query_string":
-				d.Next()
-				m.ForceCharsetQueryString = d.Val()
-			case "force_encoding_query_string":
-				d.Next()
-				m.ForceEncodingQueryString = d.Val()
-			case "var_type":
-				d.Next()
-				m.VarType = d.Val()
-			case "var_language":
-				d.Next()
-				m.VarLanguage = d.Val()
-			case "var_charset":
-				d.Next()
-				m.VarCharset = d.Val()
-			case "var_encoding":
-				d.Next()
-				m.VarEncoding = d.Val()
+// temporalFormat returns the layout of the dates in TemporalHeaderName,
+// BeforeDate and AfterDate.
+func (m MatchConneg) temporalFormat() string {
+	if len(m.TemporalFormat) == 0 {
+		return "2006-01-02"
+	}
+	return m.TemporalFormat
+}
+
+// matchTemporal checks the date given in the TemporalHeaderName header
+// against BeforeDate and AfterDate, and returns it in the TemporalFormat
+// layout. Requests without the header match, while malformed dates don't.
+func (m MatchConneg) matchTemporal(r *http.Request) (bool, string) {
+	value := strings.TrimSpace(r.Header.Get(m.TemporalHeaderName))
+	if len(value) == 0 {
+		return true, ""
+	}
+	layout := m.temporalFormat()
+	date, err := time.Parse(layout, value)
+	if err != nil {
+		return false, ""
+	}
+	// the bounds have been checked in Validate
+	if before, err := time.Parse(layout, m.BeforeDate); err == nil && !date.Before(before) {
+		return false, ""
+	}
+	if after, err := time.Parse(layout, m.AfterDate); err == nil && !date.After(after) {
+		return false, ""
+	}
+	return true, date.Format(layout)
+}
+
+// hasBody reports whether the request comes with a body (or says it does).
+func hasBody(r *http.Request) bool {
+	return r.ContentLength != 0 || len(r.Header.Get("Content-Type")) > 0
+}
+
+// degraded tells whether a dimension that did not match is to be skipped
+// instead, because it is listed in GracefulDegradation and the client's
+// header for it is malformed. Skipped dimensions are reported in the
+// variable `conneg_source` as `degraded`.
+func (m MatchConneg) degraded(r *http.Request, dimension, headerName string) bool {
+	if !slices.Contains(m.GracefulDegradation, dimension) {
+		return false
+	}
+	header := strings.Join(r.Header.Values(headerName), ", ")
+	if len(header) == 0 {
+		return false
+	}
+	malformed := false
+	switch dimension {
+	case "type":
+		_, ok := parseMediaRanges(header)
+		malformed = !ok
+	case "language":
+		_, _, err := language.ParseAcceptLanguage(header)
+		malformed = err != nil
+	default:
+		_, _, _, err := negotiateCharsetOrEncoding(header, nil, false)
+		var syntaxErr acceptSyntaxError
+		malformed = errors.As(err, &syntaxErr)
+	}
+	if !malformed {
+		return false
+	}
+	m.logger.Warn("skipping negotiation for malformed header",
+		zap.String("dimension", dimension),
+		zap.String("header", header),
+	)
+	caddyhttp.SetVar(r.Context(), sourceVar, "degraded")
+	return true
+}
+
+// containsParameters reports whether all of the wanted parameters are present in params.
+// Parameter names are case-insensitive, and so are their values here.
+func containsParameters(params, wanted Parameters) bool {
+	for key, value := range wanted {
+		if v, found := params[key]; !found || !strings.EqualFold(v, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m MatchConneg) matchType(r *http.Request, offers []string, offerTypes []contenttype.MediaType, forces []ForceMechanism, headerName string) (bool, string, string) {
+	match, result := false, ""
+	source, rejected := "", false
+	for _, mechanism := range forces {
+		values := m.forcedValues(r, mechanism)
+		if len(values) == 0 {
+			continue
+		}
+		for _, value := range values {
+			for _, t := range offers {
+				if m.namesOffer(t, value, mechanism.Source == "query") {
+					match, result = true, t
+				}
+			}
+			if match {
+				m.countAliasResolution(value, result)
+				break
+			}
+		}
+		if match {
+			if m.ForceTypeAcceptReplace {
+				r.Header.Set("Accept", result)
 			}
+			if m.RemoveForceParam && mechanism.Source == "query" {
+				removeQueryParam(r, mechanism.Key)
+			}
+			source = mechanism.Source
+			break
+		}
+		// parts of the URL often carry other meanings, but an explicitly
+		// named parameter, header or cookie asks for something not on offer
+		switch mechanism.Source {
+		case "query", "header", "cookie", "form":
+			rejected = true
 		}
 	}
-	return nil
+	if !match && rejected {
+		return false, "", ""
+	}
+	if !match {
+		var headerValues []string
+		headerValues = append(headerValues, r.Header.Values(headerName)...)
+		if m.UseClientHints && len(headerValues) > 0 {
+			// supported types come first, as if the client had asked for them
+			headerValues = append(clientHintTypes(r, strings.Join(headerValues, ", "), offerTypes), headerValues...)
+		}
+		if m.PrioritizeOffer {
+			if mediatype, ok := prioritizedMediaType(strings.Join(headerValues, ", "), offerTypes); ok {
+				match, result, source = true, mediatype.String(), "header"
+			}
+		} else if m.weightedTypes {
+			if mediatype, ok := m.weightedMediaType(strings.Join(headerValues, ", "), offers, offerTypes); ok {
+				match, result, source = true, mediatype.String(), "header"
+			}
+		} else if len(headerValues) > 0 {
+			// RFC 7230, 3.2.2: multiple header fields are equivalent to one
+			// with their values joined by commas, so negotiate them at once
+			var mediatype, _, _ = contenttype.GetAcceptableMediaTypeFromHeader(strings.Join(headerValues, ", "), offerTypes)
+			if mediatype.Type != "" {
+				match, result, source = true, mediatype.String(), "header"
+			}
+		}
+		if match && len(m.WildcardDefault) > 0 && matchedByWildcard(strings.Join(headerValues, ", "), contenttype.NewMediaType(result)) {
+			result = m.WildcardDefault
+		}
+		if !match && m.ZeroQRejectsAll && rejectsAllMediaTypes(strings.Join(headerValues, ", "), offerTypes) {
+			caddyhttp.SetVar(r.Context(), sourceVar, "explicit_rejection")
+			return false, "", ""
+		}
+		if !match && m.MultipartFallback && slices.Contains(offers, "multipart/mixed") {
+			match, result, source = true, "multipart/mixed", "default"
+		}
+	}
+	return match, result, source
 }
 
-// Provision sets up the module.
-func (m *MatchConneg) Provision(ctx caddy.Context) error {
-	// m.logger = ctx.Logger(m) // m.logger is a *zap.Logger
-	// sugar := m.logger.Sugar()
-	// defer m.logger.Sync() // flushes buffer, if any
+// weightedMediaType chooses the offered type with the highest product of the
+// quality given to it in the Accept header and its server-side quality. As in
+// GetAcceptableMediaTypeFromHeader, ties go to the type whose range comes
+// first in the header, then to the type offered first.
+func (m MatchConneg) weightedMediaType(header string, offers []string, offerTypes []contenttype.MediaType) (contenttype.MediaType, bool) {
+	ranges, ok := parseMediaRanges(header)
+	if !ok {
+		return contenttype.MediaType{}, false
+	}
+	best, bestScore, bestOrder := -1, 0.0, 0
+	for i, offer := range offerTypes {
+		rng := bestMediaRange(ranges, offer)
+		if rng == nil || rng.weight == 0 {
+			continue
+		}
+		quality := 1.0
+		if i < len(offers) {
+			if q, ok := m.serverQualities[offers[i]]; ok {
+				quality = q
+			}
+		}
+		score := float64(rng.weight) * quality
+		if score > bestScore || (score == bestScore && score > 0 && rng.order < bestOrder) {
+			best, bestScore, bestOrder = i, score, rng.order
+		}
+	}
+	if best < 0 {
+		return contenttype.MediaType{}, false
+	}
+	return offerTypes[best], true
+}
 
-	for _, t := range m.MatchTypes {
-		m.MatchTTypes = append(m.MatchTTypes, contenttype.NewMediaType(t))
+// acceptableTypes returns the offered types that the Accept header accepts,
+// by descending product of the quality given to them in the header and
+// their server-side quality, with ties broken as in weightedMediaType.
+func (m MatchConneg) acceptableTypes(header string, offers []string, offerTypes []contenttype.MediaType) []string {
+	ranges, ok := parseMediaRanges(header)
+	if !ok {
+		return nil
 	}
+	type acceptable struct {
+		offer string
+		score float64
+		order int
+	}
+	var types []acceptable
+	for i, offer := range offerTypes {
+		rng := bestMediaRange(ranges, offer)
+		if rng == nil || rng.weight == 0 {
+			continue
+		}
+		quality := 1.0
+		if i < len(offers) {
+			if q, ok := m.serverQualities[offers[i]]; ok {
+				quality = q
+			}
+		}
+		types = append(types, acceptable{offer.String(), float64(rng.weight) * quality, rng.order})
+	}
+	sort.SliceStable(types, func(i, j int) bool {
+		return types[i].score > types[j].score || (types[i].score == types[j].score && types[i].order < types[j].order)
+	})
+	result := make([]string, len(types))
+	for i, t := range types {
+		result[i] = t.offer
+	}
+	return result
+}
 
-	m.MatchTLanguages = append(m.MatchTLanguages, language.Make("und"))
-	for _, l := range m.MatchLanguages {
-		m.MatchTLanguages = append(m.MatchTLanguages, language.Make(l))
+// maxTypeVars returns the number of types stored with MultipleTypeVars.
+func (m MatchConneg) maxTypeVars() int {
+	if m.MaxTypeVars == 0 {
+		return 10
 	}
-	m.LanguageMatcher = language.NewMatcher(m.MatchTLanguages)
+	return m.MaxTypeVars
+}
 
-	for _, c := range m.MatchCharsets {
-		m.MatchTCharsets = append(m.MatchTCharsets, CharsetOrEncoding{Value: c})
+// setTypeVars stores the types for MultipleTypeVars in the indexed
+// variables, up to MaxTypeVars of them, and their number.
+func (m MatchConneg) setTypeVars(r *http.Request, types []string) {
+	if len(types) > m.maxTypeVars() {
+		types = types[:m.maxTypeVars()]
 	}
+	for i, t := range types {
+		caddyhttp.SetVar(r.Context(), "conneg_"+m.VarType+"_"+strconv.Itoa(i), m.whitelistedParams(t))
+	}
+	caddyhttp.SetVar(r.Context(), "conneg_"+m.VarType+"_count", strconv.Itoa(len(types)))
+}
 
-	for _, e := range m.MatchEncodings {
-		m.MatchTEncodings = append(m.MatchTEncodings, CharsetOrEncoding{Value: e})
+// prioritizedMediaType chooses the first offered type that the Accept header
+// accepts at all, whatever the quality, see PrioritizeOffer.
+func prioritizedMediaType(header string, offerTypes []contenttype.MediaType) (contenttype.MediaType, bool) {
+	ranges, ok := parseMediaRanges(header)
+	if !ok {
+		return contenttype.MediaType{}, false
+	}
+	for _, offer := range offerTypes {
+		if rng := bestMediaRange(ranges, offer); rng != nil && rng.weight > 0 {
+			return offer, true
+		}
 	}
+	return contenttype.MediaType{}, false
+}
 
-	// sugar.Infof("Conneg config: %+v", m)
-	return nil
+// forcedValues returns the values given by the client with a force mechanism,
+// if any, to be tried in turn (see forcedCandidates).
+func (m MatchConneg) forcedValues(r *http.Request, mechanism ForceMechanism) []string {
+	var value string
+	switch mechanism.Source {
+	case "query", "form":
+		if err := r.ParseForm(); err != nil {
+			sugar := m.logger.Sugar()
+			sugar.Infof("Problem parsing URL: %+v", err)
+			return nil
+		}
+		form := r.Form
+		if mechanism.Source == "form" {
+			form = r.PostForm
+		}
+		return m.forcedCandidates(form[mechanism.Key])
+	case "header":
+		value = r.Header.Get(mechanism.Key)
+	case "cookie":
+		if cookie, err := r.Cookie(mechanism.Key); err == nil {
+			value = cookie.Value
+		}
+	case "extension":
+		value = strings.TrimPrefix(path.Ext(r.URL.Path), ".")
+	case "path_segment":
+		value = nthPart(strings.Split(strings.Trim(r.URL.Path, "/"), "/"), mechanism.Key, -1)
+	case "subdomain":
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		labels := strings.Split(host, ".")
+		if len(labels) > 2 {
+			// the registered domain is no subdomain
+			value = nthPart(labels[:len(labels)-2], mechanism.Key, 0)
+		}
+	}
+	if len(value) == 0 {
+		return nil
+	}
+	return []string{value}
 }
 
-// Validate validates that the module has a usable config.
-func (m MatchConneg) Validate() error {
-	if len(m.MatchTypes)+len(m.MatchLanguages)+len(m.MatchCharsets)+len(m.MatchEncodings) == 0 {
-		return errors.New("One of match_types, match_languages, match_charsets, match_encodings MUST be set.")
+// forcedCandidates returns the values of a parameter given more than once,
+// as in `?format=json&format=rdf`, that are tried in turn as the forced value,
+// as configured in ForceQueryParamMultiValue.
+func (m MatchConneg) forcedCandidates(values []string) []string {
+	switch {
+	case len(values) == 0:
+		return nil
+	case m.ForceQueryParamMultiValue == "last":
+		return values[len(values)-1:]
+	case m.ForceQueryParamMultiValue == "highest_quality":
+		// the client's preferences, in order
+		return values
+	default:
+		return values[:1]
 	}
-	if len(m.MatchTypes) == 0 && len(m.VarType) > 0 {
-		return errors.New("You cannot specify a variable to store content negotiation results (for content types) if you don't also specify what types are offered. (Use '*/*' to work around this constraint.)")
+}
+
+// namesOffer tells whether a value forced by the client is the offer t or
+// one of its aliases. Values from query parameters are compared
+// case-insensitively if NormalizeQueryParam is set.
+func (m MatchConneg) namesOffer(t, value string, fromQuery bool) bool {
+	if !m.NormalizeQueryParam || !fromQuery {
+		return t == value || slices.Contains(m.offerAliases(t), value)
 	}
-	if len(m.MatchLanguages) == 0 && len(m.VarLanguage) > 0 {
-		return errors.New("You cannot specify a variable to store content negotiation results (for languages) if you don't also specify what languages are offered. (Use '*' to work around this constraint.)")
+	value = strings.ToLower(value)
+	if strings.ToLower(t) == value {
+		return true
 	}
-	if len(m.MatchCharsets) == 0 && len(m.VarCharset) > 0 {
-		return errors.New("You cannot specify a variable to store content negotiation results (for charsets) if you don't also specify what charsets are offered. (Use '*' to work around this constraint.)")
+	for _, alias := range m.offerAliases(t) {
+		if strings.ToLower(alias) == value {
+			return true
+		}
 	}
-	if len(m.MatchEncodings) == 0 && len(m.VarEncoding) > 0 {
-		return errors.New("You cannot specify a variable to store content negotiation results (for encodings) if you don't also specify what encodings are offered. (Use '*' to work around this constraint.)")
+	return false
+}
+
+// removeQueryParam removes all values of the query parameter key from the
+// request URL, keeping the other parameters as they are. The parsed r.Form
+// is left alone, so that other matchers can still see the parameter.
+func removeQueryParam(r *http.Request, key string) {
+	var kept []string
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		name := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			name = pair[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); len(pair) == 0 || (err == nil && unescaped == key) {
+			continue
+		}
+		kept = append(kept, pair)
 	}
-	return nil
+	r.URL.RawQuery = strings.Join(kept, "&")
+	r.RequestURI = r.URL.RequestURI()
 }
 
-// Match returns true if the request matches all requirements.
-func (m MatchConneg) Match(r *http.Request) bool {
+// nthPart returns the part at the index given as string (or the default
+// index if it is empty), negative indices counting from the end.
+func nthPart(parts []string, index string, defaultIndex int) string {
+	i := defaultIndex
+	if len(index) > 0 {
+		var err error
+		if i, err = strconv.Atoi(index); err != nil {
+			return ""
+		}
+	}
+	if i < 0 {
+		i += len(parts)
+	}
+	if i < 0 || i >= len(parts) {
+		return ""
+	}
+	return parts[i]
+}
 
-	typeMatch, _type := false, ""
-	if len(m.MatchTypes) == 0 {
-		typeMatch = true
-	} else {
-		typeMatch, _type = m.matchType(r, m.MatchTypes, m.MatchTTypes, m.ForceTypeQueryString, "Accept")
-		if typeMatch && len(m.VarType) > 0 {
-			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarType, _type)
+// mediaRange is a range of an Accept header with its quality value.
+type mediaRange struct {
+	mediaType contenttype.MediaType
+	weight    int
+	// whether the quality has been given explicitly
+	weighted bool
+	// position in the header
+	order int
+}
+
+// parseMediaRanges splits an Accept header into its media ranges.
+func parseMediaRanges(header string) ([]mediaRange, bool) {
+	var ranges []mediaRange
+	for _, value := range splitMediaRanges(header) {
+		mediaType, err := contenttype.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			return nil, false
 		}
+		q, ok := mediaType.Parameters["q"]
+		delete(mediaType.Parameters, "q")
+		weight, valid := getWeight(q)
+		if !ok || !valid {
+			weight = 1000
+		}
+		ranges = append(ranges, mediaRange{mediaType, weight, ok && valid, len(ranges)})
 	}
+	return ranges, true
+}
 
-	languageMatch, language := false, ""
-	if len(m.MatchLanguages) == 0 {
-		languageMatch = true
-	} else {
-		languageMatch, language = m.matchLanguage(r, m.MatchLanguages, m.ForceLanguageQueryString, "Accept-Language")
-		if languageMatch && len(m.VarLanguage) > 0 {
-			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarLanguage, language)
+// splitMediaRanges splits an Accept header at the commas between its media
+// ranges, leaving commas in quoted parameter values like
+// `profile="a,b"` alone.
+func splitMediaRanges(header string) []string {
+	var values []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(header); i++ {
+		switch c := header[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			values = append(values, header[start:i])
+			start = i + 1
 		}
 	}
+	return append(values, header[start:])
+}
 
-	charsetMatch, charset := false, ""
-	if len(m.MatchCharsets) == 0 {
-		charsetMatch = true
-	} else {
-		charsetMatch, charset = m.matchCharsetOrEncoding(r, m.MatchCharsets, m.MatchTCharsets, m.ForceCharsetQueryString, "Accept-Charset")
-		if charsetMatch && len(m.VarCharset) > 0 {
-			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarCharset, charset)
+// bestMediaRange returns the most specific of the media ranges that include
+// the offered type, or nil if there is none.
+func bestMediaRange(ranges []mediaRange, offer contenttype.MediaType) *mediaRange {
+	var best *mediaRange
+	for i, rng := range ranges {
+		if !rangeMatches(rng.mediaType, offer) {
+			continue
+		}
+		if best == nil || specificity(rng.mediaType) > specificity(best.mediaType) {
+			best = &ranges[i]
 		}
 	}
+	return best
+}
 
-	encodingMatch, encoding := false, ""
-	if len(m.MatchEncodings) == 0 {
-		encodingMatch = true
-	} else {
-		encodingMatch, encoding = m.matchCharsetOrEncoding(r, m.MatchEncodings, m.MatchTEncodings, m.ForceEncodingQueryString, "Accept-Encoding")
-		if encodingMatch && len(m.VarEncoding) > 0 {
-			caddyhttp.SetVar(r.Context(), "conneg_"+m.VarEncoding, encoding)
+// rejectsAllMediaTypes reports whether the most specific media range of an
+// Accept header matching each of the offered types has a quality of 0.
+func rejectsAllMediaTypes(header string, offerTypes []contenttype.MediaType) bool {
+	ranges, ok := parseMediaRanges(header)
+	if !ok || len(offerTypes) == 0 {
+		return false
+	}
+	for _, offer := range offerTypes {
+		best := bestMediaRange(ranges, offer)
+		if best == nil || !best.weighted || best.weight != 0 {
+			return false
 		}
 	}
+	return true
+}
 
-	return (typeMatch && languageMatch && charsetMatch && encodingMatch)
+// matchedByWildcard reports whether the offered type has been negotiated from
+// a `*/*` range of the Accept header rather than a more specific one.
+func matchedByWildcard(header string, offer contenttype.MediaType) bool {
+	ranges, ok := parseMediaRanges(header)
+	if !ok {
+		return false
+	}
+	best := bestMediaRange(ranges, offer)
+	return best != nil && best.mediaType.Type == "*" && best.mediaType.Subtype == "*"
 }
 
-func (m MatchConneg) matchType(r *http.Request, offers []string, offerTypes []contenttype.MediaType, forceString string, headerName string) (bool, string) {
-	match, result := false, ""
-	if forceString != "" {
-		if err := r.ParseForm(); err != nil {
-			sugar := m.logger.Sugar()
-			sugar.Infof("Problem parsing URL: %+v", err)
-			// return errors.New("One of match_types, match_languages, match_charsets, match_encodings MUST be set.")
-		} else {
-			if len(r.Form[forceString]) > 0 {
-				for _, t := range offers {
-					if t == r.Form[forceString][0] {
-						match, result = true, t
-					} else {
-						values, containsKey := aliases[t]
-						if containsKey {
-							if slices.Contains(values.([]string), r.Form[forceString][0]) {
-								match, result = true, t
-							}
-						}
-					}
-				}
-				if !match {
-					return false, ""
-				}
-			}
-		}
+// rangeMatches reports whether a media range of an Accept header includes the offered type.
+func rangeMatches(mediaRange, offer contenttype.MediaType) bool {
+	if (mediaRange.Type != "*" && mediaRange.Type != offer.Type) || (mediaRange.Subtype != "*" && mediaRange.Subtype != offer.Subtype) {
+		return false
 	}
-	if !match {
-		var headerValues []string
-		headerValues = append(headerValues, r.Header.Values(headerName)...)
-		for _, a := range headerValues {
-			var mediatype, _, _ = contenttype.GetAcceptableMediaTypeFromHeader(a, offerTypes)
-			if mediatype.Type != "" {
-				match, result = true, mediatype.String()
-			}
+	for k, v := range mediaRange.Parameters {
+		if offer.Parameters[k] != v {
+			return false
 		}
 	}
-	return match, result
+	return true
+}
+
+// specificity ranks media ranges as in RFC 7231, 5.3.2: more specific ranges override less specific ones.
+func specificity(mediaRange contenttype.MediaType) int {
+	result := len(mediaRange.Parameters)
+	if mediaRange.Type != "*" {
+		result += 1000
+	}
+	if mediaRange.Subtype != "*" {
+		result += 1000
+	}
+	return result
 }
 
-func (m MatchConneg) matchLanguage(r *http.Request, offers []string, forceString string, headerName string) (bool, string) {
+func (m MatchConneg) matchLanguage(r *http.Request, offers []string, forceString string, headerName string) (bool, string, language.Confidence) {
 
-	match, result := false, ""
+	match, result, forced, confidence := false, "", "", language.No
 	if forceString != "" {
 		if err := r.ParseForm(); err != nil {
 			sugar := m.logger.Sugar()
 			sugar.Infof("Problem parsing URL: %+v", err)
 			// return errors.New("One of match_types, match_languages, match_charsets, match_encodings MUST be set.")
 		} else {
-			if len(r.Form[forceString]) > 0 {
-				for _, t := range offers {
-					if t == r.Form[forceString][0] {
-						match, result = true, t
-					} else {
-						values, containsKey := aliases[t]
-						if containsKey {
-							if slices.Contains(values.([]string), r.Form[forceString][0]) {
-								match, result = true, t
-							}
+			if values := m.forcedCandidates(r.Form[forceString]); len(values) > 0 {
+				for _, value := range values {
+					value = m.localeTag(value)
+					for _, t := range offers {
+						if m.namesOffer(t, value, true) {
+							match, result, forced = true, m.formatLanguage(language.Make(t)), t
 						}
 					}
+					if match {
+						break
+					}
 				}
 				if !match {
-					return false, ""
+					return false, "", language.No
+				}
+				confidence = language.Exact
+				if m.ForceLanguageAcceptReplace {
+					r.Header.Set(headerName, forced)
+				}
+				if m.RemoveForceParam {
+					removeQueryParam(r, forceString)
 				}
 			}
 		}
@@ -327,15 +3461,115 @@ func (m MatchConneg) matchLanguage(r *http.Request, offers []string, forceString
 	if !match {
 		var headerValues []string
 		headerValues = append(headerValues, r.Header.Values(headerName)...)
-		tag, _ := language.MatchStrings(m.LanguageMatcher, strings.Join(headerValues, ", "))
+		if len(headerValues) == 0 && m.SameOriginLanguage {
+			if lang, ok := m.originLanguage(r, offers); ok {
+				headerValues = append(headerValues, lang)
+			}
+		}
+		if len(headerValues) == 0 && m.geoDB != nil {
+			headerValues = append(headerValues, m.geoLanguage(r))
+		}
+		// like language.MatchStrings, but keeping the confidence
+		var tag language.Tag
+		var index int
+		desired, _, err := language.ParseAcceptLanguage(strings.Join(headerValues, ", "))
+		if err == nil {
+			tag, index, confidence = m.LanguageMatcher.Match(desired...)
+		}
+		if err != nil || confidence == language.No {
+			tag, index, confidence = m.LanguageMatcher.Match()
+		}
 		match = !tag.IsRoot()
 		if match {
-			result = display.English.Tags().Name(tag) + "/" + display.Self.Name(tag)
+			// report the offered language rather than the client's variant of it
+			result = m.formatLanguage(m.MatchTLanguages[index])
 		} else {
 			result = ""
 		}
 	}
-	return match, result
+	return match, result, confidence
+}
+
+// localeTag returns the BCP 47 tag for a locale identifier forced by the
+// client, see LocaleAlias, or the identifier itself if it has none.
+func (m MatchConneg) localeTag(identifier string) string {
+	if tag, ok := m.LocaleAlias[identifier]; ok {
+		return tag
+	}
+	if tag, ok := iso639_2Tags[strings.ToLower(identifier)]; ok {
+		return tag
+	}
+	return identifier
+}
+
+// formatLanguage renders a language tag as configured in LanguageDisplayFormat.
+func (m MatchConneg) formatLanguage(tag language.Tag) string {
+	switch m.LanguageDisplayFormat {
+	case "display_en":
+		return display.English.Tags().Name(tag)
+	case "display_native":
+		return display.Self.Name(tag)
+	case "iso639_1":
+		base, _ := tag.Base()
+		return base.String()
+	default:
+		return tag.String()
+	}
+}
+
+// implicitUTF8 tells whether a missing Accept-Charset header is taken to
+// accept UTF-8, see ImplicitUTF8.
+func (m MatchConneg) implicitUTF8() bool {
+	if m.ImplicitUTF8 == nil {
+		// earlier versions let such requests miss
+		return !m.BackwardsCompatibilityMode
+	}
+	return *m.ImplicitUTF8
+}
+
+// whitelistedParams drops the parameters of a content type that are not in
+// MIMEParamWhitelist, keeping the others in the order of the whitelist.
+func (m MatchConneg) whitelistedParams(t string) string {
+	if len(m.MIMEParamWhitelist) == 0 {
+		return t
+	}
+	mediaType := contenttype.NewMediaType(t)
+	if len(mediaType.Type) == 0 {
+		return t
+	}
+	var sb strings.Builder
+	sb.WriteString(mediaType.MIME())
+	for _, key := range m.MIMEParamWhitelist {
+		key = strings.ToLower(key)
+		if value, ok := mediaType.Parameters[key]; ok {
+			sb.WriteString(";" + key + "=" + value)
+		}
+	}
+	return sb.String()
+}
+
+// originLanguage returns the offered language named by the first label of
+// the host in the Origin header, as in `https://fr.example.com`, if the host
+// is a subdomain of one of the AllowedOriginDomains.
+func (m MatchConneg) originLanguage(r *http.Request, offers []string) (string, bool) {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil {
+		return "", false
+	}
+	host := strings.ToLower(origin.Hostname())
+	for _, domain := range m.AllowedOriginDomains {
+		subdomain := strings.TrimSuffix(host, "."+strings.ToLower(strings.Trim(domain, ".")))
+		if subdomain == host || len(subdomain) == 0 {
+			continue
+		}
+		label := strings.Split(subdomain, ".")[0]
+		for _, t := range offers {
+			if strings.EqualFold(t, label) || slices.Contains(m.offerAliases(t), label) {
+				return t, true
+			}
+		}
+	}
+	return "", false
 }
 
 func (m MatchConneg) matchCharsetOrEncoding(r *http.Request, offers []string, offerCharsetOrEncodings []CharsetOrEncoding, forceString string, headerName string) (bool, string) {
@@ -346,32 +3580,48 @@ func (m MatchConneg) matchCharsetOrEncoding(r *http.Request, offers []string, of
 			sugar.Infof("Problem parsing URL: %+v", err)
 			// return errors.New("One of match_types, match_languages, match_charsets, match_encodings MUST be set.")
 		} else {
-			if len(r.Form[forceString]) > 0 {
-				for _, t := range offers {
-					if t == r.Form[forceString][0] {
-						match, result = true, t
-					} else {
-						values, containsKey := aliases[t]
-						if containsKey {
-							if slices.Contains(values.([]string), r.Form[forceString][0]) {
-								match, result = true, t
-							}
+			if values := m.forcedCandidates(r.Form[forceString]); len(values) > 0 {
+				for _, value := range values {
+					for _, t := range offers {
+						if m.namesOffer(t, value, true) {
+							match, result = true, t
 						}
 					}
+					if match {
+						m.countAliasResolution(value, result)
+						break
+					}
 				}
 				if !match {
 					return false, ""
 				}
+				if m.RemoveForceParam {
+					removeQueryParam(r, forceString)
+				}
 			}
 		}
 	}
 	if !match {
 		var headerValues []string
 		headerValues = append(headerValues, r.Header.Values(headerName)...)
-		for _, a := range headerValues {
-			var other, _, _ = getAcceptableCharsetOrEncodingFromHeader(a, offerCharsetOrEncodings)
+		if len(headerValues) == 0 && headerName == "Accept-Charset" && m.implicitUTF8() {
+			// RFC 7231, 5.3.3: a user agent that sends no Accept-Charset accepts any charset,
+			// and UTF-8 is the one we can assume it to handle
+			for _, t := range offers {
+				if strings.EqualFold(t, "utf-8") {
+					return true, t
+				}
+			}
+		}
+		if len(headerValues) > 0 {
+			// RFC 7230, 3.2.2: multiple header fields are equivalent to one
+			// with their values joined by commas, so negotiate them at once
+			exactCase := m.BackwardsCompatibilityMode && headerName == "Accept-Charset"
+			var other, _, _, err = negotiateCharsetOrEncoding(strings.Join(headerValues, ", "), offerCharsetOrEncodings, exactCase)
 			if other.Value != "" {
 				match, result = true, other.Value
+			} else if m.ZeroQRejectsAll && errors.Is(err, ErrExplicitRejection) {
+				caddyhttp.SetVar(r.Context(), sourceVar, "explicit_rejection")
 			}
 		}
 	}
@@ -384,6 +3634,8 @@ var (
 	_ caddyfile.Unmarshaler    = (*MatchConneg)(nil)
 	_ caddy.Provisioner        = (*MatchConneg)(nil)
 	_ caddy.Validator          = (*MatchConneg)(nil)
+	_ caddy.CleanerUpper       = (*MatchConneg)(nil)
+	_ Matcher                  = (*MatchConneg)(nil)
 )
 
 /*
@@ -421,6 +3673,12 @@ func isDigitChar(c byte) bool {
 
 func skipSpace(s string) (rest string) {
 	for i := 0; i < len(s); i++ {
+		// RFC 7230, 3.2.4: obsolete line folding, i.e. CRLF followed by
+		// whitespace, counts as whitespace
+		if s[i] == '\r' && i+2 < len(s) && s[i+1] == '\n' && isWhitespaceChar(s[i+2]) {
+			i += 2
+			continue
+		}
 		if !isWhitespaceChar(s[i]) {
 			return s[i:]
 		}
@@ -464,6 +3722,27 @@ func consumeParameter(s string) (string, string, string, bool) {
 	return key, value, s, true
 }
 
+// splitOfferQuality separates a server-side quality value from an offer
+// like `text/html;q=0.9`. Offers without a `q` parameter have quality 1.0.
+// As in Accept headers, anything after the `q` parameter is discarded.
+func splitOfferQuality(offer string) (string, float64, error) {
+	for i := strings.IndexByte(offer, ';'); i >= 0; {
+		if key, value, _, consumed := consumeParameter(offer[i+1:]); consumed && key == "q" {
+			weight, valid := getWeight(value)
+			if !valid {
+				return "", 0, fmt.Errorf("Invalid quality value in offer '%s'.", offer)
+			}
+			return strings.TrimSpace(offer[:i]), float64(weight) / 1000, nil
+		}
+		next := strings.IndexByte(offer[i+1:], ';')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return offer, 1.0, nil
+}
+
 func getWeight(s string) (int, bool) {
 	// RFC 7231, 5.3.1. Quality Values
 	result := 0
@@ -504,8 +3783,10 @@ func getWeight(s string) (int, bool) {
 }
 
 func compareCharsetOrEncodings(checkCharsetOrEncoding, other CharsetOrEncoding) bool {
-	// RFC 7231, 5.3.2. Accept
-	if other.Value == "*" || checkCharsetOrEncoding.Value == other.Value {
+	// RFC 7231, 5.3.3. Accept-Charset and 5.3.4. Accept-Encoding: a "*" sent by the
+	// client matches every offer; a "*" offer matches everything the client asks for.
+	// Charset and encoding names are case-insensitive.
+	if checkCharsetOrEncoding.Value == "*" || other.Value == "*" || strings.EqualFold(checkCharsetOrEncoding.Value, other.Value) {
 
 		for checkKey, checkValue := range checkCharsetOrEncoding.Parameters {
 			if value, found := other.Parameters[checkKey]; !found || value != checkValue {
@@ -519,17 +3800,30 @@ func compareCharsetOrEncodings(checkCharsetOrEncoding, other CharsetOrEncoding)
 	return false
 }
 
+// getPrecedence reports whether checkCharsetOrEncoding, a range from the
+// header, is more specific than other, the range that has matched an offer
+// so far. RFC 7231, 5.3.2. Accept: "Media ranges can be overridden by more
+// specific media ranges or specific media types. If more than one media range
+// applies to a given type, the most specific reference has precedence."
 func getPrecedence(checkCharsetOrEncoding, other CharsetOrEncoding) bool {
-	// RFC 7231, 5.3.2. Accept
 	if len(other.Value) == 0 { // not set
 		return true
 	}
 
-	if (other.Value == "*" && checkCharsetOrEncoding.Value != "*") ||
-		(len(other.Parameters) < len(checkCharsetOrEncoding.Parameters)) {
-		return true
+	// a specific value is more specific than "*", whatever the parameters
+	if (other.Value == "*") != (checkCharsetOrEncoding.Value == "*") {
+		return other.Value == "*"
+	}
+
+	// with equal values, more parameters are more specific
+	if len(other.Parameters) != len(checkCharsetOrEncoding.Parameters) {
+		return len(other.Parameters) < len(checkCharsetOrEncoding.Parameters)
 	}
 
+	// Equally specific: either the same range repeated, or ranges with as many
+	// parameters but different parameter values. As both have matched the offer,
+	// all their parameters are parameters of the offer, so neither is more
+	// specific. The range that came first keeps precedence.
 	return false
 }
 
@@ -537,6 +3831,16 @@ func getPrecedence(checkCharsetOrEncoding, other CharsetOrEncoding) bool {
 // Returns the most charset/encoding or an error if none can be selected.
 // This is copied from <> and modified only slightly
 func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableCharsetOrEncodings []CharsetOrEncoding) (CharsetOrEncoding, Parameters, error) {
+	result, extensionParameters, _, err := negotiateCharsetOrEncoding(headerValue, availableCharsetOrEncodings, false)
+	return result, extensionParameters, err
+}
+
+// negotiateCharsetOrEncoding does the work of
+// getAcceptableCharsetOrEncodingFromHeader, returning the weight (in
+// thousandths) of the chosen charset or encoding as well. With exactCase,
+// the (lowercased) values of the header only match offers written the same,
+// as in earlier versions (see BackwardsCompatibilityMode).
+func negotiateCharsetOrEncoding(headerValue string, availableCharsetOrEncodings []CharsetOrEncoding, exactCase bool) (CharsetOrEncoding, Parameters, int, error) {
 	s := headerValue
 
 	weights := make([]struct {
@@ -554,14 +3858,16 @@ func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableChars
 			}
 			s = s[1:] // skip the comma
 		}
+		s = skipSpace(s)
 
 		acceptableCharsetOrEncoding := CharsetOrEncoding{
 			Parameters: Parameters{},
 		}
 		var consumed bool
 		if acceptableCharsetOrEncoding.Value, s, consumed = consumeToken(s); !consumed {
-			return CharsetOrEncoding{}, Parameters{}, errors.New("invalid value in Accept-* string")
+			return CharsetOrEncoding{}, Parameters{}, 0, acceptSyntaxError("invalid value in Accept-* string")
 		}
+		s = skipSpace(s)
 
 		weight := 1000 // 1.000
 
@@ -571,12 +3877,12 @@ func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableChars
 
 			var key, value string
 			if key, value, s, consumed = consumeParameter(s); !consumed {
-				return CharsetOrEncoding{}, Parameters{}, errors.New("invalid parameter in Accept-* string")
+				return CharsetOrEncoding{}, Parameters{}, 0, acceptSyntaxError("invalid parameter in Accept-* string")
 			}
 
 			if key == "q" {
 				if weight, consumed = getWeight(value); !consumed {
-					return CharsetOrEncoding{}, Parameters{}, errors.New("invalid weight in Accept-* string")
+					return CharsetOrEncoding{}, Parameters{}, 0, acceptSyntaxError("invalid weight in Accept-* string")
 				}
 				break // "q" parameter separates media type parameters from Accept extension parameters
 			}
@@ -590,7 +3896,7 @@ func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableChars
 
 			var key, value, remaining string
 			if key, value, remaining, consumed = consumeParameter(s); !consumed {
-				return CharsetOrEncoding{}, Parameters{}, errors.New("invalid parameter in Accept-* string")
+				return CharsetOrEncoding{}, Parameters{}, 0, acceptSyntaxError("invalid parameter in Accept-* string")
 			}
 
 			s = remaining
@@ -599,6 +3905,10 @@ func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableChars
 		}
 
 		for i, availableCharsetOrEncoding := range availableCharsetOrEncodings {
+			if exactCase && acceptableCharsetOrEncoding.Value != "*" && availableCharsetOrEncoding.Value != "*" &&
+				acceptableCharsetOrEncoding.Value != availableCharsetOrEncoding.Value {
+				continue
+			}
 			if compareCharsetOrEncodings(acceptableCharsetOrEncoding, availableCharsetOrEncoding) &&
 				getPrecedence(acceptableCharsetOrEncoding, weights[i].other) {
 				weights[i].other = acceptableCharsetOrEncoding
@@ -613,7 +3923,7 @@ func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableChars
 
 	// there must not be anything left after parsing the header
 	if len(s) > 0 {
-		return CharsetOrEncoding{}, Parameters{}, errors.New("invalid range in Accept-* string")
+		return CharsetOrEncoding{}, Parameters{}, 0, acceptSyntaxError("invalid range in Accept-* string")
 	}
 
 	resultIndex := -1
@@ -629,8 +3939,18 @@ func getAcceptableCharsetOrEncodingFromHeader(headerValue string, availableChars
 	}
 
 	if resultIndex == -1 {
-		return CharsetOrEncoding{}, Parameters{}, errors.New("no acceptable value found")
+		// if every offer has been matched, it was with a weight of 0
+		rejected := len(weights) > 0
+		for _, weight := range weights {
+			if weight.other.Value == "" {
+				rejected = false
+			}
+		}
+		if rejected {
+			return CharsetOrEncoding{}, Parameters{}, 0, ErrExplicitRejection
+		}
+		return CharsetOrEncoding{}, Parameters{}, 0, errors.New("no acceptable value found")
 	}
 
-	return availableCharsetOrEncodings[resultIndex], weights[resultIndex].extensionParameters, nil
+	return availableCharsetOrEncodings[resultIndex], weights[resultIndex].extensionParameters, weights[resultIndex].weight, nil
 }
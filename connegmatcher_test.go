@@ -1,90 +1,2284 @@
 package connegmatcher
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
-	"net/http/httptest"
-	"regexp"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/mpilhlt/caddy-conneg/connegctx"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
-func getReq(method string) (*httptest.ResponseRecorder, *http.Request) {
-	w := httptest.NewRecorder()
-	r, _ := http.NewRequest(method, "http://foo.com", nil)
-	r.Header.Set(requestMethodKey, "POST")
-	return w, r
+func newConnegRequest(t *testing.T, target string, headers map[string]string) *http.Request {
+	t.Helper()
+	r, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	ctx := context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{}))
+	return r.WithContext(ctx)
+}
+
+func provisionConneg(t *testing.T, m *MatchConneg) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+}
+
+func TestMultipartFallback(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		m := MatchConneg{
+			MatchTypes:        []string{"text/html", "multipart/mixed"},
+			VarType:           "type",
+			MultipartFallback: fallback,
+		}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json"})
+		if got := m.Match(r); got != fallback {
+			t.Fatalf("MultipartFallback=%v: expected match %v, got %v", fallback, fallback, got)
+		}
+		if fallback {
+			if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != "multipart/mixed" {
+				t.Fatalf("Expected conneg_type \"multipart/mixed\", got %v", v)
+			}
+		}
+	}
+}
+
+func TestWildcardDefault(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:      []string{"application/json", "text/html;q=0.9", "text/csv"},
+		WildcardDefault: "text/html",
+		VarType:         "type",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for accept, want := range map[string]string{
+		"*/*":                           "text/html",
+		"*/*;q=0.8":                     "text/html",
+		"text/csv, */*;q=0.1":           "text/csv",
+		"application/json":              "application/json",
+		"text/*":                        "text/csv",
+		"text/*;q=0.5, */*":             "text/html",
+		"application/json;q=0.5, */*":   "text/html",
+		"application/json, */*;q=0.9":   "application/json",
+		"text/csv;q=0.1, application/*": "application/json",
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept})
+		if !m.Match(r) {
+			t.Fatalf("%s: request should match", accept)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != want {
+			t.Errorf("%s: expected type %q, got %v", accept, want, v)
+		}
+	}
+
+	m = MatchConneg{MatchTypes: []string{"application/json"}, WildcardDefault: "text/html"}
+	if err := m.Validate(); err == nil {
+		t.Fatal("wildcard_default that is not offered should be rejected")
+	}
+}
+
+func TestOfferQualities(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes: []string{"text/html;q=1.0", "application/json;q=0.9", "text/plain"},
+		VarType:    "type",
+	}
+	provisionConneg(t, &m)
+	expected := map[string]float64{"text/html": 1.0, "application/json": 0.9, "text/plain": 1.0}
+	for offer, q := range expected {
+		if m.serverQualities[offer] != q {
+			t.Fatalf("Expected server quality %v for %s, got %v", q, offer, m.serverQualities[offer])
+		}
+	}
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json"})
+	if !m.Match(r) {
+		t.Fatal("Offer with inline quality value should still match")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != "application/json" {
+		t.Fatalf("Expected conneg_type \"application/json\", got %v", v)
+	}
+	if expected := []string{"text/html;q=1.0", "application/json;q=0.9", "text/plain"}; !reflect.DeepEqual(m.MatchTypes, expected) {
+		t.Fatalf("Provisioning should leave match_types as configured, got %v", m.MatchTypes)
+	}
+
+	m = MatchConneg{MatchTypes: []string{"text/html;q=2"}}
+	if err := m.Provision(caddy.Context{Context: context.Background()}); err == nil {
+		t.Fatal("Invalid inline quality value should fail provisioning")
+	}
+
+	// client and server qualities multiply
+	var parsed MatchConneg
+	if err := parsed.UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n match_types text/html;q=1.0 application/json;q=0.5 text/plain\n var_type type\n}")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.MatchTypes, []string{"text/html", "application/json", "text/plain"}) {
+		t.Fatalf("Expected types without quality values, got %v", parsed.MatchTypes)
+	}
+	if !reflect.DeepEqual(parsed.TypeQualities, map[string]float64{"text/html": 1.0, "application/json": 0.5}) {
+		t.Fatalf("Expected quality values of text/html and application/json, got %v", parsed.TypeQualities)
+	}
+	provisionConneg(t, &parsed)
+	defer parsed.Cleanup()
+	if err := parsed.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for accept, want := range map[string]string{
+		"text/html;q=0.8, application/json": "text/html",
+		"text/html;q=0.4, application/json": "application/json",
+		"text/html;q=0.5, application/json": "text/html",
+		"application/json, text/html;q=0.5": "application/json",
+		"*/*":                               "text/html",
+		"application/*":                     "application/json",
+		"text/html;q=0, application/json":   "application/json",
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept})
+		if !parsed.Match(r) {
+			t.Fatalf("%s: request should match", accept)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != want {
+			t.Errorf("%s: expected type %q, got %v", accept, want, v)
+		}
+	}
+	if parsed.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "image/png"})) {
+		t.Error("Request for a type not on offer should not match")
+	}
+	// commas in quoted parameter values do not separate media ranges
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": `text/plain;profile="a,b", application/json;q=0.5`})
+	if !parsed.Match(r) {
+		t.Fatal("Request with a quoted comma in the Accept header should match")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != "application/json" {
+		t.Errorf("Expected type \"application/json\", got %v", v)
+	}
+
+	if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n match_types text/html;q=1.5\n}")); err == nil {
+		t.Error("Invalid quality value in the Caddyfile should be rejected")
+	}
+	m = MatchConneg{MatchTypes: []string{"text/html"}, TypeQualities: map[string]float64{"application/json": 0.5}}
+	if err := m.Validate(); err == nil {
+		t.Error("Quality of a type that is not offered should be rejected")
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html"}, VarType: "type", AllowedMethods: []string{"GET", "HEAD"}}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json"})
+	if m.Match(r) {
+		t.Error("GET request should be negotiated and not match")
+	}
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"})
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "text/html" {
+		t.Errorf("GET request should be negotiated, got type %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json"})
+	r.Method = http.MethodDelete
+	if !m.Match(r) {
+		t.Error("DELETE request should match without negotiation")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != nil {
+		t.Errorf("DELETE request should not be negotiated, got type %v", v)
+	}
+
+	disallowed := MatchConneg{MatchTypes: []string{"text/html"}, DisallowedMethods: []string{"POST"}}
+	provisionConneg(t, &disallowed)
+	defer disallowed.Cleanup()
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json"})
+	r.Method = http.MethodPost
+	if !disallowed.Match(r) {
+		t.Error("POST request should match without negotiation")
+	}
+	r.Method = http.MethodPut
+	if disallowed.Match(r) {
+		t.Error("PUT request should be negotiated and not match")
+	}
+
+	disallowed.AllowedMethods = []string{"GET"}
+	if err := disallowed.Validate(); err == nil {
+		t.Error("Setting both allowed_methods and disallowed_methods should fail validation")
+	}
+}
+
+func TestAssertMethod(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"application/json"}, AssertMethod: "GET"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for method, expected := range map[string]bool{http.MethodGet: false, http.MethodPost: true, http.MethodDelete: true} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"})
+		r.Method = method
+		if m.Match(r) != expected {
+			t.Errorf("%s request: expected match %v", method, expected)
+		}
+	}
+
+	for _, invalid := range []MatchConneg{
+		{MatchTypes: []string{"text/html"}, AssertMethod: "GET", AllowedMethods: []string{"GET"}},
+		{MatchTypes: []string{"text/html"}, AssertMethod: "GET POST"},
+		{MatchTypes: []string{"text/html"}, AssertMethod: "GET,"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v should fail validation", invalid)
+		}
+	}
+}
+
+func TestMultipleTypeVars(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:           []string{"text/html", "application/json", "application/ld+json", "text/plain"},
+		ForceTypeQueryString: "format",
+		VarType:              "type",
+		MultipleTypeVars:     true,
+		MaxTypeVars:          2,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		url, accept string
+		vars        map[string]interface{}
+	}{
+		{"http://foo.com", "application/json;q=0.5, text/html;q=0.8, application/ld+json", map[string]interface{}{
+			"conneg_type_0": "application/ld+json", "conneg_type_1": "text/html", "conneg_type_2": nil, "conneg_type_count": "2",
+		}},
+		{"http://foo.com", "text/plain, image/png", map[string]interface{}{
+			"conneg_type_0": "text/plain", "conneg_type_1": nil, "conneg_type_count": "1",
+		}},
+		{"http://foo.com?format=html", "application/json", map[string]interface{}{
+			"conneg_type_0": "text/html", "conneg_type_1": nil, "conneg_type_count": "1",
+		}},
+	} {
+		r := newConnegRequest(t, test.url, map[string]string{"Accept": test.accept})
+		if !m.Match(r) {
+			t.Errorf("%s %s: expected a match", test.url, test.accept)
+		}
+		for name, expected := range test.vars {
+			if v := caddyhttp.GetVar(r.Context(), name); v != expected {
+				t.Errorf("%s %s: expected %s %v, got %v", test.url, test.accept, name, expected, v)
+			}
+		}
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, MultipleTypeVars: true}).Validate(); err == nil {
+		t.Error("multiple_type_vars without var_type should not validate")
+	}
+	if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n max_type_vars\n 5\n}")); err == nil {
+		t.Error("max_type_vars without a value should be rejected")
+	}
+}
+
+func TestInvertMatch(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"application/json"}, MatchLanguages: []string{"en", "de"}, VarLanguage: "lang", InvertMatch: true}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for accept, expected := range map[string]bool{"application/json": false, "text/html": true} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept, "Accept-Language": "de"})
+		if m.Match(r) != expected {
+			t.Errorf("Accept: %s should match: %t", accept, expected)
+		}
+		if m.MatchWithResult(r).Match == expected {
+			t.Errorf("Accept: %s: the result should not be inverted", accept)
+		}
+		// as without invert_match
+		if v := caddyhttp.GetVar(r.Context(), "conneg_lang"); v != "de" {
+			t.Errorf("Accept: %s: expected language de, got %v", accept, v)
+		}
+	}
+}
+
+func TestDefaultOnEmpty(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:             []string{"text/html"},
+		VarType:                "type",
+		VarLanguage:            "lang",
+		DefaultLanguageOnEmpty: "en",
+		VarEncoding:            "enc",
+		DefaultEncodingOnEmpty: "identity",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "de", "Accept-Encoding": "gzip"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	for name, expected := range map[string]string{"conneg_type": "text/html", "conneg_lang": "en", "conneg_enc": "identity"} {
+		if v := caddyhttp.GetVar(r.Context(), name); v != expected {
+			t.Errorf("Expected %s %s, got %v", name, expected, v)
+		}
+	}
+
+	for _, invalid := range []MatchConneg{
+		{MatchTypes: []string{"text/html"}, VarLanguage: "lang"},
+		{MatchTypes: []string{"text/html"}, DefaultTypeOnEmpty: "text/plain"},
+		{MatchTypes: []string{"text/html"}, VarLanguageConfidence: "confidence", DefaultLanguageOnEmpty: "en"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v should fail validation", invalid)
+		}
+	}
+}
+
+func TestRequireAtLeastOneHeader(t *testing.T) {
+	m := MatchConneg{MatchCharsets: []string{"utf-8", "iso-8859-1"}, ForceCharsetQueryString: "charset", RequireAtLeastOneHeader: true}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := []struct {
+		url       string
+		headers   map[string]string
+		match     bool
+		noHeaders interface{}
+	}{
+		{"http://foo.com", map[string]string{}, false, "1"},
+		{"http://foo.com", map[string]string{"Accept-Charset": "iso-8859-1"}, true, nil},
+		{"http://foo.com", map[string]string{"Accept": "text/html"}, true, nil},
+		{"http://foo.com?charset=utf-8", map[string]string{}, true, nil},
+		{"http://foo.com?charset=utf-16", map[string]string{}, false, nil},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, test.url, test.headers)
+		if m.Match(r) != test.match {
+			t.Errorf("%s %v: expected match %v", test.url, test.headers, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_no_headers"); v != test.noHeaders {
+			t.Errorf("%s %v: expected conneg_no_headers %v, got %v", test.url, test.headers, test.noHeaders, v)
+		}
+	}
+}
+
+func init() {
+	caddy.RegisterModule(testPathMatcher{})
+}
+
+// testPathMatcher is a request matcher for the tests of chained_matcher,
+// standing in for Caddy's path matcher.
+type testPathMatcher struct {
+	Prefixes []string `json:"prefixes"`
+}
+
+func (testPathMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.conneg_test_path",
+		New: func() caddy.Module { return new(testPathMatcher) },
+	}
+}
+
+func (p *testPathMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		p.Prefixes = append(p.Prefixes, d.Val())
+	}
+	return nil
+}
+
+func (p testPathMatcher) Match(r *http.Request) bool {
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChainedMatcher(t *testing.T) {
+	var m MatchConneg
+	d := caddyfile.NewTestDispenser(`conneg {
+		match_types application/json
+		chained_matcher {
+			conneg_test_path /api/
+			conneg_test_path /v2/
+		}
+		var_type type
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	// the lines of a matcher configure it together, as in a named matcher
+	if len(m.ChainedMatcher) != 1 || string(m.ChainedMatcher[0]) != `{"conneg_test_path":{"prefixes":["/api/","/v2/"]}}` {
+		t.Fatalf("Expected the chained matcher's config, got %q", m.ChainedMatcher)
+	}
+	if m.VarType != "type" {
+		t.Errorf("Expected the directives after chained_matcher to be parsed, got %+v", m)
+	}
+	if _, err := m.MarshalCaddyfile(); err == nil {
+		t.Error("A chained_matcher cannot be written back to a Caddyfile")
+	}
+
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, before := range []bool{false, true} {
+		m.ChainBefore = before
+		for path, expected := range map[string]bool{"/api/items": true, "/v2/items": true, "/static/app.js": false} {
+			r := newConnegRequest(t, "http://foo.com"+path, map[string]string{"Accept": "application/json"})
+			if m.Match(r) != expected {
+				t.Errorf("chain_before %v, %s: expected match %v", before, path, expected)
+			}
+			// the negotiation is skipped for requests rejected beforehand
+			if negotiated := caddyhttp.GetVar(r.Context(), "conneg_type") != nil; negotiated != (expected || !before) {
+				t.Errorf("chain_before %v, %s: expected negotiation %v", before, path, expected || !before)
+			}
+		}
+	}
+
+	d = caddyfile.NewTestDispenser(`conneg {
+		chained_matcher {
+			conneg_test_path /api/
+		}
+		chained_matcher {
+			conneg_test_path /v2/
+		}
+	}`)
+	if err := new(MatchConneg).UnmarshalCaddyfile(d); err == nil {
+		t.Error("A matcher chained in two blocks should be rejected")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustProvisionWithLogger cannot load chained matchers and should panic")
+		}
+	}()
+	chained := MatchConneg{MatchTypes: []string{"application/json"}, ChainedMatcher: m.ChainedMatcher}
+	chained.MustProvisionWithLogger(zap.NewNop())
+}
+
+func TestDefaultAliases(t *testing.T) {
+	t.Cleanup(func() {
+		aliasesMu.Lock()
+		defer aliasesMu.Unlock()
+		delete(aliases, "text/turtle")
+		delete(aliases, "application/n-triples")
+	})
+	if err := AddDefaultAlias("text/turtle", "ttl"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDefaultAliases(map[string][]string{"application/n-triples": {"nt", "ntriples"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := MatchConneg{MatchTypes: []string{"text/turtle", "application/n-triples"}, ForceTypeQueryString: "format", VarType: "type"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for format, expected := range map[string]string{"ttl": "text/turtle", "ntriples": "application/n-triples"} {
+		r := newConnegRequest(t, "http://foo.com?format="+format, map[string]string{"Accept": "text/html"})
+		if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != expected {
+			t.Errorf("format=%s: expected %s, got %v", format, expected, caddyhttp.GetVar(r.Context(), "conneg_type"))
+		}
+	}
+
+	if err := SetDefaultAliases(map[string][]string{"text/n3": {"n3"}, "text/turtle": {""}}); err == nil {
+		t.Error("Setting an empty alias should fail")
+	}
+	if values := aliasesOf("text/n3"); values != nil {
+		t.Errorf("A failed SetDefaultAliases should change nothing, got %v", values)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	parent := MatchConneg{MatchTypes: []string{"text/html", "application/json;q=0.5"}, MatchLanguages: []string{"en"}, RegistryKey: "test_inherit_parent"}
+	provisionConneg(t, &parent)
+	defer parent.Cleanup()
+
+	var child MatchConneg
+	d := caddyfile.NewTestDispenser(`conneg {
+		inherit test_inherit_parent
+		match_types text/turtle text/html;q=0.9
+		var_type type
+	}`)
+	if err := child.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	provisionConneg(t, &child)
+	defer child.Cleanup()
+	if expected := []string{"application/json", "text/turtle", "text/html"}; !reflect.DeepEqual(child.matchTypes, expected) {
+		t.Errorf("Expected types %v, got %v", expected, child.matchTypes)
+	}
+	if !reflect.DeepEqual(child.MatchLanguages, []string{"en"}) {
+		t.Errorf("Expected the parent's languages, got %v", child.MatchLanguages)
+	}
+	// the parent's quality of application/json is inherited
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json, text/turtle;q=0.6", "Accept-Language": "en"})
+	if !child.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "text/turtle" {
+		t.Errorf("Expected text/turtle, got %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+	// the child's own quality of text/html overrides the parent's
+	if q := child.serverQualities["text/html"]; q != 0.9 {
+		t.Errorf("Expected the child's quality 0.9 for text/html, got %v", q)
+	}
+
+	orphan := MatchConneg{Inherit: "test_inherit_missing"}
+	if err := orphan.provision(); err == nil {
+		t.Error("Inheriting from a matcher that has not been provisioned should fail")
+	}
+}
+
+type testOffersApp struct{ offers ConnegOffers }
+
+func (a testOffersApp) GetOffers() ConnegOffers { return a.offers }
+
+func TestOffersFrom(t *testing.T) {
+	app := testOffersApp{ConnegOffers{Types: []string{"text/html;q=0.5", "text/turtle"}, Languages: []string{"en", "de"}}}
+	m := MatchConneg{OffersFrom: "test_offers", MatchTypes: []string{"text/html"}, MatchLanguages: []string{"de"}, VarType: "type"}
+	m.logger = zap.NewNop()
+	// the app is looked up in Provision, which the test context cannot do
+	if err := m.offersFrom(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.provision(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"text/turtle", "text/html"}; !reflect.DeepEqual(m.MatchTypes, expected) {
+		t.Errorf("Expected types %v, got %v", expected, m.MatchTypes)
+	}
+	if expected := []string{"en", "de"}; !reflect.DeepEqual(m.MatchLanguages, expected) {
+		t.Errorf("Expected languages %v, got %v", expected, m.MatchLanguages)
+	}
+	// the matcher's own text/html keeps its quality of 1
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html, text/turtle;q=0.9", "Accept-Language": "de"})
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "text/html" {
+		t.Errorf("Expected text/html, got %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+
+	other := MatchConneg{OffersFrom: "test_offers"}
+	if err := other.offersFrom(struct{}{}); err == nil {
+		t.Error("Taking offers from an app that does not provide any should fail")
+	}
+}
+
+func TestPrioritizeOffer(t *testing.T) {
+	headers := map[string]string{"Accept": "text/plain;q=1.0, text/html;q=0.5"}
+	for prioritize, expected := range map[bool]string{false: "text/plain", true: "text/html"} {
+		m := MatchConneg{MatchTypes: []string{"text/html", "text/plain"}, VarType: "type", PrioritizeOffer: prioritize}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", headers)
+		if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != expected {
+			t.Errorf("prioritize_offer %v: expected %s, got %v", prioritize, expected, caddyhttp.GetVar(r.Context(), "conneg_type"))
+		}
+		m.Cleanup()
+	}
+
+	m := MatchConneg{MatchTypes: []string{"text/html", "text/plain"}, VarType: "type", PrioritizeOffer: true}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for accept, expected := range map[string]string{
+		"text/plain, text/html;q=0.001": "text/html",
+		"text/plain, text/html;q=0":     "text/plain",
+		"text/*;q=0.1, text/plain":      "text/html",
+		"application/json":              "",
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept})
+		if m.Match(r) != (expected != "") || (expected != "" && caddyhttp.GetVar(r.Context(), "conneg_type") != expected) {
+			t.Errorf("%s: expected %q, got %v", accept, expected, caddyhttp.GetVar(r.Context(), "conneg_type"))
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html"}, RegistryKey: "html"}
+	provisionConneg(t, &m)
+	if v, ok := Registry.Load("html"); !ok || v != &m {
+		t.Fatal("Provisioned matcher should be registered under its registry key")
+	}
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Registry.Load("html"); ok {
+		t.Fatal("Cleaned up matcher should not be registered anymore")
+	}
+
+	anon := MatchConneg{MatchTypes: []string{"text/html"}}
+	provisionConneg(t, &anon)
+	if v, ok := Registry.Load(anon.registryKey); !ok || v != &anon {
+		t.Fatal("Matcher without registry key should be registered under a derived key")
+	}
+	anon.Cleanup()
+}
+
+func TestMatchAfterCleanup(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html"}, MatchLanguages: []string{"en"}}
+	provisionConneg(t, &m)
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if m.LanguageMatcher != nil || m.logger != nil {
+		t.Error("Cleanup should release the language matcher and the logger")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Match should panic after Cleanup")
+		}
+	}()
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "en"}))
+}
+
+func TestProvisionAgain(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html", "application/json"},
+		MatchLanguages: []string{"en"},
+		MatchCharsets:  []string{"utf-8"},
+		MatchEncodings: []string{"gzip"},
+		ChainedMatcher: []json.RawMessage{json.RawMessage(`{"conneg_test_path":{"prefixes":["/api/"]}}`)},
+	}
+	provisionConneg(t, &m)
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if err := m.HealthCheck(); err != nil {
+		t.Errorf("Matcher provisioned again should be healthy: %v", err)
+	}
+	if len(m.MatchTTypes) != 2 || len(m.MatchTLanguages) != 2 || len(m.MatchTCharsets) != 1 || len(m.MatchTEncodings) != 1 {
+		t.Errorf("Offers should be parsed once, got %v %v %v %v", m.MatchTTypes, m.MatchTLanguages, m.MatchTCharsets, m.MatchTEncodings)
+	}
+	if len(m.chainedMatchers) != 1 {
+		t.Errorf("Chained matchers should be loaded once, got %d", len(m.chainedMatchers))
+	}
+
+	// without Cleanup in between
+	provisionConneg(t, &m)
+	if len(m.MatchTTypes) != 2 || len(m.chainedMatchers) != 1 {
+		t.Errorf("Provisioning twice should not add to the offers, got %v and %d chained matchers", m.MatchTTypes, len(m.chainedMatchers))
+	}
+}
+
+func TestClientWildcardCharsetOrEncoding(t *testing.T) {
+	offers := func(values ...string) []CharsetOrEncoding {
+		var result []CharsetOrEncoding
+		for _, v := range values {
+			result = append(result, CharsetOrEncoding{Value: v})
+		}
+		return result
+	}
+	tests := []struct {
+		header   string
+		offers   []CharsetOrEncoding
+		expected string
+	}{
+		{"*", offers("utf-8"), "utf-8"},
+		{"*", offers("gzip", "br"), "gzip"},
+		{"*;q=0.5, gzip;q=1.0", offers("br", "gzip"), "gzip"},
+		{"*;q=0.5, gzip;q=1.0", offers("br"), "br"},
+		{"*, utf-8;q=0", offers("utf-8"), ""},
+		{"*, utf-8;q=0", offers("utf-8", "iso-8859-1"), "iso-8859-1"},
+	}
+	for _, test := range tests {
+		result, _, err := getAcceptableCharsetOrEncodingFromHeader(test.header, test.offers)
+		if result.Value != test.expected {
+			t.Fatalf("Header %q against %v: expected %q, got %q (%v)", test.header, test.offers, test.expected, result.Value, err)
+		}
+	}
+
+	m := MatchConneg{MatchCharsets: []string{"utf-8"}, MatchEncodings: []string{"gzip", "br"}, VarEncoding: "enc"}
+	provisionConneg(t, &m)
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept-Charset": "*", "Accept-Encoding": "*"})
+	if !m.Match(r) {
+		t.Fatal("Accept-Charset: * and Accept-Encoding: * should match any offer")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_enc"); v != "gzip" {
+		t.Fatalf("Expected conneg_enc \"gzip\", got %v", v)
+	}
+}
+
+func TestMaxOfferListSize(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html", "text/plain", "application/json"}, MaxOfferListSize: 2}
+	if err := m.Validate(); err == nil {
+		t.Fatal("Offer list longer than max_offer_list_size should not validate")
+	}
+	m.MaxOfferListSize = 3
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Offer list within max_offer_list_size should validate, got %v", err)
+	}
+	m.MaxOfferListSize = 0
+	if err := m.Validate(); err != nil {
+		t.Fatalf("max_offer_list_size 0 should mean unlimited, got %v", err)
+	}
+	if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n max_offer_list_size\n 5\n}")); err == nil {
+		t.Error("max_offer_list_size without a value should be rejected")
+	}
+}
+
+func TestMarshalCaddyfileRoundTrip(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:               []string{"text/html", "application/json"},
+		MatchLanguages:           []string{"de", "en"},
+		MatchCharsets:            []string{"utf-8"},
+		MatchEncodings:           []string{"br", "gzip"},
+		MatchContentTypes:        []string{"application/json"},
+		ForceTypeQueryString:     "format",
+		ForcePriority:            []ForceMechanism{{Source: "header", Key: "X-Format"}, {Source: "extension"}},
+		ForceLanguageQueryString: "lang",
+		ForceCharsetQueryString:  "charset",
+		ForceEncodingQueryString: "enc",
+		VarType:                  "type",
+		VarLanguage:              "lang",
+		VarCharset:               "charset",
+		VarEncoding:              "enc",
+		VarContentType:           "body",
+		Reflect:                  true,
+		UpstreamMap:              map[string]string{"application/json": "localhost:8081", "text/html": "localhost:8080"},
+		DynamicUpstreamVar:       "upstream",
+		VarTypeBase:              "type_base",
+		VarTypeType:              "type_type",
+		VarTypeSubtype:           "type_subtype",
+		MatchProfiles:            map[string][]string{"application/ld+json": {"http://schema.org/", "https://www.w3.org/ns/activitystreams"}},
+		VarProfile:               "profile",
+		PostAuthMode:             true,
+		ZeroQRejectsAll:          true,
+		CoordinateWithEncode:     true,
+		AdvertiseAcceptPatch:     true,
+		RespondToOptions:         true,
+		AuthContextKey:           "http.auth.user.plan",
+		AuthExtendedOffers:       map[string][]string{"premium": {"application/ld+json", "text/turtle"}},
+		MultipartFallback:        true,
+		RegistryKey:              "my matcher",
+		TelemetryKey:             "span",
+		MaxOfferListSize:         10,
+		ImplicitUTF8:             new(bool),
+		LanguageDisplayFormat:    "iso639_1",
+		ETagVar:                  "etag",
+		ETagSalt:                 "s3cr3t",
+
+		Inherit:                    "base",
+		OffersFrom:                 "offers",
+		TypeQualities:              map[string]float64{"application/json": 0.9},
+		AllowedMethods:             []string{"GET", "HEAD"},
+		AssertMethod:               "GET",
+		RequireAtLeastOneHeader:    true,
+		InvertMatch:                true,
+		ForceCookieType:            "format",
+		RememberNegotiationCookie:  true,
+		RememberMaxAge:             600,
+		ForceTypeAcceptReplace:     true,
+		ForceLanguageAcceptReplace: true,
+		RemoveForceParam:           true,
+		NormalizeQueryParam:        true,
+		DisableBuiltinAliases:      true,
+		ForceQueryParamMultiValue:  "last",
+		LocaleAlias:                map[string]string{"en_US": "en-US", "english": "en"},
+		DefaultTypeOnEmpty:         "text/html",
+		MIMEParamWhitelist:         []string{"charset"},
+		MultipleTypeVars:           true,
+		MaxTypeVars:                3,
+		DefaultLanguageOnEmpty:     "en",
+		GeoLanguage:                true,
+		GeoDatabase:                "/var/lib/GeoLite2-Country.mmdb",
+		GeoTrustedProxies:          []string{"10.0.0.0/8", "fd00::/8"},
+		DefaultCharsetOnEmpty:      "utf-8",
+		DefaultEncodingOnEmpty:     "identity",
+		VarMatchCount:              "match_count",
+		VarNegotiatedAll:           "all",
+		VarNegotiatedAllDelimiter:  "|",
+		VarForceUsed:               "force_used",
+		ScoreVar:                   "score",
+		ScoreAggregation:           "minimum",
+		TTLVar:                     "ttl",
+		BaseTTL:                    600,
+		ExtractCharsetFromType:     true,
+		VarLanguageConfidence:      "language_confidence",
+		VarExtension:               "ext",
+		MatchAPIVersions:           []string{"1", "2"},
+		VarAPIVersion:              "api_version",
+		TemporalHeaderName:         "X-API-Version-Date",
+		TemporalFormat:             "2006-01-02T15:04",
+		BeforeDate:                 "2025-01-01T00:00",
+		AfterDate:                  "2020-01-01T00:00",
+		VarTemporalDate:            "date",
+		GracefulDegradation:        []string{"language", "encoding"},
+		CompressionAware:           true,
+		AlreadyCompressedTypes:     []string{"image/jpeg", "application/zip"},
+		EncodingFallbackToIdentity: true,
+		PrioritizeOffer:            true,
+		UseClientHints:             true,
+		WildcardDefault:            "application/json",
+		MatchInboundContentType:    true,
+		NoteHeader:                 true,
+		LogFields:                  true,
+		ContentNegotiationLog:      "/var/log/conneg.log",
+		ContentNegotiationLogMaxMB: 10,
+		ExampleComment:             "application/json request",
+		ExposeAdmin:                true,
+		HistorySize:                50,
+		SameOriginLanguage:         true,
+		AllowedOriginDomains:       []string{"example.com", "example.org"},
+		Hooks:                      []json.RawMessage{json.RawMessage(`{"hook":"log"}`)},
+		BackwardsCompatibilityMode: true,
+		OfferListVersion:           "v2",
+		SourceTag:                  "main",
+	}
+	out, err := m.MarshalCaddyfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed MatchConneg
+	if err := parsed.UnmarshalCaddyfile(caddyfile.NewTestDispenser(out)); err != nil {
+		t.Fatalf("Unmarshaling %q failed: %v", out, err)
+	}
+	if !reflect.DeepEqual(m, parsed) {
+		t.Fatalf("Round trip through\n%s\nchanged the matcher: expected %+v, got %+v", out, m, parsed)
+	}
+}
+
+func TestImplicitUTF8(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		implicit *bool
+		header   string
+		expected bool
+	}{
+		{nil, "", true},
+		{&disabled, "", false},
+		{nil, "iso-8859-1", false},
+		{nil, "iso-8859-1, utf-8", true},
+	}
+	for _, test := range tests {
+		m := MatchConneg{MatchCharsets: []string{"UTF-8"}, VarCharset: "charset", ImplicitUTF8: test.implicit}
+		provisionConneg(t, &m)
+		headers := map[string]string{}
+		if test.header != "" {
+			headers["Accept-Charset"] = test.header
+		}
+		r := newConnegRequest(t, "http://foo.com", headers)
+		if got := m.Match(r); got != test.expected {
+			t.Fatalf("Accept-Charset %q (implicit_utf8 %v): expected match %v, got %v", test.header, test.implicit, test.expected, got)
+		}
+		if test.header == "" && test.expected {
+			if v := caddyhttp.GetVar(r.Context(), "conneg_charset"); v != "UTF-8" {
+				t.Fatalf("Expected conneg_charset \"UTF-8\", got %v", v)
+			}
+		}
+	}
 }
 
-func TestDefault_NoOrigin(t *testing.T) {
-	w, r := getReq("OPTIONS")
-	Default().HandleRequest(w, r)
-	if w.Header().Get(allowOriginKey) != "" {
-		t.Fatal("Should not have origin header when no origin passed in")
+func TestBackwardsCompatibilityMode(t *testing.T) {
+	enabled := true
+	tests := []struct {
+		compatible bool
+		implicit   *bool
+		header     string
+		expected   bool
+	}{
+		{false, nil, "utf-8", true},
+		{true, nil, "utf-8", false},
+		{true, nil, "UTF-8", false},
+		{true, nil, "*", true},
+		{true, nil, "", false},
+		{true, &enabled, "", true},
+	}
+	for _, test := range tests {
+		m := MatchConneg{MatchCharsets: []string{"UTF-8"}, ImplicitUTF8: test.implicit, BackwardsCompatibilityMode: test.compatible}
+		provisionConneg(t, &m)
+		headers := map[string]string{}
+		if test.header != "" {
+			headers["Accept-Charset"] = test.header
+		}
+		if got := m.Match(newConnegRequest(t, "http://foo.com", headers)); got != test.expected {
+			t.Errorf("Accept-Charset %q (backwards_compatibility_mode %v, implicit_utf8 %v): expected match %v, got %v", test.header, test.compatible, test.implicit, test.expected, got)
+		}
+		if test.compatible && len(m.warnings) == 0 {
+			t.Error("backwards_compatibility_mode should be warned about")
+		}
 	}
 }
 
-func TestDefault_Origin_Supplied(t *testing.T) {
-	w, r := getReq("OPTIONS")
-	r.Header.Set(originKey, "http://bar.com")
-	Default().HandleRequest(w, r)
-	if w.Header().Get(allowOriginKey) != "*" {
-		t.Fatalf("Expect origin of \"*\". Got \"%s\".", w.Header().Get(allowOriginKey))
+func TestLanguageDisplayFormat(t *testing.T) {
+	tests := map[string]string{
+		"":               "de-AT",
+		"bcp47":          "de-AT",
+		"ietf":           "de-AT",
+		"display_en":     "Austrian German",
+		"display_native": "Österreichisches Deutsch",
+		"iso639_1":       "de",
 	}
-	if w.Header().Get(varyKey) != "Origin" {
-		t.Fatal("Must include Vary:Origin if allow origin header set to specific domain.")
+	for format, expected := range tests {
+		m := MatchConneg{MatchLanguages: []string{"en", "de-AT"}, VarLanguage: "lang", LanguageDisplayFormat: format}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept-Language": "de-AT, en;q=0.5"})
+		if !m.Match(r) {
+			t.Fatalf("Format %q: expected a match", format)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_lang"); v != expected {
+			t.Fatalf("Format %q: expected conneg_lang %q, got %v", format, expected, v)
+		}
+	}
+
+	m := MatchConneg{MatchLanguages: []string{"en"}, LanguageDisplayFormat: "klingon"}
+	if err := m.Validate(); err == nil {
+		t.Fatal("Unknown language_display_format should not validate")
 	}
 }
 
-func TestDefault_Dissallowed_Origin(t *testing.T) {
-	w, r := getReq("OPTIONS")
-	r.Header.Set(originKey, "http://bar.com")
-	c := Default()
-	c.AllowedOrigins = []string{"http://blog.bar.com"}
-	c.HandleRequest(w, r)
-	if w.Header().Get(allowOriginKey) != "" {
-		t.Fatal("Should not have origin header when no origin not explicitely allowed")
+func TestETagVar(t *testing.T) {
+	etag := func(salt, accept string) string {
+		m := MatchConneg{MatchTypes: []string{"text/html", "application/json"}, ETagVar: "etag", ETagSalt: salt}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept})
+		if !m.Match(r) {
+			t.Fatalf("Accept %q should match", accept)
+		}
+		v, _ := caddyhttp.GetVar(r.Context(), "conneg_etag").(string)
+		if len(v) != 8 {
+			t.Fatalf("Expected an 8 digit hex hash, got %q", v)
+		}
+		return v
+	}
+	if etag("", "text/html") != etag("", "text/html") {
+		t.Fatal("Same negotiation result should give the same hash")
+	}
+	if etag("", "text/html") == etag("", "application/json") {
+		t.Fatal("Different representations should give different hashes")
+	}
+	if etag("", "text/html") == etag("salt", "text/html") {
+		t.Fatal("Salt should change the hash")
 	}
 }
 
-func TestDefault_Allowed_Origin_By_Regexp(t *testing.T) {
-	c := Default()
-	c.AllowedOrigins = []string{}
-	c.OriginRegexps = []*regexp.Regexp{
-		regexp.MustCompile(".+\\.example\\.com$"),
-		regexp.MustCompile("^http\\:\\/\\/(.+)\\.other\\.org$"),
+func TestEqual(t *testing.T) {
+	a := &MatchConneg{MatchTypes: []string{"text/html", "application/json"}, VarType: "type", MultipartFallback: true}
+	b := &MatchConneg{MatchTypes: []string{"text/html", "application/json"}, VarType: "type", MultipartFallback: true}
+	if !a.Equal(b) {
+		t.Fatal("Matchers with the same configuration should be equal")
+	}
+	provisionConneg(t, b)
+	defer b.Cleanup()
+	if !a.Equal(b) {
+		t.Fatal("Provisioned fields should not be compared")
+	}
+	c := &MatchConneg{MatchTypes: []string{"application/json", "text/html"}, VarType: "type", MultipartFallback: true}
+	if a.Equal(c) {
+		t.Fatal("Offer lists should be compared in order")
+	}
+	d := &MatchConneg{MatchTypes: []string{"text/html", "application/json"}, VarType: "type"}
+	if a.Equal(d) {
+		t.Fatal("Boolean fields should be compared")
 	}
+	if a.Equal(nil) {
+		t.Fatal("A matcher should not equal nil")
+	}
+}
 
-	allowedOrigins := []string{"http://foo.example.com", "http://bar.other.org"}
+func TestMatchContentTypes(t *testing.T) {
+	m := MatchConneg{MatchContentTypes: []string{"application/json", "text/*", "application/xml;charset=utf-8"}, VarContentType: "body"}
+	provisionConneg(t, &m)
+	tests := map[string]string{
+		"application/json":                "application/json",
+		"application/json; charset=utf-8": "application/json",
+		"text/turtle":                     "text/turtle",
+		"application/xml; charset=UTF-8":  "application/xml",
+		"application/xml":                 "",
+		"image/png":                       "",
+		"":                                "",
+	}
+	for header, expected := range tests {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Content-Type": header})
+		if header == "" {
+			r.Header.Del("Content-Type")
+		}
+		if got := m.Match(r); got != (expected != "") {
+			t.Fatalf("Content-Type %q: expected match %v, got %v", header, expected != "", got)
+		}
+		if expected != "" {
+			if v := caddyhttp.GetVar(r.Context(), "conneg_body"); v != expected {
+				t.Fatalf("Content-Type %q: expected conneg_body %q, got %v", header, expected, v)
+			}
+		}
+	}
+}
 
-	for _, origin := range allowedOrigins {
-		w, r := getReq("OPTIONS")
-		r.Header.Set(originKey, origin)
-		c.HandleRequest(w, r)
-		if w.Header().Get(allowOriginKey) != origin {
-			t.Fatal("Should have origin header with the request origin when the regexp matches")
+func TestMatchInboundContentType(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:              []string{"text/turtle", "application/ld+json"},
+		MatchInboundContentType: true,
+		VarContentType:          "body",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for contentType, expected := range map[string]string{
+		"text/turtle":                        "text/turtle",
+		"application/ld+json; charset=utf-8": "application/ld+json",
+		"application/json":                   "",
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "*/*", "Content-Type": contentType})
+		r.Method = http.MethodPut
+		if got := m.Match(r); got != (expected != "") {
+			t.Fatalf("PUT with Content-Type %q: expected match %v, got %v", contentType, expected != "", got)
 		}
+		if expected != "" {
+			if v := caddyhttp.GetVar(r.Context(), "conneg_body"); v != expected {
+				t.Fatalf("PUT with Content-Type %q: expected conneg_body %q, got %v", contentType, expected, v)
+			}
+		}
+	}
+	if !m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/turtle"})) {
+		t.Fatal("Requests without a body should not be checked")
 	}
 
+	m = MatchConneg{MatchLanguages: []string{"en"}, MatchInboundContentType: true}
+	if err := m.Validate(); err == nil {
+		t.Fatal("match_inbound_content_type without match_types should be rejected")
+	}
+}
+
+func TestProvisionLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	m := MatchConneg{
+		MatchTypes:           []string{"text/html", "application/json", "text/plain", "text/turtle", "application/ld+json", "application/rdf+xml"},
+		MatchLanguages:       []string{"de", "en"},
+		ForceTypeQueryString: "format",
+	}
+	m.MustProvisionWithLogger(zap.New(core))
+	defer m.Cleanup()
+	entries := logs.FilterMessage("conneg provisioned").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one provisioning log entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["types"] != int64(6) || fields["languages"] != int64(2) || fields["charsets"] != int64(0) {
+		t.Fatalf("Unexpected offer counts in %v", fields)
+	}
+	if first, ok := fields["first_types"].([]interface{}); !ok || len(first) != 5 || first[0] != "text/html" {
+		t.Fatalf("Expected the first 5 types to be logged, got %v", fields["first_types"])
+	}
+	if fields["aliases"] != int64(len(aliases)) {
+		t.Fatalf("Expected alias count %d, got %v", len(aliases), fields["aliases"])
+	}
+	if fields["force_type_query_string"] != "format" {
+		t.Fatalf("Expected force_type_query_string \"format\", got %v", fields["force_type_query_string"])
+	}
 }
 
-func TestDefault_Methods(t *testing.T) {
-	w, r := getReq("OPTIONS")
-	r.Header.Set(originKey, "http://bar.com")
-	c := Default()
-	c.HandleRequest(w, r)
-	if w.Header().Get(allowMethodsKey) != "POST, GET, OPTIONS, PUT, DELETE" {
-		t.Fatal("Allow methods should be set")
+func TestSourceTag(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	m := MatchConneg{MatchTypes: []string{"text/html"}, SourceTag: "main-api-v2", LogFields: true}
+	m.MustProvisionWithLogger(zap.New(core))
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"})
+	if result := m.MatchWithResult(r); result.SourceTag != "main-api-v2" {
+		t.Errorf("Expected the result to carry the source tag, got %+v", result)
+	}
+	for _, message := range []string{"conneg provisioned", "conneg negotiated"} {
+		entries := logs.FilterMessage(message).All()
+		if len(entries) != 1 || entries[0].ContextMap()["source_tag"] != "main-api-v2" {
+			t.Errorf("Expected the %q entry to carry the source tag, got %v", message, entries)
+		}
 	}
 }
 
-func TestDefault_AllowAllHeaders(t *testing.T) {
-	w, r := getReq("OPTIONS")
-	c := Default()
-	c.AllowedHeaders = "*"
-	reqHeaders := "Bar, Foo, X-Yz"
-	r.Header.Set(originKey, "http://bar.com")
-	r.Header.Set(requestHeadersKey, reqHeaders)
-	c.HandleRequest(w, r)
-	if w.Header().Get(allowHeadersKey) != reqHeaders {
-		t.Fatal("If AllowedHeaders is *, it should copy the value of requestHeadersKey to allowHeadersKey")
+func TestLogFields(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html", "application/json"},
+		MatchLanguages: []string{"de", "en"},
+		LogFields:      true,
+	}
+	m.MustProvisionWithLogger(zap.New(core))
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com/doc", map[string]string{"Accept": "application/json", "Accept-Language": "en"})
+	r.RequestURI = "/doc"
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	entries := logs.FilterMessage("conneg negotiated").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one negotiation log entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	for key, want := range map[string]interface{}{
+		"uri":             "/doc",
+		"match":           true,
+		"conneg_type":     "application/json",
+		"conneg_language": "en",
+	} {
+		if fields[key] != want {
+			t.Errorf("Expected %s %v, got %v", key, want, fields[key])
+		}
+	}
+	if _, ok := fields["conneg_charset"]; ok {
+		t.Errorf("Dimensions without offers should not be logged, got %v", fields)
+	}
+
+	m.LogFields = false
+	m.Match(newConnegRequest(t, "http://foo.com/doc", map[string]string{"Accept": "text/html"}))
+	if n := logs.FilterMessage("conneg negotiated").Len(); n != 1 {
+		t.Errorf("Expected no more log entries without log_fields, got %d", n)
+	}
+}
+
+func TestReflect(t *testing.T) {
+	var m MatchConneg
+	d := caddyfile.NewTestDispenser(`conneg {
+		match_types application/json application/ld+json
+		reflect true
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json", "Content-Type": "application/json"})
+	if !m.Match(r) {
+		t.Fatal("With reflect, offered types should also be accepted as request body types")
+	}
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json", "Content-Type": "text/turtle"})
+	if m.Match(r) {
+		t.Fatal("With reflect, request body types that are not offered should not match")
+	}
+
+	m = MatchConneg{MatchContentTypes: []string{"application/json"}, Reflect: true}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if !reflect.DeepEqual(m.matchTypes, []string{"application/json"}) {
+		t.Fatalf("With reflect, accepted body types should also be offered, got %v", m.matchTypes)
+	}
+}
+
+func TestSparqlFormats(t *testing.T) {
+	var m MatchConneg
+	d := caddyfile.NewTestDispenser(`conneg {
+		preset sparql
+		force_type_query_string format
+		var_type type
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.MatchTypes) != 4 {
+		t.Fatalf("Expected the sparql preset to offer 4 types, got %v", m.MatchTypes)
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := map[string]string{
+		"srj":         "application/sparql-results+json",
+		"sparql-json": "application/sparql-results+json",
+		"srx":         "application/sparql-results+xml",
+		"sparql-xml":  "application/sparql-results+xml",
+		"tsv":         "text/tab-separated-values",
+	}
+	for alias, expected := range tests {
+		r := newConnegRequest(t, "http://foo.com/sparql?format="+alias, nil)
+		if !m.Match(r) {
+			t.Fatalf("?format=%s should match", alias)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != expected {
+			t.Fatalf("?format=%s: expected conneg_type %q, got %v", alias, expected, v)
+		}
+	}
+
+	if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n preset nope\n}")); err == nil {
+		t.Fatal("Unknown preset should be rejected")
+	}
+}
+
+func TestJSONSchemaFormats(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:           []string{"application/json", "application/schema+json", "application/json-patch+json", "application/merge-patch+json"},
+		ForceTypeQueryString: "format",
+		VarType:              "type",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := map[string]string{
+		"schema":      "application/schema+json",
+		"json-schema": "application/schema+json",
+		"json-patch":  "application/json-patch+json",
+		"merge-patch": "application/merge-patch+json",
+	}
+	for alias, expected := range tests {
+		r := newConnegRequest(t, "http://foo.com/api?format="+alias, map[string]string{"Accept": "application/json"})
+		if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != expected {
+			t.Errorf("?format=%s: expected conneg_type %q, got %v", alias, expected, caddyhttp.GetVar(r.Context(), "conneg_type"))
+		}
+	}
+	r := newConnegRequest(t, "http://foo.com/api", map[string]string{"Accept": "application/json-patch+json, application/json;q=0.5"})
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "application/json-patch+json" {
+		t.Errorf("Expected application/json-patch+json, got %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+}
+
+func TestInlineCaddyfile(t *testing.T) {
+	tests := []struct {
+		inline string
+		block  string
+	}{
+		{"conneg text/html", "conneg {\n match_types text/html\n}"},
+		{"conneg text/html application/json", "conneg {\n match_types text/html application/json\n}"},
+		{
+			"conneg text/html application/json with var_type type force_type_query_string format match_languages en match_languages de multipart_fallback true",
+			"conneg {\n match_types text/html application/json\n var_type type\n force_type_query_string format\n match_languages en de\n multipart_fallback\n}",
+		},
+		{"conneg with match_languages en", "conneg {\n match_languages en\n}"},
+		{"conneg text/html {\n var_type type\n}", "conneg {\n match_types text/html\n var_type type\n}"},
+	}
+	for _, test := range tests {
+		inline, block := MatchConneg{}, MatchConneg{}
+		if err := inline.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.inline)); err != nil {
+			t.Fatalf("%q: %v", test.inline, err)
+		}
+		if err := block.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.block)); err != nil {
+			t.Fatalf("%q: %v", test.block, err)
+		}
+		if !reflect.DeepEqual(inline, block) {
+			t.Errorf("%q: expected %+v, got %+v", test.inline, block, inline)
+		}
+	}
+
+	for _, input := range []string{"conneg text/html with", "conneg text/html with var_type", "conneg with preset nope"} {
+		if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%q should be rejected", input)
+		}
+	}
+}
+
+func TestOfferContinuationLines(t *testing.T) {
+	expected := MatchConneg{
+		MatchTypes:     []string{"text/html", "application/json", "application/ld+json"},
+		MatchLanguages: []string{"en", "de", "fr"},
+		VarType:        "type",
+	}
+	for _, input := range []string{
+		"conneg {\n match_types text/html \\\n application/json \\\n application/ld+json\n match_languages en de \\\n fr\n var_type type\n}",
+		"conneg {\n match_types text/html\n + application/json\n +application/ld+json\n match_languages en\n + de fr\n var_type type\n}",
+	} {
+		var m MatchConneg
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("%q: expected %+v, got %+v", input, expected, m)
+		}
+	}
+}
+
+func TestDynamicUpstreamVar(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:         []string{"text/html", "application/json", "text/plain"},
+		UpstreamMap:        map[string]string{"text/html": "html-backend:8080", "application/json": "api-backend:8081"},
+		DynamicUpstreamVar: "upstream",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := map[string]interface{}{
+		"application/json": "api-backend:8081",
+		"text/html":        "html-backend:8080",
+		"text/plain":       nil,
+	}
+	for accept, expected := range tests {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept})
+		if !m.Match(r) {
+			t.Fatalf("Accept %q should match", accept)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_upstream"); v != expected {
+			t.Fatalf("Accept %q: expected conneg_upstream %v, got %v", accept, expected, v)
+		}
+	}
+
+	m = MatchConneg{MatchTypes: []string{"text/html"}, DynamicUpstreamVar: "upstream"}
+	if err := m.Validate(); err == nil {
+		t.Fatal("dynamic_upstream_var without upstreams should not validate")
+	}
+}
+
+func TestPostAuthMode(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:         []string{"text/html"},
+		VarType:            "type",
+		PostAuthMode:       true,
+		AuthContextKey:     "http.auth.user.plan",
+		AuthExtendedOffers: map[string][]string{"premium": {"application/json"}},
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	withPlan := func(r *http.Request, plan string) *http.Request {
+		repl := caddy.NewReplacer()
+		if plan != "" {
+			repl.Set("http.auth.user.plan", plan)
+		}
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+	accept := map[string]string{"Accept": "application/json"}
+	if m.Match(withPlan(newConnegRequest(t, "http://foo.com", accept), "")) {
+		t.Fatal("Unauthenticated request should not match an extended type")
+	}
+	if m.Match(withPlan(newConnegRequest(t, "http://foo.com", accept), "basic")) {
+		t.Fatal("Request with a claim without extended offers should not match an extended type")
+	}
+	r := withPlan(newConnegRequest(t, "http://foo.com", accept), "premium")
+	if !m.Match(r) {
+		t.Fatal("Request with a premium claim should match an extended type")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != "application/json" {
+		t.Fatalf("Expected conneg_type \"application/json\", got %v", v)
+	}
+	if !m.Match(withPlan(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"}), "")) {
+		t.Fatal("Public offers should match without authentication")
+	}
+}
+
+func TestVarTypeComponents(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html;charset=UTF-8"},
+		VarType:        "type",
+		VarTypeBase:    "type_base",
+		VarTypeType:    "type_type",
+		VarTypeSubtype: "type_subtype",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	for name, want := range map[string]string{
+		"conneg_type_base":    "text/html",
+		"conneg_type_type":    "text",
+		"conneg_type_subtype": "html",
+	} {
+		if v := caddyhttp.GetVar(r.Context(), name); v != want {
+			t.Errorf("Expected %s %q, got %v", name, want, v)
+		}
+	}
+}
+
+func TestVarExtension(t *testing.T) {
+	for mimeType, want := range mimeToExtension {
+		m := MatchConneg{MatchTypes: []string{mimeType}, VarExtension: "ext"}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": mimeType})
+		if !m.Match(r) {
+			t.Fatalf("Request for %s should match", mimeType)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_ext"); v != want {
+			t.Errorf("Expected extension %q for %s, got %v", want, mimeType, v)
+		}
+		m.Cleanup()
+	}
+
+	// not built in, but known to the mime package
+	m := MatchConneg{MatchTypes: []string{"image/png", "application/x-unknown"}, VarExtension: "ext"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "image/png"})
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_ext") != ".png" {
+		t.Errorf("Expected extension .png from the mime package, got %v", caddyhttp.GetVar(r.Context(), "conneg_ext"))
+	}
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/x-unknown"})
+	if !m.Match(r) {
+		t.Fatal("Request for unknown type should match")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_ext"); v != nil {
+		t.Errorf("Expected no extension for unknown type, got %v", v)
+	}
+}
+
+func TestMIMEParamWhitelist(t *testing.T) {
+	tests := []struct {
+		whitelist []string
+		expected  string
+	}{
+		{[]string{"charset"}, "text/html;charset=utf-8"},
+		{[]string{"level", "Charset"}, "text/html;level=1;charset=utf-8"},
+		{[]string{"profile"}, "text/html"},
+	}
+	for _, test := range tests {
+		m := MatchConneg{MatchTypes: []string{"text/html;charset=utf-8;level=1"}, VarType: "type", MIMEParamWhitelist: test.whitelist}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"})
+		if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != test.expected {
+			t.Errorf("mime_param_whitelist %v: expected %s, got %v", test.whitelist, test.expected, caddyhttp.GetVar(r.Context(), "conneg_type"))
+		}
+		m.Cleanup()
+	}
+}
+
+func TestVarMatchCount(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html"},
+		MatchLanguages: []string{"en"},
+		MatchEncodings: []string{"gzip"},
+		VarMatchCount:  "match_count",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := []struct {
+		headers map[string]string
+		match   bool
+		count   string
+	}{
+		{map[string]string{"Accept": "text/html", "Accept-Language": "en", "Accept-Encoding": "gzip"}, true, "3"},
+		{map[string]string{"Accept": "text/html", "Accept-Language": "fr", "Accept-Encoding": "gzip"}, false, "2"},
+		{map[string]string{"Accept": "application/json", "Accept-Language": "fr", "Accept-Encoding": "gzip"}, false, "1"},
+		{map[string]string{"Accept": "application/json", "Accept-Language": "fr", "Accept-Encoding": "br"}, false, "0"},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://foo.com", test.headers)
+		if m.Match(r) != test.match {
+			t.Errorf("%v: expected match %v", test.headers, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_match_count"); v != test.count {
+			t.Errorf("%v: expected match count %q, got %v", test.headers, test.count, v)
+		}
+	}
+}
+
+func TestVarNegotiatedAll(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:       []string{"text/html"},
+		MatchLanguages:   []string{"en"},
+		MatchEncodings:   []string{"gzip"},
+		VarNegotiatedAll: "all",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "en", "Accept-Encoding": "gzip"})
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_all") != "text/html:en:*:gzip" {
+		t.Errorf("Expected text/html:en:*:gzip, got %v", caddyhttp.GetVar(r.Context(), "conneg_all"))
+	}
+
+	m.VarNegotiatedAllDelimiter = "|"
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "fr", "Accept-Encoding": "gzip"})
+	if m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_all") != "text/html|*|*|gzip" {
+		t.Errorf("Expected text/html|*|*|gzip, got %v", caddyhttp.GetVar(r.Context(), "conneg_all"))
+	}
+}
+
+func TestVarForceUsed(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:               []string{"text/html", "application/rdf+xml"},
+		MatchLanguages:           []string{"en", "de"},
+		ForceTypeQueryString:     "format",
+		ForcePriority:            []ForceMechanism{{Source: "header", Key: "X-Format"}},
+		ForceLanguageQueryString: "lang",
+		VarForceUsed:             "force_used",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := []struct {
+		query   string
+		headers map[string]string
+		used    string
+	}{
+		{"", map[string]string{"Accept": "text/html", "Accept-Language": "en"}, "0"},
+		{"?format=rdf", map[string]string{"Accept": "text/html", "Accept-Language": "en"}, "1"},
+		{"?lang=de", map[string]string{"Accept": "text/html", "Accept-Language": "en"}, "1"},
+		{"", map[string]string{"Accept": "text/html", "Accept-Language": "en", "X-Format": "rdf"}, "1"},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://foo.com/"+test.query, test.headers)
+		if !m.Match(r) {
+			t.Errorf("%s %v: expected a match", test.query, test.headers)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_force_used"); v != test.used {
+			t.Errorf("%s %v: expected conneg_force_used %s, got %v", test.query, test.headers, test.used, v)
+		}
+	}
+}
+
+func TestDisableBuiltinAliases(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:            []string{"text/html", "application/xml"},
+		ForceTypeQueryString:  "format",
+		VarType:               "type",
+		DisableBuiltinAliases: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	headers := map[string]string{"Accept": "application/xml"}
+	if r := newConnegRequest(t, "http://foo.com/?format=html", headers); m.Match(r) {
+		t.Errorf("Built-in alias should not resolve, got %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+	r := newConnegRequest(t, "http://foo.com/?format=text/html", headers)
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "text/html" {
+		t.Errorf("Expected the offered type to be forced, got %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+
+	m.DisableBuiltinAliases = false
+	r = newConnegRequest(t, "http://foo.com/?format=html", headers)
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "text/html" {
+		t.Errorf("Expected the built-in alias to resolve, got %v", caddyhttp.GetVar(r.Context(), "conneg_type"))
+	}
+}
+
+func TestLocaleAlias(t *testing.T) {
+	m := MatchConneg{
+		MatchLanguages:           []string{"en-US", "de", "fr"},
+		ForceLanguageQueryString: "lang",
+		LocaleAlias:              map[string]string{"en_US": "en-US", "english": "en-US"},
+		VarLanguage:              "lang",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for query, expected := range map[string]string{"en_US": "en-US", "english": "en-US", "ger": "de", "DEU": "de", "fra": "fr", "de": "de"} {
+		r := newConnegRequest(t, "http://foo.com/?lang="+query, map[string]string{"Accept-Language": "fr"})
+		if !m.Match(r) {
+			t.Errorf("%s: expected a match", query)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_lang"); v != expected {
+			t.Errorf("%s: expected language %s, got %v", query, expected, v)
+		}
+	}
+}
+
+func TestScoreVar(t *testing.T) {
+	headers := map[string]string{"Accept": "text/html;q=0.8", "Accept-Language": "de;q=0.5, en;q=0.2", "Accept-Charset": "utf-8"}
+	for aggregation, expected := range map[string]string{"": "0.400", "product": "0.400", "minimum": "0.500", "average": "0.767"} {
+		m := MatchConneg{
+			MatchTypes:       []string{"text/html"},
+			MatchLanguages:   []string{"de"},
+			MatchCharsets:    []string{"utf-8"},
+			ScoreVar:         "score",
+			ScoreAggregation: aggregation,
+		}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", headers)
+		if !m.Match(r) {
+			t.Fatalf("%s: request should match", aggregation)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_score"); v != expected {
+			t.Errorf("%s: expected score %s, got %v", aggregation, expected, v)
+		}
+		m.Cleanup()
+	}
+
+	// forced values are what the client wants most
+	m := MatchConneg{MatchTypes: []string{"text/html", "application/json"}, ForceTypeQueryString: "format", ScoreVar: "score"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com?format=application/json", map[string]string{"Accept": "text/html, application/json;q=0.1"})
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_score") != "1.000" {
+		t.Errorf("Expected score 1.000 for a forced type, got %v", caddyhttp.GetVar(r.Context(), "conneg_score"))
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, ScoreVar: "score", ScoreAggregation: "median"}).Validate(); err == nil {
+		t.Error("Unknown score_aggregation should not validate")
+	}
+}
+
+func TestTTLVar(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html"},
+		MatchLanguages: []string{"de"},
+		TTLVar:         "ttl",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	custom := MatchConneg{MatchTypes: []string{"text/html"}, TTLVar: "ttl", BaseTTL: 600}
+	provisionConneg(t, &custom)
+	defer custom.Cleanup()
+	for _, test := range []struct {
+		m       *MatchConneg
+		headers map[string]string
+		ttl     string
+	}{
+		{&m, map[string]string{"Accept": "text/html", "Accept-Language": "de"}, "3600"},
+		{&m, map[string]string{"Accept": "text/html;q=0.8", "Accept-Language": "de;q=0.5"}, "2340"},
+		{&m, map[string]string{"Accept": "*/*;q=0.1", "Accept-Language": "de"}, "1980"},
+		{&custom, map[string]string{"Accept": "text/*;q=0.5"}, "300"},
+	} {
+		r := newConnegRequest(t, "http://foo.com", test.headers)
+		if !test.m.Match(r) {
+			t.Errorf("%v: request should match", test.headers)
+		} else if v := caddyhttp.GetVar(r.Context(), "conneg_ttl"); v != test.ttl {
+			t.Errorf("%v: expected TTL %s, got %v", test.headers, test.ttl, v)
+		}
+	}
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, BaseTTL: 600}).Validate(); err == nil {
+		t.Error("base_ttl without ttl_var should not validate")
+	}
+}
+
+func TestSynthesizeAcceptHeader(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html", "application/json;q=0.8", "text/plain;charset=utf-8;q=0.25"},
+		MatchLanguages: []string{"en", "de-AT"},
+	}
+	want := "text/html, application/json;q=0.8, text/plain;charset=utf-8;q=0.25"
+	if got := m.SynthesizeAcceptHeader(); got != want {
+		t.Errorf("Expected Accept %q before provisioning, got %q", want, got)
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if got := m.SynthesizeAcceptHeader(); got != want {
+		t.Errorf("Expected Accept %q after provisioning, got %q", want, got)
+	}
+	if got, want := m.SynthesizeAcceptLanguage(), "en, de-AT"; got != want {
+		t.Errorf("Expected Accept-Language %q, got %q", want, got)
+	}
+
+	m.VarType, m.VarLanguage = "type", "lang"
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": m.SynthesizeAcceptHeader(), "Accept-Language": m.SynthesizeAcceptLanguage()})
+	if !m.Match(r) {
+		t.Fatal("Synthesized headers should match the matcher")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != "text/html" {
+		t.Errorf("Expected the best offer text/html, got %v", v)
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_lang"); v != "en" {
+		t.Errorf("Expected the first language en, got %v", v)
+	}
+}
+
+type brotliOnly struct{}
+
+func (brotliOnly) SupportsEncoding(name string) bool { return name == "br" }
+
+func TestCoordinateWithEncode(t *testing.T) {
+	m := MatchConneg{
+		MatchEncodings:       []string{"gzip", "br"},
+		CoordinateWithEncode: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept-Encoding": "br"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	if encoding, ok := connegctx.SelectEncoding(r.Context(), brotliOnly{}); !ok || encoding != "br" {
+		t.Errorf("Expected negotiated encoding \"br\", got %q", encoding)
+	}
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept-Encoding": "gzip"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	if encoding, ok := connegctx.SelectEncoding(r.Context(), brotliOnly{}); ok {
+		t.Errorf("Unsupported encoding should not be selected, got %q", encoding)
+	}
+}
+
+func TestCompressionAware(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:           []string{"text/html", "image/png"},
+		MatchEncodings:       []string{"gzip", "br"},
+		VarEncoding:          "encoding",
+		CompressionAware:     true,
+		CoordinateWithEncode: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := []struct {
+		accept, acceptEncoding, encoding string
+	}{
+		{"text/html", "br", "br"},
+		{"image/png", "br", "identity"},
+		// the encoding of already compressed types is not negotiated at all
+		{"image/png", "compress", "identity"},
+		{"text/html", "compress", ""},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": test.accept, "Accept-Encoding": test.acceptEncoding})
+		if got := m.Match(r); got != (test.encoding != "") {
+			t.Errorf("%s, %s: expected match %v, got %v", test.accept, test.acceptEncoding, test.encoding != "", got)
+			continue
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_encoding"); test.encoding != "" && v != test.encoding {
+			t.Errorf("%s, %s: expected encoding %q, got %v", test.accept, test.acceptEncoding, test.encoding, v)
+		}
+		if encoding, _ := connegctx.Encoding(r.Context()); test.encoding != "" && encoding != test.encoding {
+			t.Errorf("%s, %s: expected coordinated encoding %q, got %q", test.accept, test.acceptEncoding, test.encoding, encoding)
+		}
+	}
+
+	custom := MatchConneg{
+		MatchTypes:             []string{"image/png", "image/svg+xml"},
+		MatchEncodings:         []string{"gzip"},
+		VarEncoding:            "encoding",
+		CompressionAware:       true,
+		AlreadyCompressedTypes: []string{"image/svg+xml"},
+	}
+	provisionConneg(t, &custom)
+	defer custom.Cleanup()
+	for accept, encoding := range map[string]string{"image/png": "gzip", "image/svg+xml": "identity"} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept, "Accept-Encoding": "gzip"})
+		if !custom.Match(r) {
+			t.Errorf("%s: request should match", accept)
+		} else if v := caddyhttp.GetVar(r.Context(), "conneg_encoding"); v != encoding {
+			t.Errorf("%s: expected encoding %q, got %v", accept, encoding, v)
+		}
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"image/png"}, CompressionAware: true}).Validate(); err == nil {
+		t.Error("compression_aware without match_encodings should not validate")
+	}
+}
+
+func TestEncodingFallbackToIdentity(t *testing.T) {
+	for fallback, expected := range map[bool]bool{false: false, true: true} {
+		m := MatchConneg{MatchEncodings: []string{"gzip", "br"}, VarEncoding: "encoding", EncodingFallbackToIdentity: fallback}
+		provisionConneg(t, &m)
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept-Encoding": "deflate"})
+		if m.Match(r) != expected {
+			t.Errorf("encoding_fallback_to_identity %v: expected match %v", fallback, expected)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_encoding"); expected && v != "identity" {
+			t.Errorf("encoding_fallback_to_identity %v: expected encoding identity, got %v", fallback, v)
+		}
+		m.Cleanup()
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, EncodingFallbackToIdentity: true}).Validate(); err == nil {
+		t.Error("encoding_fallback_to_identity without match_encodings should not validate")
+	}
+}
+
+func TestMultipleCharsetHeaders(t *testing.T) {
+	m := MatchConneg{
+		MatchCharsets: []string{"iso-8859-1", "utf-8"},
+		VarCharset:    "charset",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", nil)
+	r.Header.Add("Accept-Charset", "utf-8")
+	r.Header.Add("Accept-Charset", "iso-8859-1;q=0.5")
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_charset"); v != "utf-8" {
+		t.Errorf("Expected the best charset across all header fields \"utf-8\", got %v", v)
+	}
+
+	// the better value may also come in a later header field
+	r = newConnegRequest(t, "http://foo.com", nil)
+	r.Header.Add("Accept-Charset", "iso-8859-1;q=0.5")
+	r.Header.Add("Accept-Charset", "utf-8")
+	if !m.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_charset") != "utf-8" {
+		t.Errorf("Expected the best charset across all header fields \"utf-8\", got %v", caddyhttp.GetVar(r.Context(), "conneg_charset"))
+	}
+
+	e := MatchConneg{MatchEncodings: []string{"gzip", "br"}, VarEncoding: "encoding"}
+	provisionConneg(t, &e)
+	defer e.Cleanup()
+	r = newConnegRequest(t, "http://foo.com", nil)
+	r.Header.Add("Accept-Encoding", "gzip;q=0.5")
+	r.Header.Add("Accept-Encoding", "br")
+	if !e.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_encoding") != "br" {
+		t.Errorf("Expected the best encoding across all header fields \"br\", got %v", caddyhttp.GetVar(r.Context(), "conneg_encoding"))
+	}
+
+	types := MatchConneg{MatchTypes: []string{"text/html", "application/json"}, VarType: "type"}
+	provisionConneg(t, &types)
+	defer types.Cleanup()
+	for _, headers := range [][]string{{"application/json", "text/html;q=0.5"}, {"text/html;q=0.5", "application/json"}} {
+		r = newConnegRequest(t, "http://foo.com", nil)
+		for _, h := range headers {
+			r.Header.Add("Accept", h)
+		}
+		if !types.Match(r) || caddyhttp.GetVar(r.Context(), "conneg_type") != "application/json" {
+			t.Errorf("Accept %v: expected the best type across all header fields \"application/json\", got %v", headers, caddyhttp.GetVar(r.Context(), "conneg_type"))
+		}
+	}
+}
+
+func TestMatchProfiles(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:    []string{"text/html", "application/ld+json", "application/activity+json;charset=utf-8"},
+		VarType:       "type",
+		MatchProfiles: map[string][]string{"application/ld+json": {"http://schema.org/"}, "application/activity+json": {"https://www.w3.org/ns/activitystreams"}},
+		VarProfile:    "profile",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		accept  string
+		match   bool
+		_type   interface{}
+		profile interface{}
+	}{
+		{`application/ld+json;profile="http://schema.org/"`, true, "application/ld+json", "http://schema.org/"},
+		{`application/ld+json`, true, "application/ld+json", nil},
+		{`application/activity+json;profile="https://www.w3.org/ns/activitystreams"`, true, "application/activity+json;charset=utf-8", "https://www.w3.org/ns/activitystreams"},
+		{`*/*`, true, "text/html", nil},
+		{`application/ld+json;profile="http://example.org/"`, false, nil, nil},
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": test.accept})
+		if m.Match(r) != test.match {
+			t.Errorf("Accept: %s should match: %t", test.accept, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != test._type {
+			t.Errorf("Accept: %s: expected type %v, got %v", test.accept, test._type, v)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_profile"); v != test.profile {
+			t.Errorf("Accept: %s: expected profile %v, got %v", test.accept, test.profile, v)
+		}
+	}
+}
+
+func TestMatchAPIVersions(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:       []string{"application/vnd.myapi+json;version=1", "application/vnd.myapi+json;version=2", "application/vnd.myapi+json;version=3"},
+		MatchAPIVersions: []string{"1", "2"},
+		VarAPIVersion:    "api_version",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		accept  string
+		match   bool
+		version interface{}
+	}{
+		{"application/vnd.myapi+json;version=2", true, "2"},
+		{"application/vnd.myapi+json;version=1, application/vnd.myapi+json;version=2;q=0.5", true, "1"},
+		{"application/vnd.myapi+json;version=3", false, nil},
+		{"application/vnd.myapi+json;version=4", false, nil},
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": test.accept})
+		if m.Match(r) != test.match {
+			t.Errorf("Accept: %s should match: %t", test.accept, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_api_version"); v != test.version {
+			t.Errorf("Accept: %s: expected version %v, got %v", test.accept, test.version, v)
+		}
+	}
+
+	if err := (MatchConneg{MatchLanguages: []string{"en"}, VarAPIVersion: "api_version"}).Validate(); err == nil {
+		t.Error("API versions without offered types should not validate")
+	}
+}
+
+func TestTemporalHeader(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:         []string{"application/json"},
+		TemporalHeaderName: "X-API-Version-Date",
+		AfterDate:          "2023-12-31",
+		BeforeDate:         "2025-01-01",
+		VarTemporalDate:    "date",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		date  string
+		match bool
+		value interface{}
+	}{
+		{"2024-01-01", true, "2024-01-01"},
+		{" 2024-06-30 ", true, "2024-06-30"},
+		{"", true, nil},
+		{"2023-12-31", false, nil},
+		{"2025-01-01", false, nil},
+		{"01/01/2024", false, nil},
+	} {
+		headers := map[string]string{"Accept": "application/json"}
+		if len(test.date) > 0 {
+			headers["X-API-Version-Date"] = test.date
+		}
+		r := newConnegRequest(t, "http://foo.com", headers)
+		if m.Match(r) != test.match {
+			t.Errorf("%q should match: %t", test.date, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_date"); v != test.value {
+			t.Errorf("%q: expected date %v, got %v", test.date, test.value, v)
+		}
+	}
+
+	for _, invalid := range []MatchConneg{
+		{MatchTypes: []string{"application/json"}, BeforeDate: "2025-01-01"},
+		{MatchTypes: []string{"application/json"}, TemporalHeaderName: "X-API-Version-Date", AfterDate: "2025"},
+		{MatchTypes: []string{"application/json"}, TemporalHeaderName: "X-API-Version-Date", TemporalFormat: "2006", BeforeDate: "2025-01-01"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v should fail validation", invalid)
+		}
+	}
+}
+
+func TestZeroQRejectsAll(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:        []string{"text/html", "multipart/mixed"},
+		MatchEncodings:    []string{"gzip", "br"},
+		MultipartFallback: true,
+		ZeroQRejectsAll:   true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		headers  map[string]string
+		match    bool
+		rejected bool
+	}{
+		{map[string]string{"Accept": "*/*;q=0", "Accept-Encoding": "gzip"}, false, true},
+		{map[string]string{"Accept": "text/*;q=0, multipart/*;q=0", "Accept-Encoding": "gzip"}, false, true},
+		{map[string]string{"Accept": "*/*;q=0, text/html", "Accept-Encoding": "gzip"}, true, false},
+		{map[string]string{"Accept": "application/json", "Accept-Encoding": "gzip"}, true, false},
+		{map[string]string{"Accept": "text/html", "Accept-Encoding": "*;q=0"}, false, true},
+		{map[string]string{"Accept": "text/html", "Accept-Encoding": "gzip;q=0, deflate"}, false, false},
+	} {
+		r := newConnegRequest(t, "http://foo.com", test.headers)
+		if m.Match(r) != test.match {
+			t.Errorf("%v should match: %t", test.headers, test.match)
+		}
+		if rejected := caddyhttp.GetVar(r.Context(), "conneg_source") == "explicit_rejection"; rejected != test.rejected {
+			t.Errorf("%v should be reported as explicit rejection: %t", test.headers, test.rejected)
+		}
+	}
+}
+
+type mockSpan map[string]string
+
+func (s mockSpan) SetTag(key, value string) { s[key] = value }
+
+func TestGracefulDegradation(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:          []string{"text/html"},
+		MatchLanguages:      []string{"en"},
+		MatchEncodings:      []string{"gzip"},
+		VarType:             "type",
+		GracefulDegradation: []string{"language", "encoding"},
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	tests := []struct {
+		headers map[string]string
+		match   bool
+		source  interface{}
+	}{
+		{map[string]string{"Accept": "text/html", "Accept-Language": "en;q=x", "Accept-Encoding": "gzip"}, true, "degraded"},
+		{map[string]string{"Accept": "text/html", "Accept-Language": "en", "Accept-Encoding": "gzip;=1"}, true, "degraded"},
+		// well-formed headers asking for something else still don't match
+		{map[string]string{"Accept": "text/html", "Accept-Language": "fr", "Accept-Encoding": "gzip"}, false, nil},
+		{map[string]string{"Accept": "text/html", "Accept-Language": "en", "Accept-Encoding": "br"}, false, nil},
+		// type is not listed
+		{map[string]string{"Accept": "text/html;", "Accept-Language": "en", "Accept-Encoding": "gzip"}, false, nil},
+		{map[string]string{"Accept": "text/html", "Accept-Language": "en", "Accept-Encoding": "gzip"}, true, nil},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://foo.com", test.headers)
+		if got := m.Match(r); got != test.match {
+			t.Errorf("%v: expected match %v, got %v", test.headers, test.match, got)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_source"); v != test.source {
+			t.Errorf("%v: expected source %v, got %v", test.headers, test.source, v)
+		}
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, GracefulDegradation: []string{"profile"}}).Validate(); err == nil {
+		t.Error("Unknown dimension in graceful_degradation should not validate")
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html"},
+		MatchLanguages: []string{"de"},
+		TelemetryKey:   "span",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	span := mockSpan{}
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "de-AT"})
+	r = r.WithContext(context.WithValue(r.Context(), caddy.CtxKey("span"), span))
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	expected := mockSpan{"conneg.match": "true", "conneg.type": "text/html", "conneg.language": "de"}
+	if !reflect.DeepEqual(span, expected) {
+		t.Errorf("Expected tags %v, got %v", expected, span)
+	}
+}
+
+func TestForcePriority(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes: []string{"text/html", "application/tei+xml", "application/rdf+xml"},
+		VarType:    "type",
+		ForcePriority: []ForceMechanism{
+			{Source: "header", Key: "X-Format"},
+			{Source: "cookie", Key: "format"},
+			{Source: "extension"},
+			{Source: "path_segment", Key: "0"},
+			{Source: "subdomain"},
+		},
+		ForceTypeQueryString: "format",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		target  string
+		headers map[string]string
+		match   bool
+		_type   interface{}
+	}{
+		{"http://foo.com/doc", map[string]string{"Accept": "text/html"}, true, "text/html"},
+		{"http://foo.com/doc?format=tei", map[string]string{"Accept": "text/html"}, true, "application/tei+xml"},
+		{"http://foo.com/doc?format=xls", map[string]string{"Accept": "text/html"}, false, nil},
+		{"http://foo.com/doc.rdf?format=tei", map[string]string{"Accept": "text/html"}, true, "application/rdf+xml"},
+		{"http://foo.com/doc.rdf", map[string]string{"Accept": "text/html", "X-Format": "tei"}, true, "application/tei+xml"},
+		{"http://foo.com/doc.rdf", map[string]string{"Accept": "text/html", "Cookie": "format=tei"}, true, "application/tei+xml"},
+		{"http://foo.com/doc.php", map[string]string{"Accept": "text/html", "X-Format": "xls"}, false, nil},
+		{"http://foo.com/doc.php", map[string]string{"Accept": "application/tei+xml"}, true, "application/tei+xml"},
+		{"http://foo.com/rdf/doc", map[string]string{"Accept": "text/html"}, true, "application/rdf+xml"},
+		{"http://tei.api.foo.com:8080/doc", map[string]string{"Accept": "text/html"}, true, "application/tei+xml"},
+	} {
+		r := newConnegRequest(t, test.target, test.headers)
+		if m.Match(r) != test.match {
+			t.Errorf("%s %v should match: %t", test.target, test.headers, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != test._type {
+			t.Errorf("%s %v: expected type %v, got %v", test.target, test.headers, test._type, v)
+		}
+	}
+
+	for _, mechanism := range []ForceMechanism{{Source: "query"}, {Source: "path_segment", Key: "last"}, {Source: "referer"}} {
+		o := MatchConneg{MatchTypes: []string{"text/html"}, ForcePriority: []ForceMechanism{mechanism}}
+		if err := o.Validate(); err == nil {
+			t.Errorf("Force mechanism %+v should not validate", mechanism)
+		}
+	}
+}
+
+func TestMustProvision(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html"}}
+	m.MustProvision(caddy.Context{Context: context.Background()})
+	defer m.Cleanup()
+	if len(m.MatchTTypes) != 1 {
+		t.Errorf("Expected the matcher to be provisioned, got %+v", m)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustProvisionWithLogger should panic on an invalid quality value")
+		}
+	}()
+	o := MatchConneg{MatchTypes: []string{"text/html;q=2"}}
+	o.MustProvisionWithLogger(zap.NewNop())
+}
+
+func TestForceAcceptReplace(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:                 []string{"text/html", "application/rdf+xml"},
+		MatchLanguages:             []string{"en", "de"},
+		ForceTypeQueryString:       "format",
+		ForceLanguageQueryString:   "lang",
+		ForceTypeAcceptReplace:     true,
+		ForceLanguageAcceptReplace: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	headers := map[string]string{"Accept": "text/html", "Accept-Language": "en"}
+
+	r := newConnegRequest(t, "http://foo.com/?format=rdf&lang=de", headers)
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	// later handlers get to see the request as modified by the matcher
+	if v := r.Header.Get("Accept"); v != "application/rdf+xml" {
+		t.Errorf("Expected Accept header to be replaced with the forced type, got %q", v)
+	}
+	if v := r.Header.Get("Accept-Language"); v != "de" {
+		t.Errorf("Expected Accept-Language header to be replaced with the forced language, got %q", v)
+	}
+
+	r = newConnegRequest(t, "http://foo.com/", headers)
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	if r.Header.Get("Accept") != "text/html" || r.Header.Get("Accept-Language") != "en" {
+		t.Errorf("Headers should be left alone without a forced value, got %v", r.Header)
+	}
+}
+
+func TestRemoveForceParam(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:               []string{"text/html", "application/rdf+xml"},
+		MatchLanguages:           []string{"en", "de"},
+		ForceTypeQueryString:     "format",
+		ForceLanguageQueryString: "lang",
+		VarType:                  "type",
+		RemoveForceParam:         true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	tests := []struct {
+		query, expected string
+	}{
+		{"?a=1&format=rdf&b=2", "a=1&b=2"},
+		{"?format=rdf", ""},
+		{"?b=2&format=rdf&a=1&format=html", "b=2&a=1"},
+		{"?a=1&format=rdf&lang=de&b=x%20y", "a=1&b=x%20y"},
+		{"?a=1&form%61t=rdf", "a=1"},
+		{"?formats=1&format=rdf&x", "formats=1&x"},
+		// parameters that are not used to force a value are kept
+		{"?a=1&b=2", "a=1&b=2"},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://foo.com/path"+test.query, map[string]string{"Accept": "text/html", "Accept-Language": "en"})
+		if !m.Match(r) {
+			t.Errorf("%s: request should match", test.query)
+			continue
+		}
+		if r.URL.RawQuery != test.expected {
+			t.Errorf("%s: expected query %q, got %q", test.query, test.expected, r.URL.RawQuery)
+		}
+	}
+
+	// a value not on offer is not removed, as it is not applied
+	r := newConnegRequest(t, "http://foo.com/path?a=1&format=xml", map[string]string{"Accept": "text/html"})
+	if m.Match(r) {
+		t.Error("Request forcing a type not on offer should not match")
+	}
+	if r.URL.RawQuery != "a=1&format=xml" {
+		t.Errorf("Expected the query to be left alone, got %q", r.URL.RawQuery)
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, RemoveForceParam: true}).Validate(); err == nil {
+		t.Error("remove_force_param without a query parameter should not validate")
+	}
+}
+
+func TestForceQueryParamMultiValue(t *testing.T) {
+	tests := map[string]map[string]string{
+		"first":           {"format=html&format=rdf": "text/html", "format=foo&format=rdf": "", "format=html&lang=fr&lang=de": ""},
+		"last":            {"format=html&format=rdf": "application/rdf+xml", "format=foo&format=rdf": "application/rdf+xml", "format=html&lang=fr&lang=de": "de"},
+		"highest_quality": {"format=html&format=rdf": "text/html", "format=foo&format=rdf": "application/rdf+xml", "format=html&lang=fr&lang=de": "de"},
+	}
+	for mode, queries := range tests {
+		m := MatchConneg{
+			MatchTypes:                []string{"text/html", "application/rdf+xml"},
+			MatchLanguages:            []string{"en", "de"},
+			ForceTypeQueryString:      "format",
+			ForceLanguageQueryString:  "lang",
+			VarType:                   "type",
+			VarLanguage:               "lang",
+			ForceQueryParamMultiValue: mode,
+		}
+		provisionConneg(t, &m)
+		for query, expected := range queries {
+			r := newConnegRequest(t, "http://foo.com/?"+query, map[string]string{"Accept": "image/png", "Accept-Language": "en"})
+			if got := m.Match(r); got != (len(expected) > 0) {
+				t.Errorf("%s, %s: expected match %v, got %v", mode, query, len(expected) > 0, got)
+				continue
+			}
+			if len(expected) > 0 && caddyhttp.GetVar(r.Context(), "conneg_type") != expected && caddyhttp.GetVar(r.Context(), "conneg_lang") != expected {
+				t.Errorf("%s, %s: expected %s to be negotiated", mode, query, expected)
+			}
+		}
+		m.Cleanup()
+	}
+
+	if err := (MatchConneg{MatchTypes: []string{"text/html"}, ForceTypeQueryString: "format", ForceQueryParamMultiValue: "all"}).Validate(); err == nil {
+		t.Error("An unknown force_query_param_multi_value should not validate")
+	}
+}
+
+func TestNormalizeQueryParam(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		m := MatchConneg{
+			MatchTypes:               []string{"text/html", "application/rdf+xml"},
+			MatchLanguages:           []string{"en", "de-AT"},
+			MatchEncodings:           []string{"gzip", "br"},
+			ForceTypeQueryString:     "format",
+			ForceLanguageQueryString: "lang",
+			ForceEncodingQueryString: "enc",
+			VarType:                  "type",
+			VarLanguage:              "lang",
+			VarEncoding:              "enc",
+			NormalizeQueryParam:      normalize,
+		}
+		provisionConneg(t, &m)
+		for query, expected := range map[string]string{
+			"format=HTML":            "text/html",
+			"format=Rdf":             "application/rdf+xml",
+			"format=TEXT/HTML":       "text/html",
+			"format=html&lang=DE-at": "de-AT",
+			"format=html&enc=GZIP":   "gzip",
+		} {
+			r := newConnegRequest(t, "http://foo.com/?"+query, map[string]string{"Accept": "image/png", "Accept-Language": "en", "Accept-Encoding": "br"})
+			if got := m.Match(r); got != normalize {
+				t.Errorf("normalize_query_param %v, %s: expected match %v, got %v", normalize, query, normalize, got)
+				continue
+			}
+			if !normalize {
+				continue
+			}
+			found := false
+			for _, v := range []string{"conneg_type", "conneg_lang", "conneg_enc"} {
+				found = found || caddyhttp.GetVar(r.Context(), v) == expected
+			}
+			if !found {
+				t.Errorf("%s: expected %s to be negotiated", query, expected)
+			}
+		}
+		m.Cleanup()
+	}
+}
+
+func TestLanguageConfidence(t *testing.T) {
+	m := MatchConneg{
+		MatchLanguages:        []string{"en", "de", "zh"},
+		VarLanguage:           "language",
+		VarLanguageConfidence: "confidence",
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for _, test := range []struct {
+		header     string
+		match      bool
+		language   interface{}
+		confidence interface{}
+	}{
+		{"de", true, "de", "Exact"},
+		{"de-AT", true, "de", "High"},
+		{"zh-Hant", true, "zh", "Low"},
+		{"fr", false, nil, nil},
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept-Language": test.header})
+		if m.Match(r) != test.match {
+			t.Errorf("Accept-Language: %s should match: %t", test.header, test.match)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_language"); v != test.language {
+			t.Errorf("Accept-Language: %s: expected language %v, got %v", test.header, test.language, v)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_confidence"); v != test.confidence {
+			t.Errorf("Accept-Language: %s: expected confidence %v, got %v", test.header, test.confidence, v)
+		}
+	}
+}
+
+func TestExtractCharsetFromType(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:             []string{"text/html;charset=utf-8", "text/html;charset=iso-8859-1", "application/json"},
+		VarCharset:             "charset",
+		ExtractCharsetFromType: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	for accept, expected := range map[string]interface{}{
+		"text/html;charset=iso-8859-1": "iso-8859-1",
+		"text/html":                    "utf-8",
+		"application/json":             nil,
+	} {
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": accept})
+		if !m.Match(r) {
+			t.Fatalf("Accept: %s should match", accept)
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_charset"); v != expected {
+			t.Errorf("Accept: %s: expected charset %v, got %v", accept, expected, v)
+		}
 	}
 }
@@ -0,0 +1,96 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"golang.org/x/text/language"
+)
+
+// geoRecord is the part of a GeoIP2/GeoLite2 country or city record that is
+// needed to guess the language of a client.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// provisionGeo opens GeoDatabase and parses GeoTrustedProxies.
+func (m *MatchConneg) provisionGeo() error {
+	m.geoProxies = nil
+	for _, cidr := range m.GeoTrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid network '%s' in geo_trusted_proxies: %v", cidr, err)
+		}
+		m.geoProxies = append(m.geoProxies, network)
+	}
+	db, err := maxminddb.Open(m.GeoDatabase)
+	if err != nil {
+		return fmt.Errorf("Cannot open geo_database '%s': %v", m.GeoDatabase, err)
+	}
+	m.geoDB = db
+	return nil
+}
+
+// geoClientIP returns the address of the client, which is taken from the
+// X-Forwarded-For header if the request comes from a trusted proxy.
+func (m MatchConneg) geoClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, proxy := range m.geoProxies {
+		if proxy.Contains(ip) {
+			// the left-most address is the one of the original client
+			forwarded := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])
+			if forwardedIP := net.ParseIP(forwarded); forwardedIP != nil {
+				return forwardedIP
+			}
+			break
+		}
+	}
+	return ip
+}
+
+// geoLanguage returns the most widely spoken language of the country the
+// client IP is located in, or `und` if the country is not known.
+func (m MatchConneg) geoLanguage(r *http.Request) string {
+	var record geoRecord
+	ip := m.geoClientIP(r)
+	if ip == nil || m.geoDB.Lookup(ip, &record) != nil || len(record.Country.ISOCode) == 0 {
+		return "und"
+	}
+	region, err := language.ParseRegion(record.Country.ISOCode)
+	if err != nil {
+		return "und"
+	}
+	// likely subtags, e.g. und-CH becomes de-Latn-CH
+	tag, err := language.Compose(language.Und, region)
+	if err != nil {
+		return "und"
+	}
+	base, _ := tag.Base()
+	return base.String()
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// writeTestGeoDatabase writes an IPv4 MaxMind DB with record size 24 that
+// locates each of the given networks in the given country, the way GeoLite2
+// country databases do.
+func writeTestGeoDatabase(t *testing.T, countries map[string]string) string {
+	t.Helper()
+	str := func(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+	u16 := func(v int) []byte { return []byte{5<<5 | 2, byte(v >> 8), byte(v)} }
+	u32 := func(v int) []byte { return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+	mapOf := func(pairs ...[]byte) []byte {
+		out := []byte{7<<5 | byte(len(pairs)/2)}
+		for _, p := range pairs {
+			out = append(out, p...)
+		}
+		return out
+	}
+
+	// search tree: records are node indexes (> 0), data offsets (< 0, as
+	// -1 - offset) or 0 for networks without data
+	nodes := [][2]int{{0, 0}}
+	var data []byte
+	for cidr, country := range countries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To4()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -1 - len(data)
+				break
+			}
+			if nodes[node][bit] == 0 {
+				nodes = append(nodes, [2]int{0, 0})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		data = append(data, mapOf(str("country"), mapOf(str("iso_code"), str(country)))...)
+	}
+
+	var db []byte
+	for _, node := range nodes {
+		for _, record := range node {
+			value := len(nodes)
+			if record > 0 {
+				value = record
+			} else if record < 0 {
+				value = len(nodes) + 16 + (-1 - record)
+			}
+			db = append(db, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, mapOf(
+		str("binary_format_major_version"), u16(2),
+		str("binary_format_minor_version"), u16(0),
+		str("database_type"), str("Test-Country"),
+		str("ip_version"), u16(4),
+		str("node_count"), u32(len(nodes)),
+		str("record_size"), u16(24),
+	)...)
+
+	path := filepath.Join(t.TempDir(), "test-country.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoLanguage(t *testing.T) {
+	m := MatchConneg{
+		MatchLanguages:    []string{"en", "de", "zh"},
+		VarLanguage:       "lang",
+		GeoLanguage:       true,
+		GeoDatabase:       writeTestGeoDatabase(t, map[string]string{"81.2.69.0/24": "DE", "175.16.199.0/24": "CN"}),
+		GeoTrustedProxies: []string{"10.0.0.0/8"},
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	tests := []struct {
+		remoteAddr string
+		headers    map[string]string
+		language   string
+	}{
+		{"81.2.69.142:4711", nil, "de"},
+		{"175.16.199.1:4711", nil, "zh"},
+		{"81.2.69.142:4711", map[string]string{"Accept-Language": "en"}, "en"},
+		{"10.1.2.3:4711", map[string]string{"X-Forwarded-For": "175.16.199.1, 10.1.2.3"}, "zh"},
+		// not from a trusted proxy
+		{"192.0.2.1:4711", map[string]string{"X-Forwarded-For": "175.16.199.1"}, ""},
+		// unknown addresses fall through to und, which matches no language
+		{"192.0.2.1:4711", nil, ""},
+		{"[2001:db8::1]:4711", nil, ""},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://foo.com", test.headers)
+		r.RemoteAddr = test.remoteAddr
+		if got := m.Match(r); got != (test.language != "") {
+			t.Errorf("%s %v: expected match %v, got %v", test.remoteAddr, test.headers, test.language != "", got)
+			continue
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_lang"); test.language != "" && v != test.language {
+			t.Errorf("%s %v: expected language %q, got %v", test.remoteAddr, test.headers, test.language, v)
+		}
+	}
+
+	if err := (&MatchConneg{MatchLanguages: []string{"en"}, GeoLanguage: true, GeoDatabase: filepath.Join(t.TempDir(), "missing.mmdb")}).provision(); err == nil {
+		t.Error("Provisioning with a missing geo_database should fail")
+	}
+}
+
+func TestSameOriginLanguage(t *testing.T) {
+	m := MatchConneg{
+		MatchLanguages:       []string{"en", "de", "fr"},
+		VarLanguage:          "lang",
+		SameOriginLanguage:   true,
+		AllowedOriginDomains: []string{"example.com"},
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	tests := []struct {
+		headers  map[string]string
+		language string
+	}{
+		{map[string]string{"Origin": "https://fr.example.com"}, "fr"},
+		{map[string]string{"Origin": "https://DE.Example.com:8443"}, "de"},
+		{map[string]string{"Origin": "https://fr.example.com", "Accept-Language": "en"}, "en"},
+		// not from an allowed domain
+		{map[string]string{"Origin": "https://fr.example.org"}, ""},
+		{map[string]string{"Origin": "https://fr.notexample.com"}, ""},
+		{map[string]string{"Origin": "https://example.com"}, ""},
+		// not an offered language
+		{map[string]string{"Origin": "https://it.example.com"}, ""},
+		{map[string]string{"Origin": "https://api.example.com"}, ""},
+		{map[string]string{"Origin": "null"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, "http://api.example.com", test.headers)
+		if got := m.Match(r); got != (test.language != "") {
+			t.Errorf("%v: expected match %v, got %v", test.headers, test.language != "", got)
+			continue
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_lang"); test.language != "" && v != test.language {
+			t.Errorf("%v: expected language %q, got %v", test.headers, test.language, v)
+		}
+	}
+
+	if err := (MatchConneg{MatchLanguages: []string{"en"}, SameOriginLanguage: true}).Validate(); err == nil {
+		t.Error("same_origin_language without allowed_origin_domains should not validate")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Variable holding the advertisement of the last conneg matcher that matched
+// the request. The name does not start with `conneg_`, so that it does not
+// collide with the result variables.
+const advertisementVar = "conneg.advertisement"
+
+// advertisement holds what a matcher has to say about the capabilities of a
+// resource in the response.
+type advertisement struct {
+	acceptPatch      string
+	vary             []string
+	respondToOptions bool
+	// cookie remembering the negotiated type, see RememberNegotiationCookie
+	cookie *http.Cookie
+	// explanation of the negotiation, see NoteHeader
+	note string
+	// client hints to ask for, see UseClientHints
+	acceptCH []string
+}
+
+func init() {
+	caddy.RegisterModule(ConnegHandler{})
+	httpcaddyfile.RegisterHandlerDirective("conneg", parseCaddyfileHandler)
+}
+
+// ConnegHandler is the companion handler of the conneg matcher. It advertises
+// the capabilities of the matched resource, as configured in the matcher with
+// `advertise_accept_patch` and `respond_to_options`, sets the cookie of
+// `remember_negotiation_cookie`, adds the header of `note_header` and asks
+// for the client hints of `use_client_hints`.
+type ConnegHandler struct {
+	// Methods listed in the Allow header of responses to OPTIONS requests. Default: GET, HEAD, OPTIONS, PATCH
+	Allow []string `json:"allow,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConnegHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.conneg",
+		New: func() caddy.Module { return new(ConnegHandler) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (h *ConnegHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "allow":
+				h.Allow = append(h.Allow, d.RemainingArgs()...)
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var c ConnegHandler
+	err := c.UnmarshalCaddyfile(h.Dispenser)
+	return c, err
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (h ConnegHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	a, ok := caddyhttp.GetVar(r.Context(), advertisementVar).(advertisement)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+	if a.cookie != nil {
+		http.SetCookie(w, a.cookie)
+	}
+	if len(a.note) > 0 {
+		w.Header().Add("X-Content-Negotiation", a.note)
+	}
+	if len(a.acceptPatch) > 0 {
+		w.Header().Set("Accept-Patch", a.acceptPatch)
+	}
+	if len(a.acceptCH) > 0 {
+		w.Header().Set("Accept-CH", strings.Join(a.acceptCH, ", "))
+	}
+	if a.respondToOptions && r.Method == http.MethodOptions {
+		allow := h.Allow
+		if len(allow) == 0 {
+			allow = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPatch}
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		if len(a.vary) > 0 {
+			w.Header().Set("Vary", strings.Join(a.vary, ", "))
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*ConnegHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*ConnegHandler)(nil)
+)
@@ -0,0 +1,227 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestConnegHandler(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:           []string{"application/merge-patch+json", "application/json-patch+json"},
+		MatchLanguages:       []string{"en"},
+		AdvertiseAcceptPatch: true,
+		RespondToOptions:     true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	var h ConnegHandler
+
+	headers := map[string]string{"Accept": "*/*", "Accept-Language": "en"}
+	r := newConnegRequest(t, "http://foo.com", headers)
+	r.Method = http.MethodOptions
+	if !m.Match(r) {
+		t.Fatal("OPTIONS request should match")
+	}
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("OPTIONS request should be answered by the handler, got status %d", w.Code)
+	}
+	for header, want := range map[string]string{
+		"Accept-Patch": "application/merge-patch+json, application/json-patch+json",
+		"Allow":        "GET, HEAD, OPTIONS, PATCH",
+		"Vary":         "Accept, Accept-Language",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("Expected %s %q, got %q", header, want, got)
+		}
+	}
+
+	r = newConnegRequest(t, "http://foo.com", headers)
+	if !m.Match(r) {
+		t.Fatal("GET request should match")
+	}
+	w = httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusTeapot {
+		t.Errorf("GET request should be passed on, got status %d", w.Code)
+	}
+	if got := w.Header().Get("Accept-Patch"); got == "" {
+		t.Error("GET response should advertise Accept-Patch")
+	}
+	if got := w.Header().Get("Allow"); got != "" {
+		t.Errorf("GET response should not get an Allow header, got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	if err := h.ServeHTTP(w, newConnegRequest(t, "http://foo.com", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusTeapot || w.Header().Get("Accept-Patch") != "" {
+		t.Error("Requests not matched by a conneg matcher should be passed on unchanged")
+	}
+}
+
+func TestRememberNegotiationCookie(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:                []string{"text/html", "application/rdf+xml"},
+		ForceCookieType:           "format",
+		RememberNegotiationCookie: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	var h ConnegHandler
+
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/rdf+xml"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Set-Cookie"); !strings.HasPrefix(got, "format=rdf;") || !strings.Contains(got, "Max-Age=3600") {
+		t.Errorf("Expected a cookie remembering the negotiated type, got %q", got)
+	}
+
+	// the cookie takes precedence over the Accept header of later requests
+	r = newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Cookie": "format=rdf"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	w = httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Errorf("Forced types should not be remembered again, got %q", got)
+	}
+	if v := caddyhttp.GetVar(r.Context(), advertisementVar); v != nil {
+		t.Errorf("Expected nothing to do for the handler, got %v", v)
+	}
+}
+
+func TestNoteHeader(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:               []string{"text/html", "application/json"},
+		MatchLanguages:           []string{"en", "de"},
+		MatchCharsets:            []string{"utf-8"},
+		ForceLanguageQueryString: "lang",
+		NoteHeader:               true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	var h ConnegHandler
+
+	tests := []struct {
+		url     string
+		headers map[string]string
+		note    string
+	}{
+		{
+			"http://foo.com",
+			map[string]string{"Accept": "application/json;q=0.8, text/html;q=0.5", "Accept-Language": "de-AT;q=0.7, fr", "Accept-Charset": "*;q=0.3"},
+			"type=application/json;source=header;q=0.800, language=de;source=header;q=0.700, charset=utf-8;source=header;q=0.300",
+		},
+		{
+			"http://foo.com?lang=en",
+			map[string]string{"Accept": "*/*", "Accept-Language": "de"},
+			"type=text/html;source=header;q=1.000, language=en;source=query, charset=utf-8;source=default",
+		},
+	}
+	for _, test := range tests {
+		r := newConnegRequest(t, test.url, test.headers)
+		if !m.Match(r) {
+			t.Fatalf("%s %v: request should match", test.url, test.headers)
+		}
+		w := httptest.NewRecorder()
+		if err := h.ServeHTTP(w, r, next); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Header().Get("X-Content-Negotiation"); got != test.note {
+			t.Errorf("%s %v: expected note %q, got %q", test.url, test.headers, test.note, got)
+		}
+	}
+
+	m.NoteHeader = false
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "en"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("X-Content-Negotiation"); got != "" {
+		t.Errorf("Expected no note without note_header, got %q", got)
+	}
+}
+
+func TestClientHints(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"image/jpeg", "image/webp", "image/avif"},
+		VarType:        "type",
+		UseClientHints: true,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	var h ConnegHandler
+
+	for _, test := range []struct {
+		headers map[string]string
+		_type   string
+	}{
+		{map[string]string{"Accept": "*/*", "Sec-CH-UA-Full-Version-List": `"Chromium";v="119.0.6045.105", "Google Chrome";v="119.0.6045.105", "Not?A_Brand";v="24.0.0.0"`}, "image/avif"},
+		{map[string]string{"Accept": "image/*", "Sec-CH-UA": `"Chromium";v="80", "Google Chrome";v="80"`}, "image/webp"},
+		{map[string]string{"Accept": "*/*", "Sec-CH-UA": `"Chromium";v="20"`}, "image/jpeg"},
+		{map[string]string{"Accept": "*/*"}, "image/jpeg"},
+		// hints do not override what the client asks for
+		{map[string]string{"Accept": "image/jpeg", "Sec-CH-UA": `"Chromium";v="119"`}, "image/jpeg"},
+		{map[string]string{"Accept": "*/*, image/avif;q=0", "Sec-CH-UA": `"Chromium";v="119"`}, "image/webp"},
+	} {
+		r := newConnegRequest(t, "http://foo.com", test.headers)
+		if !m.Match(r) {
+			t.Errorf("%v: request should match", test.headers)
+			continue
+		}
+		if v := caddyhttp.GetVar(r.Context(), "conneg_type"); v != test._type {
+			t.Errorf("%v: expected %s, got %v", test.headers, test._type, v)
+		}
+		w := httptest.NewRecorder()
+		if err := h.ServeHTTP(w, r, next); err != nil {
+			t.Fatal(err)
+		}
+		if v := w.Header().Get("Accept-CH"); v != "Sec-CH-UA-Full-Version-List" {
+			t.Errorf("Expected Accept-CH header asking for the full version list, got %q", v)
+		}
+	}
+}
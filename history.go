@@ -0,0 +1,90 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// historyEntry is the outcome of a negotiation kept in the history of a
+// matcher, see HistorySize.
+type historyEntry struct {
+	// position in the sequence of all entries, to order them
+	seq                uint64
+	Time               time.Time `json:"ts"`
+	URI                string    `json:"uri"`
+	Match              bool      `json:"match"`
+	Type               string    `json:"type,omitempty"`
+	Profile            string    `json:"profile,omitempty"`
+	Language           string    `json:"language,omitempty"`
+	LanguageConfidence string    `json:"language_confidence,omitempty"`
+	Charset            string    `json:"charset,omitempty"`
+	Encoding           string    `json:"encoding,omitempty"`
+	ContentType        string    `json:"content_type,omitempty"`
+}
+
+// negotiationHistory is a ring buffer of the last negotiations of a matcher.
+// Writers claim a slot by atomically advancing a counter and store their
+// entry in it, so that requests never wait for each other.
+type negotiationHistory struct {
+	slots []atomic.Value
+	// number of entries ever added
+	next uint64
+}
+
+// newNegotiationHistory returns a history keeping the last size entries.
+func newNegotiationHistory(size int) *negotiationHistory {
+	return &negotiationHistory{slots: make([]atomic.Value, size)}
+}
+
+// add records the result of a negotiation, replacing the oldest entry if the
+// history is full.
+func (h *negotiationHistory) add(uri string, result ConnegResult) {
+	seq := atomic.AddUint64(&h.next, 1) - 1
+	h.slots[seq%uint64(len(h.slots))].Store(&historyEntry{
+		seq:                seq,
+		Time:               time.Now().UTC(),
+		URI:                uri,
+		Match:              result.Match,
+		Type:               result.Type,
+		Profile:            result.Profile,
+		Language:           result.Language,
+		LanguageConfidence: result.LanguageConfidence,
+		Charset:            result.Charset,
+		Encoding:           result.Encoding,
+		ContentType:        result.ContentType,
+	})
+}
+
+// entries returns the entries of the history, oldest first. Entries that are
+// being replaced while they are read may be left out.
+func (h *negotiationHistory) entries() []historyEntry {
+	next := atomic.LoadUint64(&h.next)
+	var first uint64
+	if size := uint64(len(h.slots)); next > size {
+		first = next - size
+	}
+	entries := make([]historyEntry, 0, next-first)
+	for i := range h.slots {
+		entry, ok := h.slots[i].Load().(*historyEntry)
+		if ok && entry.seq >= first && entry.seq < next {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
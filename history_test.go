@@ -0,0 +1,83 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html", "application/rdf+xml"}, RegistryKey: "test_history", HistorySize: 3}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	for i, accept := range []string{"text/html", "image/png", "application/rdf+xml", "text/html"} {
+		r := newConnegRequest(t, fmt.Sprintf("http://foo.com/%d", i), map[string]string{"Accept": accept})
+		r.RequestURI = r.URL.RequestURI()
+		m.Match(r)
+	}
+
+	w := httptest.NewRecorder()
+	if err := (adminAPI{}).handleInstance(w, httptest.NewRequest(http.MethodGet, "/conneg/test_history/history", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var entries []historyEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	// the oldest entry has been replaced
+	expected := []struct {
+		uri, _type string
+		match      bool
+	}{{"/1", "", false}, {"/2", "application/rdf+xml", true}, {"/3", "text/html", true}}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %+v", len(expected), entries)
+	}
+	for i, e := range expected {
+		if entries[i].URI != e.uri || entries[i].Type != e._type || entries[i].Match != e.match || entries[i].Time.IsZero() {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, e, entries[i])
+		}
+	}
+}
+
+func TestHistoryConcurrency(t *testing.T) {
+	h := newNegotiationHistory(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.add(fmt.Sprintf("/%d/%d", i, j), ConnegResult{Match: true})
+				h.entries()
+			}
+		}(i)
+	}
+	wg.Wait()
+	entries := h.entries()
+	if len(entries) != 10 {
+		t.Fatalf("Expected a full history of 10 entries, got %d", len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].seq != entries[i-1].seq+1 {
+			t.Errorf("Expected consecutive entries, got %d after %d", entries[i].seq, entries[i-1].seq)
+		}
+	}
+}
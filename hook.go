@@ -0,0 +1,120 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(LogHook{})
+}
+
+// Hook is notified of the outcome of each negotiation, see
+// MatchConneg.Hooks. Caddy modules in the `conneg.hook` namespace that
+// implement it can add telemetry, caching or other logic to the matcher
+// without changes to this package.
+type Hook interface {
+	// OnMatch is called with the results of a request that matched.
+	OnMatch(r *http.Request, result *ConnegResult)
+	// OnMiss is called with the first dimension (like `type` or `language`)
+	// that kept a request from matching.
+	OnMiss(r *http.Request, dimension string)
+}
+
+// notifyHooks hands the outcome of a negotiation to the hooks.
+func (m MatchConneg) notifyHooks(r *http.Request, result *ConnegResult, missed string) {
+	for _, hook := range m.hooks {
+		if result.Match {
+			hook.OnMatch(r, result)
+		} else {
+			hook.OnMiss(r, missed)
+		}
+	}
+}
+
+// parseHook reads a hook directive, which names a module of the
+// `conneg.hook` namespace, configured by the rest of the line and its block
+// if the module supports that.
+func parseHook(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	mod, err := caddy.GetModule("conneg.hook." + name)
+	if err != nil {
+		return nil, d.Errf("unknown hook: %s", name)
+	}
+	hook := mod.New()
+	if unmarshaler, ok := hook.(caddyfile.Unmarshaler); ok {
+		if err := unmarshaler.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return nil, err
+		}
+	} else if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return caddyconfig.JSONModuleObject(hook, "hook", name, nil), nil
+}
+
+// LogHook is a Hook that logs the outcome of each negotiation at the info
+// level, as an example of what hooks can do.
+type LogHook struct {
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (LogHook) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "conneg.hook.log",
+		New: func() caddy.Module { return new(LogHook) },
+	}
+}
+
+// Provision sets up the hook.
+func (h *LogHook) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	return nil
+}
+
+// OnMatch logs the results of a request that matched.
+func (h LogHook) OnMatch(r *http.Request, result *ConnegResult) {
+	h.logger.Info("conneg matched",
+		zap.String("uri", r.RequestURI),
+		zap.String("type", result.Type),
+		zap.String("language", result.Language),
+		zap.String("charset", result.Charset),
+		zap.String("encoding", result.Encoding),
+	)
+}
+
+// OnMiss logs the dimension that kept a request from matching.
+func (h LogHook) OnMiss(r *http.Request, dimension string) {
+	h.logger.Info("conneg missed",
+		zap.String("uri", r.RequestURI),
+		zap.String("dimension", dimension),
+	)
+}
+
+// Interface guards
+var (
+	_ Hook              = (*LogHook)(nil)
+	_ caddy.Provisioner = (*LogHook)(nil)
+)
@@ -0,0 +1,119 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// recordingHook remembers what it has been notified of.
+type recordingHook struct {
+	matched []string
+	missed  []string
+}
+
+func (h *recordingHook) OnMatch(r *http.Request, result *ConnegResult) {
+	h.matched = append(h.matched, result.Type)
+}
+
+func (h *recordingHook) OnMiss(r *http.Request, dimension string) {
+	h.missed = append(h.missed, dimension)
+}
+
+func TestHooks(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html", "application/json"},
+		MatchLanguages: []string{"en"},
+	}
+	// recordingHook is not a registered module, so it is set up directly
+	hook := &recordingHook{}
+	m.hooks = []Hook{hook}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json", "Accept-Language": "en"}))
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "image/png", "Accept-Language": "en"}))
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "de"}))
+
+	if expected := []string{"application/json"}; !reflect.DeepEqual(hook.matched, expected) {
+		t.Errorf("Expected matches %v, got %v", expected, hook.matched)
+	}
+	if expected := []string{"type", "language"}; !reflect.DeepEqual(hook.missed, expected) {
+		t.Errorf("Expected misses %v, got %v", expected, hook.missed)
+	}
+
+	// requests exempted from negotiation match without results
+	m.AllowedMethods = []string{"GET"}
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "image/png"})
+	r.Method = http.MethodPost
+	m.Match(r)
+	if expected := []string{"application/json", ""}; !reflect.DeepEqual(hook.matched, expected) {
+		t.Errorf("Expected matches %v, got %v", expected, hook.matched)
+	}
+}
+
+func TestHookCaddyfile(t *testing.T) {
+	var m MatchConneg
+	d := caddyfile.NewTestDispenser(`conneg {
+		match_types text/html
+		hook log
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Hooks) != 1 || string(m.Hooks[0]) != `{"hook":"log"}` {
+		t.Fatalf("Expected the log hook, got %q", m.Hooks)
+	}
+	if _, err := m.MarshalCaddyfile(); err != nil {
+		t.Errorf("A hook without configuration should be written back: %v", err)
+	}
+
+	d = caddyfile.NewTestDispenser(`conneg {
+		hook log verbose
+	}`)
+	if err := (&MatchConneg{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("The log hook takes no arguments")
+	}
+}
+
+func TestLogHook(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	hook := LogHook{logger: zap.New(core)}
+	m := MatchConneg{MatchTypes: []string{"text/html"}}
+	m.hooks = []Hook{hook}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"}))
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "image/png"}))
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %d", len(entries))
+	}
+	if entries[0].Message != "conneg matched" || entries[0].ContextMap()["type"] != "text/html" {
+		t.Errorf("Unexpected entry for a match: %s %v", entries[0].Message, entries[0].ContextMap())
+	}
+	if entries[1].Message != "conneg missed" || entries[1].ContextMap()["dimension"] != "type" {
+		t.Errorf("Unexpected entry for a miss: %s %v", entries[1].Message, entries[1].ContextMap())
+	}
+}
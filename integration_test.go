@@ -0,0 +1,95 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+)
+
+// TestJSONConfig configures the matcher through Caddy's JSON config API
+// rather than the Caddyfile, so that the JSON field names are exercised.
+func TestJSONConfig(t *testing.T) {
+	tester := caddytest.NewTester(t)
+	tester.InitServer(`
+	{
+		"apps": {
+			"http": {
+				"http_port": 9080,
+				"https_port": 9443,
+				"servers": {
+					"srv0": {
+						"listen": [
+							":9080"
+						],
+						"routes": [
+							{
+								"match": [
+									{
+										"conneg": {
+											"match_types": ["text/html", "application/rdf+xml"],
+											"force_type_query_string": "format",
+											"var_type": "type",
+											"match_languages": ["en", "de"],
+											"var_language": "lang"
+										}
+									}
+								],
+								"handle": [
+									{
+										"handler": "static_response",
+										"body": "{http.vars.conneg_type} {http.vars.conneg_lang}",
+										"status_code": 200
+									}
+								],
+								"terminal": true
+							},
+							{
+								"handle": [
+									{
+										"handler": "static_response",
+										"status_code": 406
+									}
+								]
+							}
+						]
+					}
+				}
+			}
+		}
+	}`, "json")
+
+	for _, test := range []struct {
+		target  string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"http://localhost:9080/", map[string]string{"Accept": "text/html", "Accept-Language": "de-AT"}, 200, "text/html de"},
+		{"http://localhost:9080/?format=rdf", map[string]string{"Accept": "text/html", "Accept-Language": "en"}, 200, "application/rdf+xml en"},
+		{"http://localhost:9080/", map[string]string{"Accept": "application/json", "Accept-Language": "en"}, 406, ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, test.target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		tester.AssertResponse(req, test.status, test.body)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TestJSONRoundTrip guards the JSON struct tags: the configuration must
+// survive a trip through JSON, and the fields computed during provisioning
+// must not show up in it.
+func TestJSONRoundTrip(t *testing.T) {
+	implicitUTF8 := false
+	m := MatchConneg{
+		MatchTypes:               []string{"text/html", "application/json"},
+		MatchLanguages:           []string{"en", "de"},
+		MatchCharsets:            []string{"utf-8"},
+		MatchEncodings:           []string{"gzip"},
+		ForceTypeQueryString:     "format",
+		ForceLanguageQueryString: "lang",
+		ForcePriority:            []ForceMechanism{{Source: "header", Key: "X-Format"}},
+		VarType:                  "mytype",
+		VarLanguage:              "mylang",
+		VarCharset:               "mycharset",
+		VarEncoding:              "myencoding",
+		UpstreamMap:              map[string]string{"application/json": "localhost:8081"},
+		ImplicitUTF8:             &implicitUTF8,
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, computed := range []string{"omitempty", "MatchTTypes", "MatchTLanguages", "MatchTCharsets", "MatchTEncodings", "LanguageMatcher"} {
+		if bytes.Contains(data, []byte(`"`+computed+`"`)) {
+			t.Errorf("Computed field %s should not be marshaled: %s", computed, data)
+		}
+	}
+
+	var parsed MatchConneg
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.VarType != "mytype" {
+		t.Errorf("Expected VarType %q, got %q", "mytype", parsed.VarType)
+	}
+	if parsed.VarLanguage != "mylang" {
+		t.Errorf("Expected VarLanguage %q, got %q", "mylang", parsed.VarLanguage)
+	}
+	if !reflect.DeepEqual(parsed.UpstreamMap, m.UpstreamMap) || parsed.ImplicitUTF8 == nil || *parsed.ImplicitUTF8 != implicitUTF8 {
+		t.Errorf("Round trip through %s changed the matcher: expected %+v, got %+v", data, m, parsed)
+	}
+	provisionConneg(t, &parsed)
+	defer parsed.Cleanup()
+	if !parsed.Equal(&m) {
+		t.Errorf("Round trip through %s changed the matcher: expected %+v, got %+v", data, m, parsed)
+	}
+}
+
+// TestJSONModuleLoading decodes the matcher the way Caddy loads modules from
+// its JSON config (and thus from the admin API): into a new instance of the
+// module, rejecting unknown fields.
+func TestJSONModuleLoading(t *testing.T) {
+	info, err := caddy.GetModule("http.matchers.conneg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := info.New()
+	decoder := json.NewDecoder(strings.NewReader(`{"match_types": ["text/html", "application/json"], "var_type": "mytype", "match_languages": ["en"], "var_language": "mylang"}`))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(module); err != nil {
+		t.Fatal(err)
+	}
+	m := module.(*MatchConneg)
+	if m.VarType != "mytype" || m.VarLanguage != "mylang" {
+		t.Fatalf("Expected variables mytype and mylang, got %q and %q", m.VarType, m.VarLanguage)
+	}
+	provisionConneg(t, m)
+	defer m.Cleanup()
+	r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json", "Accept-Language": "en"})
+	if !m.Match(r) {
+		t.Fatal("Request should match")
+	}
+	if v := caddyhttp.GetVar(r.Context(), "conneg_mytype"); v != "application/json" {
+		t.Errorf("Expected conneg_mytype %q, got %v", "application/json", v)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
+)
+
+// durationBuckets are the bucket boundaries (in seconds) of the negotiation
+// latency histograms, which are well below a millisecond for most requests
+var durationBuckets = []float64{0.00001, 0.00002, 0.00005, 0.0001, 0.0002, 0.0005, 0.001, 0.01}
+
+// connegMetrics holds the latency histograms of each dimension, labeled by
+// whether the dimension matched, and the counter of aliases resolved to the
+// offers they stand for. Like Caddy's own metrics, they are registered with
+// the default Prometheus registry and served at the /metrics endpoint of the
+// admin API.
+var connegMetrics = struct {
+	durations        map[string]*prometheus.HistogramVec
+	aliasResolutions *prometheus.CounterVec
+}{}
+
+func init() {
+	connegMetrics.durations = make(map[string]*prometheus.HistogramVec)
+	for _, dimension := range []string{"type", "language", "charset", "encoding"} {
+		histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "conneg",
+			Name:      dimension + "_duration_seconds",
+			Help:      "Time spent negotiating the " + dimension + " of requests.",
+			Buckets:   durationBuckets,
+		}, []string{"match"})
+		prometheus.MustRegister(histogram)
+		connegMetrics.durations[dimension] = histogram
+	}
+	connegMetrics.aliasResolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "conneg",
+		Name:      "alias_resolutions_total",
+		Help:      "Number of forced values that named an offer by one of its aliases.",
+	}, []string{"alias", "resolved_to"})
+	prometheus.MustRegister(connegMetrics.aliasResolutions)
+}
+
+// observeDuration records the time spent negotiating a dimension since start.
+func observeDuration(dimension string, start time.Time, match bool) {
+	if histogram, ok := connegMetrics.durations[dimension]; ok {
+		histogram.WithLabelValues(strconv.FormatBool(match)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// countAliasResolution counts a value forced by the client that named the
+// offer it resolved to by an alias rather than by itself. The alias is
+// counted as it is listed, so that other spellings accepted with
+// normalize_query_param, like `HTML`, do not add series of their own.
+func (m MatchConneg) countAliasResolution(value, offer string) {
+	if strings.EqualFold(value, offer) {
+		return
+	}
+	aliases := m.offerAliases(offer)
+	if !slices.Contains(aliases, value) {
+		i := slices.IndexFunc(aliases, func(alias string) bool { return strings.EqualFold(alias, value) })
+		if i < 0 {
+			return
+		}
+		value = aliases[i]
+	}
+	connegMetrics.aliasResolutions.WithLabelValues(value, offer).Inc()
+}
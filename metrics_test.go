@@ -0,0 +1,104 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sampleCount returns the number of observations of a dimension's histogram.
+func sampleCount(t *testing.T, dimension string, match string) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := connegMetrics.durations[dimension].WithLabelValues(match).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestDurationMetrics(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html"},
+		MatchLanguages: []string{"en"},
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	typeMatches, typeMismatches := sampleCount(t, "type", "true"), sampleCount(t, "type", "false")
+	languageMatches, charsetMatches := sampleCount(t, "language", "true"), sampleCount(t, "charset", "true")
+
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html", "Accept-Language": "en"}))
+	m.Match(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "image/png", "Accept-Language": "en"}))
+
+	if got := sampleCount(t, "type", "true") - typeMatches; got != 1 {
+		t.Errorf("Expected 1 new matching type observation, got %d", got)
+	}
+	if got := sampleCount(t, "type", "false") - typeMismatches; got != 1 {
+		t.Errorf("Expected 1 new non-matching type observation, got %d", got)
+	}
+	if got := sampleCount(t, "language", "true") - languageMatches; got != 2 {
+		t.Errorf("Expected 2 new matching language observations, got %d", got)
+	}
+	// charsets are not negotiated
+	if got := sampleCount(t, "charset", "true") - charsetMatches; got != 0 {
+		t.Errorf("Expected no new charset observations, got %d", got)
+	}
+}
+
+func TestAliasResolutionMetrics(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html", "application/rdf+xml"}, ForceTypeQueryString: "format"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+
+	count := func(alias, resolvedTo string) float64 {
+		t.Helper()
+		var metric dto.Metric
+		if err := connegMetrics.aliasResolutions.WithLabelValues(alias, resolvedTo).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	html, rdf := count("html", "text/html"), count("rdf", "application/rdf+xml")
+
+	m.Match(newConnegRequest(t, "http://foo.com?format=html", nil))
+	m.Match(newConnegRequest(t, "http://foo.com?format=html", nil))
+	m.Match(newConnegRequest(t, "http://foo.com?format=application/rdf%2Bxml", nil))
+	m.Match(newConnegRequest(t, "http://foo.com?format=bogus", nil))
+
+	if got := count("html", "text/html") - html; got != 2 {
+		t.Errorf("Expected 2 new resolutions of html, got %v", got)
+	}
+	// types given as such are not resolved
+	if got := count("rdf", "application/rdf+xml") - rdf; got != 0 {
+		t.Errorf("Expected no new resolutions of rdf, got %v", got)
+	}
+
+	// other spellings are counted as the alias they stand for
+	m.NormalizeQueryParam = true
+	html = count("html", "text/html")
+	m.Match(newConnegRequest(t, "http://foo.com?format=HTML", nil))
+	m.Match(newConnegRequest(t, "http://foo.com?format=hTmL", nil))
+	if got := count("html", "text/html") - html; got != 2 {
+		t.Errorf("Expected 2 new resolutions of html, got %v", got)
+	}
+	for _, alias := range []string{"HTML", "hTmL"} {
+		if connegMetrics.aliasResolutions.DeleteLabelValues(alias, "text/html") {
+			t.Errorf("Expected no series for %s", alias)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// negotiationLog is a file that records of negotiations are appended to, see
+// ContentNegotiationLog. It is shared by all matchers logging to the same
+// path, so that their writes and rotations do not interfere.
+type negotiationLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	// number of matchers using the log
+	users int
+}
+
+// negotiationLogs holds the open negotiation logs by path.
+var negotiationLogs = struct {
+	sync.Mutex
+	byPath map[string]*negotiationLog
+}{byPath: make(map[string]*negotiationLog)}
+
+// negotiationRecord is a line of the negotiation log.
+type negotiationRecord struct {
+	Time       time.Time                         `json:"ts"`
+	URI        string                            `json:"uri"`
+	RemoteAddr string                            `json:"remote_addr"`
+	Match      bool                              `json:"match"`
+	SourceTag  string                            `json:"source_tag,omitempty"`
+	Dimensions map[string]negotiationRecordValue `json:"dimensions,omitempty"`
+}
+
+// negotiationRecordValue is the outcome of negotiating one dimension.
+type negotiationRecordValue struct {
+	Value   string   `json:"value,omitempty"`
+	Source  string   `json:"source,omitempty"`
+	Quality *float64 `json:"q,omitempty"`
+}
+
+// openNegotiationLog returns the log at path, opening it if no other matcher
+// uses it yet. The log has to be given back with close.
+func openNegotiationLog(path string, maxMB int) (*negotiationLog, error) {
+	negotiationLogs.Lock()
+	defer negotiationLogs.Unlock()
+	l, ok := negotiationLogs.byPath[path]
+	if !ok {
+		l = &negotiationLog{path: path}
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+		negotiationLogs.byPath[path] = l
+	}
+	l.mu.Lock()
+	// the most recently provisioned matcher decides the size
+	l.maxBytes = int64(maxMB) << 20
+	l.mu.Unlock()
+	l.users++
+	return l, nil
+}
+
+// open opens the file at the log's path for appending.
+func (l *negotiationLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("Cannot open content_negotiation_log '%s': %v", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Cannot open content_negotiation_log '%s': %v", l.path, err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// close gives back the log, closing the file when no matcher uses it anymore.
+func (l *negotiationLog) close() error {
+	negotiationLogs.Lock()
+	defer negotiationLogs.Unlock()
+	if l.users--; l.users > 0 {
+		return nil
+	}
+	delete(negotiationLogs.byPath, l.path)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// write appends a record to the log, after moving the log to `<path>.1` if
+// the record would make it larger than its maximum size.
+func (l *negotiationLog) write(record negotiationRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate replaces `<path>.1` with the current log and starts a new one.
+func (l *negotiationLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		// keep appending to the old file rather than losing records
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return l.open()
+}
+
+// logNegotiation writes the outcome of a negotiation to the negotiation log.
+func (m MatchConneg) logNegotiation(r *http.Request, result ConnegResult, typeSource string) {
+	record := negotiationRecord{
+		Time:       time.Now().UTC(),
+		URI:        r.RequestURI,
+		RemoteAddr: r.RemoteAddr,
+		Match:      result.Match,
+		SourceTag:  result.SourceTag,
+		Dimensions: make(map[string]negotiationRecordValue),
+	}
+	for _, d := range m.dimensionWeights(r, result.Type, typeSource, result.Language, result.Charset, result.Encoding) {
+		if len(d.value) == 0 {
+			continue
+		}
+		value := negotiationRecordValue{Value: d.value, Source: d.source}
+		if d.weighted {
+			quality := float64(d.weight) / 1000
+			value.Quality = &quality
+		}
+		record.Dimensions[d.dimension] = value
+	}
+	if len(result.ContentType) > 0 {
+		record.Dimensions["content_type"] = negotiationRecordValue{Value: result.ContentType}
+	}
+	if err := m.negotiationLog.write(record); err != nil && m.logger != nil {
+		m.logger.Error("writing to content_negotiation_log failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readNegotiationLog returns the records in the log file at path.
+func readNegotiationLog(t *testing.T, path string) []negotiationRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []negotiationRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record negotiationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestContentNegotiationLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conneg.log")
+	m := MatchConneg{
+		MatchTypes:            []string{"text/html", "application/rdf+xml"},
+		MatchLanguages:        []string{"en", "de"},
+		ForceTypeQueryString:  "format",
+		ContentNegotiationLog: path,
+	}
+	provisionConneg(t, &m)
+	// a second matcher shares the file
+	other := MatchConneg{MatchTypes: []string{"text/plain"}, ContentNegotiationLog: path}
+	provisionConneg(t, &other)
+
+	r := newConnegRequest(t, "http://foo.com/?format=rdf", map[string]string{"Accept-Language": "de;q=0.8, fr"})
+	r.RequestURI, r.RemoteAddr = "/?format=rdf", "192.0.2.1:4711"
+	m.Match(r)
+	other.Match(newConnegRequest(t, "http://foo.com/", map[string]string{"Accept": "image/png"}))
+
+	records := readNegotiationLog(t, path)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	record := records[0]
+	if !record.Match || record.URI != "/?format=rdf" || record.RemoteAddr != "192.0.2.1:4711" || record.Time.IsZero() {
+		t.Errorf("Unexpected request fields in %+v", record)
+	}
+	if d := record.Dimensions["type"]; d.Value != "application/rdf+xml" || d.Source != "query" || d.Quality != nil {
+		t.Errorf("Unexpected type in %+v", record)
+	}
+	if d := record.Dimensions["language"]; d.Value != "de" || d.Source != "header" || d.Quality == nil || *d.Quality != 0.8 {
+		t.Errorf("Unexpected language in %+v", record)
+	}
+	if records[1].Match || len(records[1].Dimensions) > 0 {
+		t.Errorf("Expected a record of a request not matching, got %+v", records[1])
+	}
+
+	// the file stays open as long as a matcher uses it
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	other.negotiationLog.mu.Lock()
+	other.negotiationLog.maxBytes = 300
+	other.negotiationLog.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		other.Match(newConnegRequest(t, "http://foo.com/", map[string]string{"Accept": "text/plain"}))
+	}
+	if err := other.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, current := readNegotiationLog(t, path+".1"), readNegotiationLog(t, path)
+	if len(rotated)+len(current) < 3 || len(current) == 0 || len(current) >= 3 {
+		t.Errorf("Expected the log to be rotated, got %d rotated and %d current records", len(rotated), len(current))
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 300 {
+		t.Errorf("Expected the current log to stay within its maximum size, got %v", info.Size())
+	}
+	if len(negotiationLogs.byPath) > 0 {
+		t.Errorf("Expected the log to be closed, got %v", negotiationLogs.byPath)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elnormous/contenttype"
+	"golang.org/x/text/language"
+)
+
+// dimensionWeight is the outcome of negotiating one dimension, along with
+// the quality the client's header gave it.
+type dimensionWeight struct {
+	dimension, value, source string
+	// quality times 1000, only meaningful if weighted
+	weight int
+	// whether the value has been negotiated from the client's header
+	weighted bool
+}
+
+// dimensionWeights returns the outcome of the negotiation for each dimension
+// with offers. Values negotiated from a header that turn out not to match any
+// of its entries are given the source `default`.
+func (m MatchConneg) dimensionWeights(r *http.Request, _type, typeSource, lang, charset, encoding string) []dimensionWeight {
+	var dimensions []dimensionWeight
+	add := func(dimension, value, source string, weight int, weighted bool) {
+		if weighted {
+			source = "header"
+		} else if source == "header" {
+			source = "default"
+		}
+		dimensions = append(dimensions, dimensionWeight{dimension, value, source, weight, weighted})
+	}
+
+	if len(m.matchTypes) > 0 || m.PostAuthMode {
+		weight, weighted := 0, false
+		if typeSource == "header" {
+			weight, weighted = typeWeight(strings.Join(r.Header.Values("Accept"), ", "), contenttype.NewMediaType(_type))
+		}
+		add("type", _type, typeSource, weight, weighted)
+	}
+	if len(m.MatchLanguages) > 0 {
+		source := noteSource(r, m.ForceLanguageQueryString)
+		weight, weighted := 0, false
+		if source == "header" {
+			weight, weighted = m.languageWeight(strings.Join(r.Header.Values("Accept-Language"), ", "))
+		}
+		add("language", lang, source, weight, weighted)
+	}
+	if len(m.MatchCharsets) > 0 && len(charset) > 0 {
+		source := noteSource(r, m.ForceCharsetQueryString)
+		weight, weighted := 0, false
+		if source == "header" {
+			weight, weighted = charsetOrEncodingWeight(strings.Join(r.Header.Values("Accept-Charset"), ", "), charset)
+		}
+		add("charset", charset, source, weight, weighted)
+	}
+	if len(m.MatchEncodings) > 0 && len(encoding) > 0 {
+		source := noteSource(r, m.ForceEncodingQueryString)
+		weight, weighted := 0, false
+		if source == "header" {
+			weight, weighted = charsetOrEncodingWeight(strings.Join(r.Header.Values("Accept-Encoding"), ", "), encoding)
+		}
+		add("encoding", encoding, source, weight, weighted)
+	}
+	return dimensions
+}
+
+// negotiationNote explains the results of the negotiation for the
+// X-Content-Negotiation header, as comma-separated
+// `dimension=value;source=X;q=Y` entries, one for each dimension with offers.
+// The quality is that of the client's header and only given if the value
+// has been negotiated from it.
+func (m MatchConneg) negotiationNote(r *http.Request, _type, typeSource, lang, charset, encoding string) string {
+	var entries []string
+	for _, d := range m.dimensionWeights(r, _type, typeSource, lang, charset, encoding) {
+		entry := d.dimension + "=" + quoteNoteValue(d.value) + ";source=" + d.source
+		if d.weighted {
+			entry += fmt.Sprintf(";q=%.3f", float64(d.weight)/1000)
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ", ")
+}
+
+// negotiationScore aggregates the qualities the client's headers gave the
+// negotiated values into a single score, as configured in ScoreAggregation.
+func (m MatchConneg) negotiationScore(r *http.Request, _type, typeSource, lang, charset, encoding string) string {
+	score := m.aggregateQuality(r, m.ScoreAggregation, _type, typeSource, lang, charset, encoding)
+	return strconv.FormatFloat(score, 'f', 3, 64)
+}
+
+// negotiationTTL suggests a cache lifetime in seconds for the negotiated
+// representation, see TTLVar: BaseTTL (or its default) times the average of
+// the qualities the client's headers gave the negotiated values.
+func (m MatchConneg) negotiationTTL(r *http.Request, _type, typeSource, lang, charset, encoding string) string {
+	base := m.BaseTTL
+	if base == 0 {
+		base = 3600
+	}
+	quality := m.aggregateQuality(r, "average", _type, typeSource, lang, charset, encoding)
+	return strconv.Itoa(int(math.Round(float64(base) * quality)))
+}
+
+// aggregateQuality combines the qualities the client's headers gave the
+// negotiated values as their `product` (the default), `minimum` or
+// `average`. Values the client has forced, or not asked for in particular,
+// count as 1.
+func (m MatchConneg) aggregateQuality(r *http.Request, aggregation string, _type, typeSource, lang, charset, encoding string) float64 {
+	var qualities []float64
+	for _, d := range m.dimensionWeights(r, _type, typeSource, lang, charset, encoding) {
+		quality := 1.0
+		if d.weighted {
+			quality = float64(d.weight) / 1000
+		}
+		qualities = append(qualities, quality)
+	}
+	score := 1.0
+	switch aggregation {
+	case "minimum":
+		for _, quality := range qualities {
+			if quality < score {
+				score = quality
+			}
+		}
+	case "average":
+		if len(qualities) > 0 {
+			sum := 0.0
+			for _, quality := range qualities {
+				sum += quality
+			}
+			score = sum / float64(len(qualities))
+		}
+	default:
+		for _, quality := range qualities {
+			score *= quality
+		}
+	}
+	return score
+}
+
+// noteSource tells whether a value has been forced with a query parameter or
+// negotiated from a header. (Values negotiated from a header that turn out
+// not to match any of its entries are defaults.)
+func noteSource(r *http.Request, forceString string) string {
+	if forceString != "" && len(r.Form[forceString]) > 0 {
+		return "query"
+	}
+	return "header"
+}
+
+// quoteNoteValue quotes values that would break up the note's entries.
+func quoteNoteValue(value string) string {
+	if value == "" || strings.ContainsAny(value, ",;=\" ") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// typeWeight returns the quality given to an offered type in an Accept header.
+func typeWeight(header string, offer contenttype.MediaType) (int, bool) {
+	ranges, ok := parseMediaRanges(header)
+	if !ok {
+		return 0, false
+	}
+	if best := bestMediaRange(ranges, offer); best != nil {
+		return best.weight, true
+	}
+	return 0, false
+}
+
+// languageWeight returns the highest quality given in an Accept-Language
+// header to a language matching the offered language that the header
+// negotiates to.
+func (m MatchConneg) languageWeight(header string) (int, bool) {
+	desired, q, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return 0, false
+	}
+	_, index, confidence := m.LanguageMatcher.Match(desired...)
+	if confidence == language.No {
+		return 0, false
+	}
+	offer := language.NewMatcher([]language.Tag{m.MatchTLanguages[index]})
+	weight, weighted := 0, false
+	for i, tag := range desired {
+		if _, _, c := offer.Match(tag); c != language.No && (!weighted || int(q[i]*1000+0.5) > weight) {
+			weight, weighted = int(q[i]*1000+0.5), true
+		}
+	}
+	return weight, weighted
+}
+
+// charsetOrEncodingWeight returns the quality given to an offered charset or
+// encoding in an Accept-Charset or Accept-Encoding header.
+func charsetOrEncodingWeight(header, offer string) (int, bool) {
+	if header == "" {
+		return 0, false
+	}
+	_, _, weight, err := negotiateCharsetOrEncoding(header, []CharsetOrEncoding{{Value: offer}}, false)
+	return weight, err == nil
+}
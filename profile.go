@@ -0,0 +1,106 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+// Named matcher configurations defined with the `conneg_profile` global
+// option. Since global options are evaluated before the site blocks, they
+// are available when the matchers referring to them are unmarshaled. They
+// belong to the Caddyfile being adapted: its first `conneg_profile` replaces
+// those of earlier Caddyfiles, and provisioning a matcher, which happens once
+// an adapted config is loaded, lets go of them.
+var (
+	profiles   map[string]MatchConneg
+	profilesMu sync.Mutex
+)
+
+func init() {
+	httpcaddyfile.RegisterGlobalOption("conneg_profile", parseProfile)
+}
+
+// parseProfile parses a `conneg_profile <name> { ... }` global option, the
+// block taking the same subdirectives as the conneg matcher.
+func parseProfile(d *caddyfile.Dispenser, existingVal interface{}) (interface{}, error) {
+	defined, ok := existingVal.(map[string]MatchConneg)
+	if !ok {
+		// the first profile of this Caddyfile
+		defined = make(map[string]MatchConneg)
+		profilesMu.Lock()
+		profiles = defined
+		profilesMu.Unlock()
+	}
+	for d.Next() {
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		name := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		var m MatchConneg
+		if err := m.unmarshalBlock(d); err != nil {
+			return nil, err
+		}
+		if _, ok := defined[name]; ok {
+			return nil, d.Errf("conneg profile %s is defined more than once", name)
+		}
+		profilesMu.Lock()
+		defined[name] = m
+		profilesMu.Unlock()
+	}
+	return defined, nil
+}
+
+// applyProfile fills all fields of m that have not been set from the
+// profile with the given name.
+func (m *MatchConneg) applyProfile(name string) (bool, error) {
+	profilesMu.Lock()
+	stored, ok := profiles[name]
+	profilesMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	// copy via JSON, so that m does not share slices and maps with the profile
+	buf, err := json.Marshal(stored)
+	if err != nil {
+		return false, err
+	}
+	var profile MatchConneg
+	if err := json.Unmarshal(buf, &profile); err != nil {
+		return false, err
+	}
+	dst, src := reflect.ValueOf(m).Elem(), reflect.ValueOf(profile)
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).IsExported() && dst.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return true, nil
+}
+
+// forgetProfiles drops the profiles of the last Caddyfile adapted.
+func forgetProfiles() {
+	profilesMu.Lock()
+	profiles = nil
+	profilesMu.Unlock()
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/exp/slices"
+)
+
+func TestProfile(t *testing.T) {
+	_, err := parseProfile(caddyfile.NewTestDispenser(`conneg_profile test_rdf {
+		match_types text/turtle application/ld+json
+		var_type type
+	}`), nil)
+	if err != nil {
+		t.Fatalf("Parsing profile failed: %v", err)
+	}
+
+	var m MatchConneg
+	err = m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`conneg {
+		match_languages en de
+		profile test_rdf
+	}`))
+	if err != nil {
+		t.Fatalf("Unmarshaling matcher with profile failed: %v", err)
+	}
+	if !slices.Equal(m.MatchTypes, []string{"text/turtle", "application/ld+json"}) || m.VarType != "type" {
+		t.Errorf("Fields of the profile were not applied: %+v", m)
+	}
+	if !slices.Equal(m.MatchLanguages, []string{"en", "de"}) {
+		t.Errorf("Fields of the matcher were not kept: %+v", m)
+	}
+
+	var o MatchConneg
+	err = o.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`conneg {
+		profile test_rdf
+		match_types text/turtle
+	}`))
+	if err != nil {
+		t.Fatalf("Unmarshaling matcher with profile failed: %v", err)
+	}
+	if !slices.Equal(o.MatchTypes, []string{"text/turtle"}) {
+		t.Errorf("Fields of the matcher should override the profile, got %v", o.MatchTypes)
+	}
+	var p MatchConneg
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n\tprofile test_rdf\n}")); err != nil {
+		t.Fatalf("Unmarshaling matcher with profile failed: %v", err)
+	}
+	p.MatchTypes[0] = "text/n3"
+	var q MatchConneg
+	if err := q.UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n\tprofile test_rdf\n}")); err != nil {
+		t.Fatalf("Unmarshaling matcher with profile failed: %v", err)
+	}
+	if q.MatchTypes[0] != "text/turtle" {
+		t.Errorf("Matchers should not share their lists with the profile, got %v", q.MatchTypes)
+	}
+
+	var u MatchConneg
+	if err := u.UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n\tprofile test_unknown\n}")); err == nil {
+		t.Error("Unknown profile should fail")
+	}
+}
+
+func TestProfileScope(t *testing.T) {
+	if _, err := parseProfile(caddyfile.NewTestDispenser("conneg_profile test_first {\n\tmatch_types text/html\n}"), nil); err != nil {
+		t.Fatalf("Parsing profile failed: %v", err)
+	}
+	// a Caddyfile adapted later only has its own profiles
+	if _, err := parseProfile(caddyfile.NewTestDispenser("conneg_profile test_second {\n\tmatch_types text/plain\n}"), nil); err != nil {
+		t.Fatalf("Parsing profile failed: %v", err)
+	}
+	if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n\tprofile test_first\n}")); err == nil {
+		t.Error("Profiles of an earlier Caddyfile should be unknown")
+	}
+	var m MatchConneg
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n\tprofile test_second\n}")); err != nil {
+		t.Fatalf("Unmarshaling matcher with profile failed: %v", err)
+	}
+
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if err := new(MatchConneg).UnmarshalCaddyfile(caddyfile.NewTestDispenser("conneg {\n\tprofile test_second\n}")); err == nil {
+		t.Error("Profiles should be unknown once an adapted config is provisioned")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+// ConnegResult holds the outcome of content negotiation for a request. Each
+// of the values is empty when the corresponding dimension has not been
+// negotiated or did not match.
+type ConnegResult struct {
+	// Whether the request matches all requirements of the matcher
+	Match bool
+	Type  string
+	// Profile requested with the type, see MatchProfiles
+	Profile string
+	// Language, as formatted by LanguageDisplayFormat
+	Language string
+	// `Exact`, `High` or `Low`
+	LanguageConfidence string
+	Charset            string
+	Encoding           string
+	// Type of the request body
+	ContentType string
+	// Version of the offers the result has been negotiated against, see
+	// MatchConneg.OfferListVersion. Cached results of other versions are stale.
+	OfferListVersion string
+	// Label of the matcher, see MatchConneg.SourceTag
+	SourceTag string
+}
+
+// version of the gob encoding of ConnegResult, to be raised whenever fields
+// are added or removed
+const connegResultVersion byte = 3
+
+// connegResultGob has the fields of ConnegResult without its methods, so
+// that it can be handed to the gob package without recursing.
+type connegResultGob ConnegResult
+
+// GobEncode implements gob.GobEncoder, so that results can be kept in
+// distributed caches.
+func (c ConnegResult) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(connegResultVersion)
+	if err := gob.NewEncoder(&buf).Encode(connegResultGob(c)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder.
+func (c *ConnegResult) GobDecode(data []byte) error {
+	if len(data) == 0 || data[0] != connegResultVersion {
+		return errors.New("Unsupported encoding of conneg result.")
+	}
+	var decoded connegResultGob
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&decoded); err != nil {
+		return err
+	}
+	*c = ConnegResult(decoded)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestConnegResultGob(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:     []string{"text/html", "application/json"},
+		MatchLanguages: []string{"de", "en"},
+		MatchEncodings: []string{"gzip"},
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	result := m.MatchWithResult(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "application/json", "Accept-Language": "de-AT", "Accept-Encoding": "gzip"}))
+	expected := ConnegResult{Match: true, Type: "application/json", Language: "de", LanguageConfidence: "High", Encoding: "gzip"}
+	if result != expected {
+		t.Fatalf("Expected result %+v, got %+v", expected, result)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(result); err != nil {
+		t.Fatal(err)
+	}
+	var decoded ConnegResult
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != result {
+		t.Errorf("Expected %+v after round trip, got %+v", result, decoded)
+	}
+
+	if err := decoded.GobDecode([]byte{0}); err == nil {
+		t.Error("Decoding an unknown version should fail")
+	}
+}
+
+func TestOfferListVersion(t *testing.T) {
+	negotiate := func(version string) (ConnegResult, string) {
+		m := MatchConneg{MatchTypes: []string{"text/html"}, ETagVar: "etag", OfferListVersion: version}
+		provisionConneg(t, &m)
+		defer m.Cleanup()
+		r := newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/html"})
+		result := m.MatchWithResult(r)
+		etag, _ := caddyhttp.GetVar(r.Context(), "conneg_etag").(string)
+		return result, etag
+	}
+	unversioned, unversionedETag := negotiate("")
+	v1, v1ETag := negotiate("v1")
+	v2, v2ETag := negotiate("v2")
+	if unversioned.OfferListVersion != "" || v1.OfferListVersion != "v1" || v2.OfferListVersion != "v2" {
+		t.Errorf("Expected the results to carry their version, got %+v, %+v and %+v", unversioned, v1, v2)
+	}
+	if v1 == v2 {
+		t.Error("Results of different versions should differ")
+	}
+	if unversionedETag == v1ETag || v1ETag == v2ETag {
+		t.Errorf("Expected the version to change the ETag, got %s, %s and %s", unversionedETag, v1ETag, v2ETag)
+	}
+
+	var decoded ConnegResult
+	data, err := v2.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.GobDecode(data); err != nil || decoded != v2 {
+		t.Errorf("Expected %+v after round trip, got %+v (%v)", v2, decoded, err)
+	}
+}
+
+func TestMatcherInterface(t *testing.T) {
+	var rm caddyhttp.RequestMatcher = &MatchConneg{MatchTypes: []string{"text/html"}}
+	provisionConneg(t, rm.(*MatchConneg))
+	defer rm.(*MatchConneg).Cleanup()
+	matcher, ok := rm.(Matcher)
+	if !ok {
+		t.Fatal("MatchConneg should implement Matcher")
+	}
+	if result := matcher.MatchWithResult(newConnegRequest(t, "http://foo.com", map[string]string{"Accept": "text/*"})); !result.Match || result.Type != "text/html" {
+		t.Errorf("Expected a match with type text/html, got %+v", result)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elnormous/contenttype"
+	"golang.org/x/exp/slices"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/language"
+)
+
+// Warning describes a non-fatal issue with the configuration of a matcher.
+type Warning struct {
+	// Caddyfile subdirective (or JSON field) the issue was found in
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// query parameters that are likely to be used by other handlers or applications
+var commonQueryKeys = []string{"format", "lang", "language", "locale", "charset", "encoding", "type"}
+
+// top-level media types registered with IANA, <https://www.iana.org/assignments/media-types/>
+var ianaTopLevelTypes = []string{"application", "audio", "example", "font", "haptics", "image", "message", "model", "multipart", "text", "video"}
+
+// VerifyConfig returns issues with the configuration that do not keep the
+// matcher from working, but may not be intended. Unlike Validate, it is
+// lenient: Provision merely logs the warnings.
+func (m MatchConneg) VerifyConfig() []Warning {
+	var warnings []Warning
+	warn := func(field, format string, args ...interface{}) {
+		warnings = append(warnings, Warning{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for field, types := range map[string][]string{"match_types": m.MatchTypes, "match_content_types": m.MatchContentTypes} {
+		for _, t := range types {
+			mediaType := contenttype.NewMediaType(t)
+			if mediaType.Type == "" {
+				warn(field, "'%s' is not a valid media type", t)
+			} else if mediaType.Type != "*" && !containsFold(ianaTopLevelTypes, mediaType.Type) {
+				warn(field, "'%s' has a top-level type not registered with IANA", t)
+			}
+		}
+	}
+
+	for _, l := range m.MatchLanguages {
+		tag, err := language.Raw.Parse(l)
+		if err != nil {
+			warn("match_languages", "'%s' is not a well-formed language tag: %v", l, err)
+			continue
+		}
+		if canonical, err := language.Deprecated.Canonicalize(tag); err == nil && canonical != tag {
+			warn("match_languages", "'%s' is deprecated, use '%s' instead", l, canonical)
+		}
+	}
+
+	for _, c := range m.MatchCharsets {
+		if c == "*" {
+			continue
+		}
+		if _, err := ianaindex.IANA.Encoding(c); err != nil {
+			warn("match_charsets", "'%s' is not registered with IANA as a character set", c)
+		}
+	}
+
+	if len(m.VarType) > 0 && len(m.ForceTypeQueryString) == 0 && len(m.ForceCookieType) == 0 && len(m.ForcePriority) == 0 {
+		warn("var_type", "without force_type_query_string or force_type, clients cannot override the negotiated type")
+	}
+
+	for directive, key := range m.forceQueryKeys() {
+		if slices.Contains(commonQueryKeys, strings.ToLower(key)) {
+			warn(directive, "'%s' is a common query parameter that other handlers may use, too", key)
+		}
+	}
+
+	var offers []string
+	for _, t := range m.MatchTypes {
+		if offer, _, err := splitOfferQuality(t); err == nil {
+			offers = append(offers, offer)
+		}
+	}
+	for _, t := range offers {
+		for _, alias := range m.offerAliases(t) {
+			if containsFold(offers, alias) {
+				warn("match_types", "alias '%s' of '%s' shadows the offered type '%s'", alias, t, alias)
+			}
+		}
+	}
+
+	if m.BackwardsCompatibilityMode {
+		warn("backwards_compatibility_mode", "is deprecated and will be removed, see the README for how to migrate")
+	}
+
+	return warnings
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
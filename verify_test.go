@@ -0,0 +1,249 @@
+// Copyright 2022 Andreas Wagner
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connegmatcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:               []string{"text/html", "foo/bar", "html"},
+		MatchLanguages:           []string{"en", "iw"},
+		MatchCharsets:            []string{"utf-8", "no-such-charset"},
+		VarType:                  "type",
+		ForceLanguageQueryString: "lang",
+	}
+	expected := map[string]int{"match_types": 3, "match_languages": 1, "match_charsets": 1, "var_type": 1, "force_language_query_string": 1}
+	counts := make(map[string]int)
+	for _, w := range m.VerifyConfig() {
+		counts[w.Field]++
+	}
+	for field, n := range expected {
+		if counts[field] != n {
+			t.Errorf("Expected %d warnings for %s, got %d", n, field, counts[field])
+		}
+	}
+	if len(counts) != len(expected) {
+		t.Errorf("Unexpected warnings: %v", counts)
+	}
+
+	clean := MatchConneg{
+		MatchTypes:           []string{"text/html", "*/*"},
+		MatchLanguages:       []string{"de-AT"},
+		MatchCharsets:        []string{"UTF-8", "*"},
+		VarType:              "type",
+		ForceTypeQueryString: "as",
+	}
+	if warnings := clean.VerifyConfig(); len(warnings) > 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+}
+
+func TestReservedQueryKeys(t *testing.T) {
+	for _, m := range []MatchConneg{
+		{MatchTypes: []string{"text/html"}, ForceTypeQueryString: "caddy_format"},
+		{MatchLanguages: []string{"en"}, ForceLanguageQueryString: "Caddy_lang"},
+		{MatchTypes: []string{"text/html"}, ForcePriority: []ForceMechanism{{Source: "form", Key: "caddy_type"}}},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("Query parameters reserved for Caddy should not validate: %+v", m)
+		}
+	}
+}
+
+func TestAdminWarnings(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"foo/bar"}, RegistryKey: "test_admin_warnings"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	w := httptest.NewRecorder()
+	if err := (adminAPI{}).handleWarnings(w, httptest.NewRequest(http.MethodGet, "/conneg/warnings", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var warnings map[string][]Warning
+	if err := json.Unmarshal(w.Body.Bytes(), &warnings); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings["test_admin_warnings"]) != 1 || warnings["test_admin_warnings"][0].Field != "match_types" {
+		t.Errorf("Expected a warning for match_types, got %v", warnings)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html"}, MatchLanguages: []string{"en"}, MatchCharsets: []string{"utf-8"}, RegistryKey: "test_health_check"}
+	if err := m.HealthCheck(); err == nil {
+		t.Error("Unprovisioned matcher should not be healthy")
+	}
+	provisionConneg(t, &m)
+	if err := m.HealthCheck(); err != nil {
+		t.Errorf("Provisioned matcher should be healthy: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := (adminAPI{}).handleHealth(w, httptest.NewRequest(http.MethodGet, "/conneg/health", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var health map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	// other tests may have left matchers in the registry, so only ours is checked
+	if health["test_health_check"] != "ok" {
+		t.Errorf("Expected a healthy matcher, got %v", health)
+	}
+
+	// an offer lost after provisioning
+	m.MatchTCharsets = nil
+	w = httptest.NewRecorder()
+	if err := (adminAPI{}).handleHealth(w, httptest.NewRequest(http.MethodGet, "/conneg/health", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || health["test_health_check"] == "ok" {
+		t.Errorf("Expected an unhealthy matcher, got %d %v", w.Code, health)
+	}
+
+	m.Cleanup()
+	if err := m.HealthCheck(); err == nil {
+		t.Error("Cleaned up matcher should not be healthy")
+	}
+}
+
+func TestAdminInstance(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"text/html", "application/rdf+xml"}, MatchLanguages: []string{"en"}, RegistryKey: "test_admin_instance", ExposeAdmin: true}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	hidden := MatchConneg{MatchTypes: []string{"text/html"}, RegistryKey: "test_admin_hidden"}
+	provisionConneg(t, &hidden)
+	defer hidden.Cleanup()
+
+	get := func(path string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		return w, (adminAPI{}).handleInstance(w, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	w, err := get("/conneg/test_admin_instance/aliases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aliases map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &aliases); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(aliases["text/html"], []string{"html", "htm"}) || !reflect.DeepEqual(aliases["application/rdf+xml"], []string{"rdf"}) {
+		t.Errorf("Expected the built-in aliases, got %v", aliases)
+	}
+
+	w, err = get("/conneg/test_admin_instance/offers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offers map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &offers); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"match_types": {"text/html", "application/rdf+xml"}, "match_languages": {"en"}}
+	if !reflect.DeepEqual(offers, expected) {
+		t.Errorf("Expected offers %v, got %v", expected, offers)
+	}
+
+	for _, path := range []string{"/conneg/test_admin_hidden/offers", "/conneg/unknown/offers", "/conneg/test_admin_instance/history", "/conneg/test_admin_instance"} {
+		if _, err := get(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		} else if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %v", path, err)
+		}
+	}
+}
+
+func TestAdminMatchers(t *testing.T) {
+	m := MatchConneg{MatchTypes: []string{"application/json"}, RegistryKey: "test_admin_matchers", ExampleComment: "application/json request"}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	w := httptest.NewRecorder()
+	if err := (adminAPI{}).handleMatchers(w, httptest.NewRequest(http.MethodGet, "/conneg/matchers", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var matchers map[string]matcherInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &matchers); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := matchers["test_admin_matchers"]; !ok || info.Example != "application/json request" {
+		t.Errorf("Expected the matcher to be listed with its example, got %v", matchers)
+	}
+}
+
+func TestAdminVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := (adminAPI{}).handleVersion(w, httptest.NewRequest(http.MethodGet, "/conneg/version", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var version map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &version); err != nil {
+		t.Fatal(err)
+	}
+	if version["version"] != Version {
+		t.Errorf("Expected version %s, got %v", Version, version)
+	}
+}
+
+func TestVarNames(t *testing.T) {
+	for _, m := range []MatchConneg{
+		{MatchTypes: []string{"text/html"}, VarType: "my var"},
+		{MatchTypes: []string{"text/html"}, VarTypeSubtype: "type!"},
+		{MatchLanguages: []string{"en"}, VarLanguage: "lang.code"},
+		{MatchTypes: []string{"text/html"}, ETagVar: "{etag}"},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("Invalid variable name should not validate: %+v", m)
+		}
+	}
+	m := MatchConneg{MatchTypes: []string{"text/html"}, VarType: "Type_2-a", ETagVar: "etag"}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Valid variable names should validate: %v", err)
+	}
+}
+
+func TestProvides(t *testing.T) {
+	m := MatchConneg{
+		MatchTypes:           []string{"text/html"},
+		MatchEncodings:       []string{"gzip"},
+		VarType:              "type",
+		VarEncoding:          "enc",
+		ETagVar:              "etag",
+		ScoreVar:             "type",
+		ZeroQRejectsAll:      true,
+		CoordinateWithEncode: true,
+	}
+	expected := []string{"conneg_type", "conneg_enc", "conneg_etag", sourceVar, "conneg.encoding"}
+	if got := m.Provides(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Before provisioning: expected %v, got %v", expected, got)
+	}
+	provisionConneg(t, &m)
+	defer m.Cleanup()
+	if got := m.Provides(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("After provisioning: expected %v, got %v", expected, got)
+	}
+	if got := (MatchConneg{MatchTypes: []string{"text/html"}}).Provides(); len(got) > 0 {
+		t.Errorf("Expected no variables without var_* subdirectives, got %v", got)
+	}
+}